@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rajaravivarma/go-mitm/internal/replay"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error
+	// flags registers command specific flags before parsing.
+	flags func(fs *flag.FlagSet)
+}
+
+var errUsage = errors.New("invalid usage")
+
+var commands = map[string]command{
+	"import": {
+		usage: "import -from flow|har|jsonl [flags] FILE...",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("from", "flow", "Input format: flow, har or jsonl")
+			fs.Bool("overwrite", false, "Overwrite existing keys")
+			fs.Bool("include-empty", false, "Import responses with empty bodies from captures")
+			fs.Bool("include-errors", false, "Import responses with status >= 400 from captures")
+			fs.Bool("forward-proxy", false, "Key entries for a -forward-proxy server (host key scheme unless -key-scheme or -key-policy sets one)")
+		},
+		run: runImport,
+	},
+	"export": {
+		usage: "export -to har|jsonl [-pattern GLOB] [-o FILE]",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("to", "jsonl", "Output format: har or jsonl")
+			fs.String("pattern", "*", "Glob of keys to export, relative to -key-prefix")
+			fs.String("base-url", "http://localhost", "Base URL for exported HAR request URLs")
+			fs.String("o", "-", "Output file, - for stdout")
+		},
+		run: runExport,
+	},
+	"ls": {
+		usage: "ls [-prefix PREFIX] [-pattern GLOB] [-count]",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("prefix", "", "Only list keys starting with this prefix, relative to -key-prefix")
+			fs.String("pattern", "*", "Glob of keys to list, relative to -key-prefix")
+			fs.Bool("count", false, "Print the number of matching keys instead of the keys")
+		},
+		run: runList,
+	},
+	"get": {
+		usage: "get [-json] KEY",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("json", false, "Print the stored JSON instead of the decoded response")
+		},
+		run: runGet,
+	},
+	"rm": {
+		usage: "rm [-prefix PREFIX] [-pattern GLOB] [KEY...]",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("prefix", "", "Remove every key starting with this prefix, relative to -key-prefix")
+			fs.String("pattern", "", "Remove every key matching this glob, relative to -key-prefix")
+		},
+		run: runRemove,
+	},
+	"stats": {
+		usage: "stats [-prefix PREFIX] [-pattern GLOB]",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("prefix", "", "Only summarize keys starting with this prefix, relative to -key-prefix")
+			fs.String("pattern", "*", "Glob of keys to summarize, relative to -key-prefix")
+		},
+		run: runStats,
+	},
+}
+
+// runCommand executes a subcommand against the configured store.
+func runCommand(name string, cmd command, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	store := registerStoreFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mitmredis %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	repository, err := store.open()
+	if err != nil {
+		return fmt.Errorf("storage init failed: %w", err)
+	}
+	defer func() {
+		if closeErr := repository.Close(); closeErr != nil {
+			log.Printf("storage close failed: %v", closeErr)
+		}
+	}()
+
+	err = cmd.run(context.Background(), repository, store, fs, fs.Args())
+	if errors.Is(err, errUsage) {
+		fs.Usage()
+	}
+	return err
+}
+
+func stringFlag(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.String()
+}
+
+func boolFlag(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.String() == "true"
+}
+
+func runImport(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	keyPolicy, err := store.keyPolicy(boolFlag(fs, "forward-proxy"))
+	if err != nil {
+		return err
+	}
+	options := replay.ImportOptions{
+		KeyPrefix:     store.keyPrefix,
+		Overwrite:     boolFlag(fs, "overwrite"),
+		IncludeEmpty:  boolFlag(fs, "include-empty"),
+		IncludeErrors: boolFlag(fs, "include-errors"),
+		KeyPolicy:     keyPolicy,
+	}
+
+	var importer func(context.Context, io.Reader, replay.Repository, replay.ImportOptions) (replay.ImportStats, error)
+	switch format := stringFlag(fs, "from"); format {
+	case "flow":
+		importer = replay.ImportFlows
+	case "har":
+		importer = replay.ImportHAR
+	case "jsonl":
+		importer = replay.ImportJSONL
+	default:
+		return fmt.Errorf("unsupported import format: %s", format)
+	}
+
+	for _, filename := range args {
+		stats, err := importFile(ctx, filename, repository, options, importer)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		log.Printf("%s: stored %d of %d entries (%d skipped)", filename, stats.Stored, stats.Read, stats.Skipped)
+	}
+	return nil
+}
+
+func importFile(ctx context.Context, filename string, repository replay.Repository, options replay.ImportOptions, importer func(context.Context, io.Reader, replay.Repository, replay.ImportOptions) (replay.ImportStats, error)) (replay.ImportStats, error) {
+	if filename == "-" {
+		return importer(ctx, os.Stdin, repository, options)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return replay.ImportStats{}, err
+	}
+	defer file.Close()
+	return importer(ctx, file, repository, options)
+}
+
+func runExport(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	options := replay.ExportOptions{
+		KeyPrefix: store.keyPrefix,
+		Pattern:   stringFlag(fs, "pattern"),
+		BaseURL:   stringFlag(fs, "base-url"),
+	}
+
+	var exporter func(context.Context, io.Writer, replay.Repository, replay.ExportOptions) (int, error)
+	switch format := stringFlag(fs, "to"); format {
+	case "har":
+		exporter = replay.ExportHAR
+	case "jsonl":
+		exporter = replay.ExportJSONL
+	default:
+		return fmt.Errorf("unsupported export format: %s", format)
+	}
+
+	out := io.Writer(os.Stdout)
+	if filename := stringFlag(fs, "o"); filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	written, err := exporter(ctx, out, repository, options)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d entries", written)
+	return nil
+}
+
+func runList(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	options := store.scanOptions(stringFlag(fs, "prefix"), stringFlag(fs, "pattern"))
+	if boolFlag(fs, "count") {
+		count, err := repository.Count(ctx, options)
+		if err != nil {
+			return err
+		}
+		fmt.Println(count)
+		return nil
+	}
+	keys, err := repository.List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Println(strings.TrimPrefix(key, store.keyPrefix))
+	}
+	return nil
+}
+
+func runGet(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	stored, found, err := repository.Get(ctx, store.keyPrefix+args[0])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("key not found: %s", args[0])
+	}
+
+	if boolFlag(fs, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stored)
+	}
+
+	fmt.Printf("%d %s\n", stored.StatusCode, http.StatusText(stored.StatusCode))
+	for _, header := range stored.Headers {
+		fmt.Printf("%s: %s\n", header.Key, header.Value)
+	}
+	fmt.Println()
+	body, err := base64.StdEncoding.DecodeString(stored.BodyBase64)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func runRemove(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	prefix := stringFlag(fs, "prefix")
+	pattern := stringFlag(fs, "pattern")
+	if len(args) == 0 && prefix == "" && pattern == "" {
+		return errUsage
+	}
+
+	keys := make([]string, 0, len(args))
+	for _, key := range args {
+		keys = append(keys, store.keyPrefix+key)
+	}
+	if prefix != "" || pattern != "" {
+		matched, err := repository.List(ctx, store.scanOptions(prefix, pattern))
+		if err != nil {
+			return err
+		}
+		keys = append(keys, matched...)
+	}
+
+	deleted, err := repository.Delete(ctx, keys...)
+	if err != nil {
+		return err
+	}
+	log.Printf("removed %d keys", deleted)
+	return nil
+}
+
+func runStats(ctx context.Context, repository replay.Repository, store *storeFlags, fs *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	keys, err := repository.List(ctx, store.scanOptions(stringFlag(fs, "prefix"), stringFlag(fs, "pattern")))
+	if err != nil {
+		return err
+	}
+
+	statuses := make(map[int]int)
+	methods := make(map[string]int)
+	var bodyBytes int64
+	for _, key := range keys {
+		stored, found, err := repository.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if !found {
+			continue
+		}
+		statuses[stored.StatusCode]++
+		if body, err := base64.StdEncoding.DecodeString(stored.BodyBase64); err == nil {
+			bodyBytes += int64(len(body))
+		}
+		if parts := strings.SplitN(strings.TrimPrefix(key, store.keyPrefix), "|", 3); len(parts) > 1 {
+			method, _, _ := strings.Cut(parts[1], ";")
+			methods[method]++
+		}
+	}
+
+	fmt.Printf("keys: %d\n", len(keys))
+	fmt.Printf("body bytes: %d\n", bodyBytes)
+	printCounts("methods", methods)
+	codes := make(map[string]int, len(statuses))
+	for code, count := range statuses {
+		codes[fmt.Sprint(code)] = count
+	}
+	printCounts("status codes", codes)
+	return nil
+}
+
+func printCounts(title string, counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%s:\n", title)
+	for _, name := range names {
+		fmt.Printf("  %s: %d\n", name, counts[name])
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/rajaravivarma/go-mitm/internal/replay"
+)
+
+// serverConfig is the -config file: listener, store and upstream options
+// plus the plugin chain. Each option sets the flag named by its flag tag;
+// options left out keep the flag's default and flags given on the command
+// line win over the file. Options are pointers so that zero values such as
+// "redis_db": 0 or "h2c": false are applied too. Durations are strings such
+// as "30s". Relative paths, here and in the plugin settings, are resolved
+// against the working directory, not the config file's directory.
+type serverConfig struct {
+	Listen   listenConfig          `json:"listen"`
+	Store    storeConfig           `json:"store"`
+	Upstream upstreamConfig        `json:"upstream"`
+	Plugins  []replay.PluginConfig `json:"plugins"`
+}
+
+type listenConfig struct {
+	Addr         *string `json:"addr" flag:"listen"`
+	TLSCert      *string `json:"tls_cert" flag:"tls-cert"`
+	TLSKey       *string `json:"tls_key" flag:"tls-key"`
+	H2C          *bool   `json:"h2c" flag:"h2c"`
+	ForwardProxy *bool   `json:"forward_proxy" flag:"forward-proxy"`
+	CADir        *string `json:"ca_dir" flag:"ca-dir"`
+	AdminListen  *string `json:"admin_listen" flag:"admin-listen"`
+	AdminPrefix  *string `json:"admin_prefix" flag:"admin-prefix"`
+}
+
+type storeConfig struct {
+	Type              *string `json:"type" flag:"store"`
+	KeyPrefix         *string `json:"key_prefix" flag:"key-prefix"`
+	KeyScheme         *string `json:"key_scheme" flag:"key-scheme"`
+	KeyPolicy         *string `json:"key_policy" flag:"key-policy"`
+	GRPCDescriptorSet *string `json:"grpc_descriptor_set" flag:"grpc-descriptor-set"`
+
+	RedisURL              *string `json:"redis_url" flag:"redis-url"`
+	RedisAddr             *string `json:"redis_addr" flag:"redis-addr"`
+	RedisUsername         *string `json:"redis_username" flag:"redis-username"`
+	RedisPassword         *string `json:"redis_password" flag:"redis-password"`
+	RedisDB               *int    `json:"redis_db" flag:"redis-db"`
+	RedisTimeout          *string `json:"redis_timeout" flag:"redis-timeout"`
+	RedisTLS              *bool   `json:"redis_tls" flag:"redis-tls"`
+	RedisTLSCA            *string `json:"redis_tls_ca" flag:"redis-tls-ca"`
+	RedisTLSCert          *string `json:"redis_tls_cert" flag:"redis-tls-cert"`
+	RedisTLSKey           *string `json:"redis_tls_key" flag:"redis-tls-key"`
+	RedisTLSSkipVerify    *bool   `json:"redis_tls_skip_verify" flag:"redis-tls-skip-verify"`
+	RedisPoolSize         *int    `json:"redis_pool_size" flag:"redis-pool-size"`
+	RedisIdleTimeout      *string `json:"redis_idle_timeout" flag:"redis-idle-timeout"`
+	RedisHealthCheck      *string `json:"redis_health_check" flag:"redis-health-check"`
+	RedisPipeline         *bool   `json:"redis_pipeline" flag:"redis-pipeline"`
+	RedisSentinelAddrs    *string `json:"redis_sentinel_addrs" flag:"redis-sentinel-addrs"`
+	RedisSentinelMaster   *string `json:"redis_sentinel_master" flag:"redis-sentinel-master"`
+	RedisSentinelPassword *string `json:"redis_sentinel_password" flag:"redis-sentinel-password"`
+	RedisClusterAddrs     *string `json:"redis_cluster_addrs" flag:"redis-cluster-addrs"`
+
+	SQLitePath          *string `json:"sqlite_path" flag:"sqlite-path"`
+	SQLiteTimeout       *string `json:"sqlite_timeout" flag:"sqlite-timeout"`
+	SQLiteSweepInterval *string `json:"sqlite_sweep_interval" flag:"sqlite-sweep-interval"`
+}
+
+type upstreamConfig struct {
+	URL               *string  `json:"url" flag:"upstream"`
+	Timeout           *string  `json:"timeout" flag:"upstream-timeout"`
+	Stream            *bool    `json:"stream" flag:"stream"`
+	MaxRecordBodySize *int64   `json:"max_record_body_size" flag:"max-record-body-size"`
+	SSETimeScale      *float64 `json:"sse_time_scale" flag:"sse-time-scale"`
+	WSReplayMode      *string  `json:"ws_replay_mode" flag:"ws-replay-mode"`
+}
+
+// pluginFlags only shape the default replay and record plugins, so they are
+// ignored when the config declares the chain.
+var pluginFlags = []string{
+	"log-not-found", "record-overwrite", "refresh-after", "record-ttl",
+	"record-sequence", "replay-sequence", "sequence-exhausted", "session-header",
+}
+
+// loadServerConfig reads filename and applies its options to the flags of
+// fs that were not given on the command line.
+func loadServerConfig(fs *flag.FlagSet, filename string) (serverConfig, error) {
+	var config serverConfig
+	if err := replay.LoadConfigFile(filename, &config); err != nil {
+		return serverConfig{}, err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, section := range []interface{}{config.Listen, config.Store, config.Upstream} {
+		if err := applyConfigFlags(fs, section, explicit); err != nil {
+			return serverConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+// applyConfigFlags sets the flag named by the flag tag of each field the
+// file gives.
+func applyConfigFlags(fs *flag.FlagSet, section interface{}, explicit map[string]bool) error {
+	value := reflect.ValueOf(section)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("flag")
+		field := value.Field(i)
+		if name == "" || field.IsNil() || explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(field.Elem().Interface())); err != nil {
+			return fmt.Errorf("config %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// watchPluginRules reloads the settings of the configured plugins when the
+// config file or one of the rule files it names changes, and on SIGHUP. Each
+// reload re-reads the whole config, so a failed validation keeps every
+// plugin on its previous settings.
+func watchPluginRules(filename string, configs []replay.PluginConfig, plugins []replay.Plugin, interval time.Duration) {
+	reload := func() error {
+		var current serverConfig
+		if err := replay.LoadConfigFile(filename, &current); err != nil {
+			return err
+		}
+		return replay.ReloadPlugins(plugins, current.Plugins)
+	}
+
+	var watcher replay.RuleWatcher
+	watcher.Watch(filename, reload)
+	for _, file := range replay.RuleFiles(configs) {
+		watcher.Watch(file, reload)
+	}
+	if interval > 0 {
+		go watcher.Run(context.Background(), interval)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := watcher.ReloadAll(); err != nil {
+				log.Printf("rules reload failed, keeping the previous rules: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfigFlags(t *testing.T) {
+	text := func(s string) *string { return &s }
+	on := func(b bool) *bool { return &b }
+	number := func(n int) *int { return &n }
+
+	cases := []struct {
+		name     string
+		section  interface{}
+		explicit map[string]bool
+		want     map[string]string
+		err      string
+	}{
+		{
+			name:    "unset options keep the flags",
+			section: storeConfig{},
+			want:    map[string]string{"store": "redis", "redis-db": "3", "redis-tls": "true"},
+		},
+		{
+			name:    "zero values are applied",
+			section: storeConfig{Type: text("sqlite"), RedisDB: number(0), RedisTLS: on(false)},
+			want:    map[string]string{"store": "sqlite", "redis-db": "0", "redis-tls": "false"},
+		},
+		{
+			name:    "durations parse from strings",
+			section: storeConfig{RedisTimeout: text("250ms")},
+			want:    map[string]string{"redis-timeout": "250ms"},
+		},
+		{
+			name:     "command line flags win",
+			section:  storeConfig{Type: text("sqlite"), RedisDB: number(1)},
+			explicit: map[string]bool{"store": true},
+			want:     map[string]string{"store": "redis", "redis-db": "1"},
+		},
+		{
+			name:    "invalid values name the flag",
+			section: storeConfig{RedisTimeout: text("soon")},
+			err:     "config redis-timeout:",
+		},
+	}
+	for _, tc := range cases {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		registerStoreFlags(fs)
+		if err := fs.Parse([]string{"-redis-db", "3", "-redis-tls"}); err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+
+		err := applyConfigFlags(fs, tc.section, tc.explicit)
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Fatalf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: applyConfigFlags: %v", tc.name, err)
+		}
+		for name, want := range tc.want {
+			if got := fs.Lookup(name).Value.String(); got != want {
+				t.Fatalf("%s: -%s = %q, want %q", tc.name, name, got, want)
+			}
+		}
+	}
+}
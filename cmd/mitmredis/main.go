@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,41 +17,79 @@ import (
 )
 
 func main() {
-	listenAddr := flag.String("listen", ":8090", "Address to listen on")
-	storeType := flag.String("store", "redis", "Storage backend: redis or sqlite")
-	keyPrefix := flag.String("key-prefix", "", "Prefix for storage keys")
-	logNotFound := flag.Bool("log-not-found", false, "Log cache misses")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := runCommand(os.Args[1], cmd, os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
 
-	redisAddr := flag.String("redis-addr", "127.0.0.1:6379", "Redis host:port")
-	redisPassword := flag.String("redis-password", "", "Redis password")
-	redisDB := flag.Int("redis-db", 0, "Redis database")
-	redisTimeout := flag.Duration("redis-timeout", 5*time.Second, "Redis operation timeout")
+	if err := runServer(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	sqlitePath := flag.String("sqlite-path", "mitm_flows.sqlite", "SQLite database path")
-	sqliteTimeout := flag.Duration("sqlite-timeout", 5*time.Second, "SQLite busy timeout")
+// runServer parses the server flags and serves until stopped. Errors are
+// returned rather than fatal so the deferred plugin and storage cleanup runs.
+func runServer() error {
+	configFile := flag.String("config", "", "JSON or YAML server config with listener, store and upstream options and the plugin chain; command-line flags override it")
+	reloadInterval := flag.Duration("rules-reload-interval", 2*time.Second, "Check the config and plugin rule files for changes this often (0 only reloads on SIGHUP)")
+	listenAddr := flag.String("listen", ":8090", "Address to listen on")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS (with HTTP/2) using this certificate file; requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	h2c := flag.Bool("h2c", false, "Accept cleartext HTTP/2 (prior knowledge or Upgrade: h2c), e.g. from gRPC clients without TLS")
+	store := registerStoreFlags(flag.CommandLine)
+	keyPrefix := &store.keyPrefix
+	logNotFound := flag.Bool("log-not-found", false, "Log cache misses")
 
 	recordMiss := flag.Bool("record-miss", false, "Deprecated: upstream responses are cached automatically")
 	recordOverwrite := flag.Bool("record-overwrite", false, "Overwrite stored response when recording")
+	refreshAfter := flag.Duration("refresh-after", 0, "Serve hits older than this (whole seconds) and refresh them from the upstream in the background (0 disables)")
+	recordTTL := flag.Duration("record-ttl", 0, "Expire recorded responses after this long, in whole seconds (0 keeps them); expired entries are fetched again, recorded sequences never expire")
+	recordSequence := flag.Bool("record-sequence", false, "Append every upstream response to the key's sequence; replay is disabled while recording")
+	replaySequence := flag.Bool("replay-sequence", false, "Replay recorded sequences in order per session")
+	sequenceExhausted := flag.String("sequence-exhausted", replay.SequenceRepeatLast, "When a session runs out of a sequence: repeat-last, loop or not-found")
+	sessionHeader := flag.String("session-header", replay.DefaultSessionHeader, "Request header identifying the replay session")
 	upstreamURL := flag.String("upstream", "", "Upstream base URL for cache misses")
-	upstreamTimeout := flag.Duration("upstream-timeout", 30*time.Second, "Timeout for upstream requests")
+	upstreamTimeout := flag.Duration("upstream-timeout", 30*time.Second, "Timeout for upstream responses; streamed responses and event streams only need their headers within it")
+	streamResponses := flag.Bool("stream", false, "Stream upstream responses to clients as they arrive instead of buffering them")
+	maxRecordBody := flag.Int64("max-record-body-size", replay.DefaultMaxRecordBodySize, "Largest streamed response body that is recorded, in bytes; larger ones are passed through")
+	eventTimeScale := flag.Float64("sse-time-scale", 1, "Scale the recorded spacing of server-sent events on replay (0.5 is twice as fast, negative sends without delay)")
+	wsReplay := flag.String("ws-replay-mode", replay.WebSocketOrdered, "How replayed WebSocket connections answer client messages: ordered or match")
+	forwardProxy := flag.Bool("forward-proxy", false, "Act as an HTTP forward proxy for absolute-form requests (HTTP_PROXY)")
+	caDir := flag.String("ca-dir", "", "Directory holding the root CA used to intercept HTTPS CONNECT tunnels; created on first use")
+
+	adminListen := flag.String("admin-listen", "", "Address for a separate admin API listener")
+	adminPrefix := flag.String("admin-prefix", "", "Serve the admin API under this path prefix of the main listener, e.g. /_admin")
+
+	flowFile := flag.String("flow-file", "", "mitmproxy .flow file to load into the store before serving")
+	flowOverwrite := flag.Bool("flow-overwrite", false, "Overwrite existing keys when loading the flow file")
+	flowIncludeEmpty := flag.Bool("flow-include-empty", false, "Load responses with empty bodies from the flow file")
+	flowIncludeErrors := flag.Bool("flow-include-errors", false, "Load responses with status >= 400 from the flow file")
 
 	flag.Parse()
 
-	gin.SetMode(gin.ReleaseMode)
+	var config serverConfig
+	if *configFile != "" {
+		loaded, err := loadServerConfig(flag.CommandLine, *configFile)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		config = loaded
+	}
 
-	var repository replay.Repository
-	var err error
+	gin.SetMode(gin.ReleaseMode)
 
-	switch *storeType {
-	case "redis":
-		repository = replay.NewRedisRepository(*redisAddr, *redisPassword, *redisDB, *redisTimeout)
-	case "sqlite":
-		repository, err = replay.NewSQLiteRepository(*sqlitePath, *sqliteTimeout)
-	default:
-		log.Fatalf("unsupported store type: %s", *storeType)
+	keyPolicy, err := store.keyPolicy(*forwardProxy)
+	if err != nil {
+		return err
 	}
+
+	repository, err := store.open()
 	if err != nil {
-		log.Fatalf("storage init failed: %v", err)
+		return fmt.Errorf("storage init failed: %w", err)
 	}
 	defer func() {
 		if closeErr := repository.Close(); closeErr != nil {
@@ -53,36 +97,188 @@ func main() {
 		}
 	}()
 
+	if *flowFile != "" {
+		stats, err := replay.ImportFlowFile(context.Background(), *flowFile, repository, replay.ImportOptions{
+			KeyPrefix:     *keyPrefix,
+			Overwrite:     *flowOverwrite,
+			IncludeEmpty:  *flowIncludeEmpty,
+			IncludeErrors: *flowIncludeErrors,
+			KeyPolicy:     keyPolicy,
+		})
+		if err != nil {
+			return fmt.Errorf("flow import failed: %w", err)
+		}
+		log.Printf("loaded %d of %d flows from %s", stats.Stored, stats.Read, *flowFile)
+	}
+
+	refreshAfterSeconds, err := wholeSeconds("refresh-after", *refreshAfter)
+	if err != nil {
+		return err
+	}
+	recordTTLSeconds, err := wholeSeconds("record-ttl", *recordTTL)
+	if err != nil {
+		return err
+	}
+
+	replayPlugin := &replay.ReplayPlugin{
+		BasePlugin:          replay.BasePlugin{PluginName: "replay"},
+		Enable:              !*recordSequence,
+		LogNotFound:         *logNotFound,
+		Sequence:            *replaySequence,
+		SequenceExhausted:   *sequenceExhausted,
+		SessionHeader:       *sessionHeader,
+		RefreshAfterSeconds: refreshAfterSeconds,
+	}
+	switch *sequenceExhausted {
+	case replay.SequenceRepeatLast, replay.SequenceLoop, replay.SequenceNotFound:
+	default:
+		return fmt.Errorf("invalid -sequence-exhausted: %s", *sequenceExhausted)
+	}
+	switch *wsReplay {
+	case replay.WebSocketOrdered, replay.WebSocketMatch:
+	default:
+		return fmt.Errorf("invalid -ws-replay-mode: %s", *wsReplay)
+	}
+
 	var upstream *replay.UpstreamClient
 	if *upstreamURL != "" {
 		upstream, err = replay.NewUpstreamClient(*upstreamURL, *upstreamTimeout)
 		if err != nil {
-			log.Fatalf("upstream init failed: %v", err)
+			return fmt.Errorf("upstream init failed: %w", err)
+		}
+	} else if *forwardProxy {
+		upstream = replay.NewProxyUpstreamClient(*upstreamTimeout)
+	}
+
+	var certAuthority *replay.CertAuthority
+	if *caDir != "" {
+		if !*forwardProxy {
+			return errors.New("-ca-dir requires -forward-proxy")
+		}
+		certAuthority, err = replay.LoadOrCreateCertAuthority(*caDir)
+		if err != nil {
+			return fmt.Errorf("CA init failed: %w", err)
 		}
 	}
 
-	router := replay.NewReplayRouter(repository, replay.ServerOptions{
-		KeyPrefix:       *keyPrefix,
-		LogNotFound:     *logNotFound,
-		Upstream:        upstream,
-		RecordMiss:      *recordMiss,
-		RecordOverwrite: *recordOverwrite,
-		Plugins: []replay.Plugin{
-			&replay.ReplayPlugin{
-				BasePlugin:  replay.BasePlugin{PluginName: "replay"},
-				Enable:      true,
-				LogNotFound: *logNotFound,
-			},
-			&replay.RecordPlugin{
-				BasePlugin:        replay.BasePlugin{PluginName: "record"},
-				Enable:            true,
-				Overwrite:         *recordOverwrite,
-				IgnoreStatusCodes: []int{http.StatusTooManyRequests},
-			},
+	plugins := []replay.Plugin{
+		replayPlugin,
+		&replay.RecordPlugin{
+			BasePlugin:        replay.BasePlugin{PluginName: "record"},
+			Enable:            true,
+			Overwrite:         *recordOverwrite,
+			IgnoreStatusCodes: []int{http.StatusTooManyRequests},
+			Sequence:          *recordSequence,
+			TTLSeconds:        recordTTLSeconds,
 		},
+	}
+	if len(config.Plugins) > 0 {
+		plugins, err = replay.NewPluginsFromConfig(config.Plugins)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			for _, name := range pluginFlags {
+				if f.Name == name {
+					log.Printf("-%s is ignored: %s declares the plugin chain", name, *configFile)
+				}
+			}
+		})
+		watchPluginRules(*configFile, config.Plugins, plugins, *reloadInterval)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	router, closePlugins, err := replay.NewReplayRouter(repository, replay.ServerOptions{
+		KeyPrefix:         *keyPrefix,
+		LogNotFound:       *logNotFound,
+		Upstream:          upstream,
+		RecordMiss:        *recordMiss,
+		RecordOverwrite:   *recordOverwrite,
+		ForwardProxy:      *forwardProxy,
+		CertAuthority:     certAuthority,
+		KeyPolicy:         keyPolicy,
+		AdminPrefix:       *adminPrefix,
+		StreamResponses:   *streamResponses,
+		MaxRecordBodySize: *maxRecordBody,
+		EventTimeScale:    *eventTimeScale,
+		WebSocketReplay:   *wsReplay,
+		H2C:               *h2c,
+		Plugins:           plugins,
 	})
+	if err != nil {
+		return fmt.Errorf("plugin init failed: %w", err)
+	}
+	defer func() {
+		if closeErr := closePlugins(); closeErr != nil {
+			log.Printf("plugin close failed: %v", closeErr)
+		}
+	}()
+
+	adminFailed := make(chan error, 1)
+	if *adminListen != "" {
+		admin := replay.NewAdminRouter(repository, replay.AdminOptions{
+			KeyPrefix: *keyPrefix,
+			Plugins:   plugins,
+		})
+		go func() {
+			if err := admin.Run(*adminListen); err != nil {
+				adminFailed <- fmt.Errorf("admin server error: %w", err)
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: *listenAddr, Handler: router.Handler()}
+	return serve(server, *tlsCert, *tlsKey, adminFailed)
+}
+
+// wholeSeconds converts a duration flag for the plugins, which count in whole
+// seconds, rejecting values that would otherwise be truncated.
+func wholeSeconds(name string, d time.Duration) (int, error) {
+	if d < 0 || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid -%s: %s is not a whole number of seconds", name, d)
+	}
+	return int(d / time.Second), nil
+}
+
+// shutdownTimeout bounds how long in-flight requests may take to finish
+// once the server is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, or until failed reports an
+// error, then lets in-flight requests finish so the deferred plugin and
+// storage cleanup runs after them.
+func serve(server *http.Server, tlsCert, tlsKey string, failed <-chan error) error {
+	stopped := make(chan struct{})
+	var failure error
+	go func() {
+		defer close(stopped)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-stop:
+		case failure = <-failed:
+		}
+		signal.Stop(stop)
+		log.Printf("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
 
-	if err := router.Run(*listenAddr); err != nil {
-		log.Fatalf("server error: %v", err)
+	var err error
+	if tlsCert != "" {
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server error: %w", err)
 	}
+	<-stopped
+	return failure
 }
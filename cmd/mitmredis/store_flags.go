@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rajaravivarma/go-mitm/internal/replay"
+)
+
+// storeFlags holds the storage options shared by the server and every subcommand.
+type storeFlags struct {
+	fs *flag.FlagSet
+
+	storeType string
+	keyPrefix string
+	keyScheme string
+	keyRules  string
+
+	grpcDescriptorSet string
+
+	redisURL      string
+	redisAddr     string
+	redisUsername string
+	redisPassword string
+	redisDB       int
+	redisTimeout  time.Duration
+	redisTLS      bool
+	redisTLSFiles replay.RedisTLSOptions
+
+	redisPoolSize    int
+	redisIdleTimeout time.Duration
+	redisHealthCheck time.Duration
+	redisPipeline    bool
+
+	redisSentinelAddrs    string
+	redisSentinelMaster   string
+	redisSentinelPassword string
+	redisClusterAddrs     string
+
+	sqlitePath    string
+	sqliteTimeout time.Duration
+	sqliteSweep   time.Duration
+}
+
+func registerStoreFlags(fs *flag.FlagSet) *storeFlags {
+	s := &storeFlags{fs: fs}
+	fs.StringVar(&s.storeType, "store", "redis", "Storage backend: redis or sqlite")
+	fs.StringVar(&s.keyPrefix, "key-prefix", "", "Prefix for storage keys")
+	fs.StringVar(&s.keyScheme, "key-scheme", "", "Storage key scheme: path (default) or host (default in forward-proxy mode)")
+	fs.StringVar(&s.keyRules, "key-policy", "", "Key policy file (JSON or YAML) with scheme and key rules")
+	fs.StringVar(&s.grpcDescriptorSet, "grpc-descriptor-set", "", "FileDescriptorSet (protoc --descriptor_set_out --include_imports) used to key gRPC requests by decoded content")
+
+	fs.StringVar(&s.redisURL, "redis-url", "", "Redis URL: redis:// or rediss://[user:password@]host[:port][/db]; -redis-* flags given explicitly override its parts")
+	fs.StringVar(&s.redisAddr, "redis-addr", "127.0.0.1:6379", "Redis host:port")
+	fs.StringVar(&s.redisUsername, "redis-username", "", "Redis ACL username (Redis 6+)")
+	fs.StringVar(&s.redisPassword, "redis-password", "", "Redis password")
+	fs.IntVar(&s.redisDB, "redis-db", 0, "Redis database")
+	fs.BoolVar(&s.redisTLS, "redis-tls", false, "Connect to Redis over TLS (implied by rediss:// and the other -redis-tls-* flags)")
+	fs.StringVar(&s.redisTLSFiles.CAFile, "redis-tls-ca", "", "PEM CA file used to verify the Redis server")
+	fs.StringVar(&s.redisTLSFiles.CertFile, "redis-tls-cert", "", "PEM client certificate for Redis TLS")
+	fs.StringVar(&s.redisTLSFiles.KeyFile, "redis-tls-key", "", "PEM client key for Redis TLS")
+	fs.BoolVar(&s.redisTLSFiles.InsecureSkipVerify, "redis-tls-skip-verify", false, "Skip Redis server certificate verification (local use only)")
+	fs.DurationVar(&s.redisTimeout, "redis-timeout", 5*time.Second, "Redis operation timeout")
+	fs.IntVar(&s.redisPoolSize, "redis-pool-size", 10, "Maximum open Redis connections")
+	fs.DurationVar(&s.redisIdleTimeout, "redis-idle-timeout", 5*time.Minute, "Close Redis connections idle for longer (0 disables)")
+	fs.DurationVar(&s.redisHealthCheck, "redis-health-check", 30*time.Second, "PING Redis connections idle for longer before reuse (0 disables)")
+	fs.BoolVar(&s.redisPipeline, "redis-pipeline", false, "Pipeline commands from concurrent requests over pooled connections")
+	fs.StringVar(&s.redisSentinelAddrs, "redis-sentinel-addrs", "", "Comma-separated Sentinel host:port list; the primary is discovered instead of using -redis-addr")
+	fs.StringVar(&s.redisSentinelMaster, "redis-sentinel-master", "mymaster", "Master name monitored by the Sentinels")
+	fs.StringVar(&s.redisSentinelPassword, "redis-sentinel-password", "", "Password for the Sentinels")
+	fs.StringVar(&s.redisClusterAddrs, "redis-cluster-addrs", "", "Comma-separated Redis Cluster seed host:port list")
+
+	fs.StringVar(&s.sqlitePath, "sqlite-path", "mitm_flows.sqlite", "SQLite database path")
+	fs.DurationVar(&s.sqliteTimeout, "sqlite-timeout", 5*time.Second, "SQLite busy timeout")
+	fs.DurationVar(&s.sqliteSweep, "sqlite-sweep-interval", time.Minute, "Delete expired SQLite entries this often (0 disables)")
+	return s
+}
+
+func (s *storeFlags) open() (replay.Repository, error) {
+	switch s.storeType {
+	case "redis":
+		options, err := s.redisOptions()
+		if err != nil {
+			return nil, err
+		}
+		return replay.NewRedisRepositoryWithOptions(options), nil
+	case "sqlite":
+		return replay.NewSQLiteRepositoryWithOptions(replay.SQLiteOptions{
+			Path:          s.sqlitePath,
+			Timeout:       s.sqliteTimeout,
+			SweepInterval: s.sqliteSweep,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported store type: %s", s.storeType)
+	}
+}
+
+// redisOptions starts from -redis-url when given and applies the -redis-*
+// flags set on the command line on top of it.
+func (s *storeFlags) redisOptions() (replay.RedisOptions, error) {
+	options := replay.RedisOptions{
+		Addr:     s.redisAddr,
+		Username: s.redisUsername,
+		Password: s.redisPassword,
+		DB:       s.redisDB,
+	}
+	if s.redisURL != "" {
+		parsed, err := replay.ParseRedisURL(s.redisURL)
+		if err != nil {
+			return replay.RedisOptions{}, err
+		}
+		if s.isSet("redis-addr") {
+			parsed.Addr = s.redisAddr
+		}
+		if s.isSet("redis-username") {
+			parsed.Username = s.redisUsername
+		}
+		if s.isSet("redis-password") {
+			parsed.Password = s.redisPassword
+		}
+		if s.isSet("redis-db") {
+			parsed.DB = s.redisDB
+		}
+		options = parsed
+	}
+
+	options.SentinelAddrs = splitAddrs(s.redisSentinelAddrs)
+	options.SentinelMaster = s.redisSentinelMaster
+	options.SentinelPassword = s.redisSentinelPassword
+	options.ClusterAddrs = splitAddrs(s.redisClusterAddrs)
+
+	if options.TLSConfig != nil || s.redisTLS || s.redisTLSFiles.Enabled() {
+		// Discovered nodes are verified against their own host names.
+		host := ""
+		if len(options.SentinelAddrs) == 0 && len(options.ClusterAddrs) == 0 {
+			var err error
+			host, _, err = net.SplitHostPort(options.Addr)
+			if err != nil {
+				host = options.Addr
+			}
+		}
+		config, err := s.redisTLSFiles.Config(host)
+		if err != nil {
+			return replay.RedisOptions{}, fmt.Errorf("redis TLS: %w", err)
+		}
+		options.TLSConfig = config
+	}
+
+	options.Timeout = s.redisTimeout
+	options.PoolSize = s.redisPoolSize
+	options.IdleTimeout = s.redisIdleTimeout
+	options.HealthCheckInterval = s.redisHealthCheck
+	options.Pipeline = s.redisPipeline
+	return options, nil
+}
+
+func splitAddrs(raw string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(raw, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (s *storeFlags) isSet(name string) bool {
+	set := false
+	s.fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// keyPolicy returns the policy loaded from -key-policy with -key-scheme and
+// -grpc-descriptor-set applied on top, or nil for the default. Without a
+// scheme from either, forward-proxy stores key by host. The server and
+// every importer must use the same policy or imported keys never match.
+func (s *storeFlags) keyPolicy(forwardProxy bool) (*replay.KeyPolicy, error) {
+	var policy *replay.KeyPolicy
+	if s.keyRules != "" {
+		loaded, err := replay.NewKeyPolicyFromFile(s.keyRules)
+		if err != nil {
+			return nil, fmt.Errorf("load key policy: %w", err)
+		}
+		policy = loaded
+	}
+	if s.grpcDescriptorSet != "" {
+		if policy == nil {
+			policy = &replay.KeyPolicy{}
+		}
+		if err := policy.LoadGRPCDescriptorSet(s.grpcDescriptorSet); err != nil {
+			return nil, err
+		}
+	}
+	if s.keyScheme == "" {
+		if forwardProxy && (policy == nil || policy.Scheme == "") {
+			if policy == nil {
+				return replay.NewKeyPolicy(replay.KeySchemeHost), nil
+			}
+			policy.Scheme = replay.KeySchemeHost
+		}
+		return policy, nil
+	}
+	scheme, err := replay.ParseKeyScheme(s.keyScheme)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return replay.NewKeyPolicy(scheme), nil
+	}
+	policy.Scheme = scheme
+	return policy, nil
+}
+
+// scanOptions selects keys under -key-prefix plus prefix whose remainder
+// matches pattern. Empty and "*" patterns only narrow by prefix.
+func (s *storeFlags) scanOptions(prefix, pattern string) replay.ScanOptions {
+	options := replay.ScanOptions{Prefix: s.keyPrefix + prefix}
+	if pattern != "" && pattern != "*" {
+		options.Pattern = globQuote(s.keyPrefix) + pattern
+	}
+	return options
+}
+
+// globQuote escapes the glob characters of literal so that it only matches
+// itself.
+func globQuote(literal string) string {
+	var builder strings.Builder
+	for _, r := range literal {
+		if r == '*' || r == '?' || r == '\\' {
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
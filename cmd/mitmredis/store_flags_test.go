@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/rajaravivarma/go-mitm/internal/replay"
+)
+
+func TestScanOptions(t *testing.T) {
+	cases := []struct {
+		keyPrefix string
+		prefix    string
+		pattern   string
+		want      replay.ScanOptions
+	}{
+		{"", "", "", replay.ScanOptions{}},
+		{"", "/api/", "", replay.ScanOptions{Prefix: "/api/"}},
+		{"svc:", "/api/", "*", replay.ScanOptions{Prefix: "svc:/api/"}},
+		{"svc:", "", "/api/*|GET|", replay.ScanOptions{Prefix: "svc:", Pattern: "svc:/api/*|GET|"}},
+		{"svc:", "/api/", "/api/v?/*", replay.ScanOptions{Prefix: "svc:/api/", Pattern: "svc:/api/v?/*"}},
+		{`a*b?\:`, "", "/x*", replay.ScanOptions{Prefix: `a*b?\:`, Pattern: `a\*b\?\\:/x*`}},
+	}
+	for _, tc := range cases {
+		store := registerStoreFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+		store.keyPrefix = tc.keyPrefix
+		if got := store.scanOptions(tc.prefix, tc.pattern); got != tc.want {
+			t.Fatalf("scanOptions(%q, %q) with key prefix %q = %#v, want %#v", tc.prefix, tc.pattern, tc.keyPrefix, got, tc.want)
+		}
+	}
+}
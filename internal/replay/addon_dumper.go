@@ -17,6 +17,10 @@ type Dumper struct {
 	BasePlugin
 	out   io.Writer
 	level int
+	// file is the output opened by NewDumperWithFilename, closed by Close.
+	file *os.File
+	// filename names file, so a reload can tell whether it changed.
+	filename string
 }
 
 func NewDumper(out io.Writer, level int) *Dumper {
@@ -31,7 +35,19 @@ func NewDumperWithFilename(filename string, level int) (*Dumper, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewDumper(out, level), nil
+	dumper := NewDumper(out, level)
+	dumper.file = out
+	dumper.filename = filename
+	return dumper, nil
+}
+
+// Close closes the file the dumper opened; writers passed to NewDumper are
+// left to their owner.
+func (d *Dumper) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
 }
 
 func (d *Dumper) OnResponse(ctx *RequestContext, stored *StoredResponse) error {
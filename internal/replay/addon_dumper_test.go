@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -40,3 +41,19 @@ func TestDumperWritesOutput(t *testing.T) {
 		t.Fatalf("missing body: %s", got)
 	}
 }
+
+func TestDumperCloseClosesItsFile(t *testing.T) {
+	dumper, err := NewDumperWithFilename(filepath.Join(t.TempDir(), "dump.log"), 0)
+	if err != nil {
+		t.Fatalf("NewDumperWithFilename: %v", err)
+	}
+	if err := dumper.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := dumper.Close(); err == nil {
+		t.Fatalf("expected the file to be closed already")
+	}
+	if err := NewDumper(&bytes.Buffer{}, 0).Close(); err != nil {
+		t.Fatalf("Close without a file: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Header operations of a HeaderRewrite rule.
+const (
+	HeaderAdd     = "add"
+	HeaderSet     = "set"
+	HeaderRemove  = "remove"
+	HeaderReplace = "replace"
+)
+
+// HeaderOp changes one header. add appends Value, set replaces every value
+// with Value, remove drops the header, and replace rewrites each value's
+// matches of the regular expression Pattern with Value, which may refer to
+// groups as $1.
+type HeaderOp struct {
+	Op      string `json:"op"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Pattern string `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+func (op *HeaderOp) apply(headers *[]Header) {
+	switch op.Op {
+	case HeaderAdd:
+		*headers = append(*headers, Header{Key: op.Name, Value: op.Value})
+	case HeaderSet:
+		removeHeader(headers, op.Name)
+		updateHeader(headers, op.Name, op.Value)
+	case HeaderRemove:
+		removeHeader(headers, op.Name)
+	case HeaderReplace:
+		// The pattern is compiled by validate; ops that skipped it are
+		// left alone.
+		if op.pattern == nil {
+			return
+		}
+		for i, header := range *headers {
+			if strings.EqualFold(header.Key, op.Name) {
+				(*headers)[i].Value = op.pattern.ReplaceAllString(header.Value, op.Value)
+			}
+		}
+	}
+}
+
+func (op *HeaderOp) validate() error {
+	if op.Name == "" {
+		return errors.New("no header name")
+	}
+	switch op.Op {
+	case HeaderAdd, HeaderSet, HeaderRemove:
+		return nil
+	case HeaderReplace:
+		pattern, err := regexp.Compile(op.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", op.Pattern, err)
+		}
+		op.pattern = pattern
+		return nil
+	default:
+		return fmt.Errorf("invalid op %q", op.Op)
+	}
+}
+
+// HeaderRewriteRule applies its Request operations to the requests it
+// selects before the cache lookup and its Response operations to their
+// responses, replayed or fetched. Response operations change what is written
+// and recorded, except for streamed responses, event streams and WebSocket
+// connections, which reach the client first; for those they only change the
+// recording.
+type HeaderRewriteRule struct {
+	RuleMatch
+	Request  []*HeaderOp `json:"request"`
+	Response []*HeaderOp `json:"response"`
+}
+
+// HeaderRewrite adds, sets, removes or rewrites request and response headers.
+// Every rule that selects the request applies, in order.
+// Request operations run after the key is built, so they change what is
+// forwarded upstream but not which entry is replayed.
+type HeaderRewrite struct {
+	BasePlugin
+	Rules  []*HeaderRewriteRule `json:"rules"`
+	Enable bool                 `json:"enable"`
+
+	// settings guards Rules and Enable against a reload swapping them while
+	// requests run.
+	settings sync.RWMutex
+}
+
+func (hr *HeaderRewrite) OnRequest(ctx *RequestContext) error {
+	hr.settings.RLock()
+	defer hr.settings.RUnlock()
+	if ctx == nil || ctx.Request == nil {
+		return nil
+	}
+	var headers []Header
+	changed := false
+	for _, rule := range matchingRules(hr.Rules, ctx) {
+		if len(rule.Request) == 0 {
+			continue
+		}
+		if !changed {
+			headers = sortedHeaders(ctx.Request.Header)
+			changed = true
+		}
+		for _, op := range rule.Request {
+			op.apply(&headers)
+		}
+		log.Printf("header rewrite %s: request %s", ruleName(rule.Name), ctx.Request.URL.Path)
+	}
+	if changed {
+		ctx.Request.Header = storedHeaderToHTTP(headers)
+	}
+	return nil
+}
+
+func (hr *HeaderRewrite) OnResponse(ctx *RequestContext, stored *StoredResponse) error {
+	hr.settings.RLock()
+	defer hr.settings.RUnlock()
+	if ctx == nil || ctx.Request == nil || stored == nil {
+		return nil
+	}
+	for _, rule := range matchingRules(hr.Rules, ctx) {
+		for _, op := range rule.Response {
+			op.apply(&stored.Headers)
+		}
+	}
+	return nil
+}
+
+func (hr *HeaderRewrite) validate() error {
+	for i, rule := range hr.Rules {
+		if rule == nil {
+			return fmt.Errorf("%d empty rule", i)
+		}
+		if err := validateHeaderOps(rule.Request); err != nil {
+			return fmt.Errorf("%d request %w", i, err)
+		}
+		if err := validateHeaderOps(rule.Response); err != nil {
+			return fmt.Errorf("%d response %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateHeaderOps(ops []*HeaderOp) error {
+	for i, op := range ops {
+		if op == nil {
+			return fmt.Errorf("op %d: empty op", i)
+		}
+		if err := op.validate(); err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (hr *HeaderRewrite) enabled() bool {
+	hr.settings.RLock()
+	defer hr.settings.RUnlock()
+	return hr.Enable
+}
+
+// swapSettings takes over the rules of next, a freshly loaded copy.
+func (hr *HeaderRewrite) swapSettings(next Plugin) error {
+	loaded, ok := next.(*HeaderRewrite)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", hr.Name(), next)
+	}
+	hr.settings.Lock()
+	defer hr.settings.Unlock()
+	hr.Rules = loaded.Rules
+	hr.Enable = loaded.Enable
+	return nil
+}
+
+func NewHeaderRewriteFromFile(filename string) (*HeaderRewrite, error) {
+	var headerRewrite HeaderRewrite
+	if err := newStructFromFile(filename, &headerRewrite); err != nil {
+		return nil, err
+	}
+	if headerRewrite.PluginName == "" {
+		headerRewrite.PluginName = "header-rewrite"
+	}
+	if err := headerRewrite.validate(); err != nil {
+		return nil, err
+	}
+	return &headerRewrite, nil
+}
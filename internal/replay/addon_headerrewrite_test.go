@@ -0,0 +1,117 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeaderRewriteFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers.yaml")
+	rules := `enable: true
+rules:
+  - name: api
+    enable: true
+    match:
+      path: /api/*
+    request:
+      - {op: remove, name: Authorization}
+      - {op: set, name: X-Api-Key, value: test-key}
+    response:
+      - {op: remove, name: Set-Cookie}
+      - {op: replace, name: Cache-Control, pattern: 'max-age=\d+', value: max-age=0}
+      - {op: add, name: X-Replayed, value: "yes"}
+`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	rewrite, err := NewHeaderRewriteFromFile(path)
+	if err != nil {
+		t.Fatalf("NewHeaderRewriteFromFile: %v", err)
+	}
+	if rewrite.Name() != "header-rewrite" {
+		t.Fatalf("unexpected name %s", rewrite.Name())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/users", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "real-key")
+	req.Header.Add("X-Api-Key", "other-key")
+	ctx := &RequestContext{Request: req}
+	if err := rewrite.OnRequest(ctx); err != nil {
+		t.Fatalf("OnRequest: %v", err)
+	}
+	if got := ctx.Request.Header.Get("Authorization"); got != "" {
+		t.Fatalf("expected Authorization to be removed, got %q", got)
+	}
+	if got := ctx.Request.Header.Values("X-Api-Key"); len(got) != 1 || got[0] != "test-key" {
+		t.Fatalf("unexpected X-Api-Key: %v", got)
+	}
+
+	stored := &StoredResponse{
+		StatusCode: http.StatusOK,
+		Headers: []Header{
+			{Key: "Set-Cookie", Value: "a=1"},
+			{Key: "Cache-Control", Value: "public, max-age=3600"},
+			{Key: "set-cookie", Value: "b=2"},
+		},
+	}
+	if err := rewrite.OnResponse(ctx, stored); err != nil {
+		t.Fatalf("OnResponse: %v", err)
+	}
+	want := []Header{
+		{Key: "Cache-Control", Value: "public, max-age=0"},
+		{Key: "X-Replayed", Value: "yes"},
+	}
+	if len(stored.Headers) != len(want) {
+		t.Fatalf("unexpected headers: %#v", stored.Headers)
+	}
+	for i, header := range want {
+		if stored.Headers[i] != header {
+			t.Fatalf("unexpected headers: %#v", stored.Headers)
+		}
+	}
+}
+
+func TestHeaderRewriteSkipsOtherRequests(t *testing.T) {
+	rewrite := &HeaderRewrite{
+		BasePlugin: BasePlugin{PluginName: "header-rewrite"},
+		Enable:     true,
+		Rules: []*HeaderRewriteRule{
+			{
+				RuleMatch: RuleMatch{Enable: true, Match: RequestMatch{Host: "api.example.com"}},
+				Request:   []*HeaderOp{{Op: HeaderRemove, Name: "Authorization"}},
+				Response:  []*HeaderOp{{Op: HeaderRemove, Name: "Set-Cookie"}},
+			},
+		},
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	ctx := &RequestContext{Request: req}
+	if err := rewrite.OnRequest(ctx); err != nil {
+		t.Fatalf("OnRequest: %v", err)
+	}
+	stored := &StoredResponse{Headers: []Header{{Key: "Set-Cookie", Value: "a=1"}}}
+	if err := rewrite.OnResponse(ctx, stored); err != nil {
+		t.Fatalf("OnResponse: %v", err)
+	}
+	if req.Header.Get("Authorization") == "" || len(stored.Headers) != 1 {
+		t.Fatalf("expected an unmatched request to keep its headers")
+	}
+}
+
+func TestHeaderRewriteValidate(t *testing.T) {
+	cases := map[string]*HeaderOp{
+		"unknown op":      {Op: "append", Name: "X-Test"},
+		"no name":         {Op: HeaderSet, Value: "1"},
+		"invalid pattern": {Op: HeaderReplace, Name: "X-Test", Pattern: "("},
+	}
+	for name, op := range cases {
+		rewrite := &HeaderRewrite{Rules: []*HeaderRewriteRule{{Response: []*HeaderOp{op}}}}
+		if err := rewrite.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
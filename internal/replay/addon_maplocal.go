@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 type mapLocalTo struct {
@@ -21,11 +22,8 @@ type mapLocalItem struct {
 	Enable bool        `json:"enable"`
 }
 
-func (item *mapLocalItem) match(req *RequestContext) bool {
-	if !item.Enable {
-		return false
-	}
-	return item.From.match(req.Request)
+func (item *mapLocalItem) selects(ctx *RequestContext) bool {
+	return item.Enable && item.From.match(ctx.Request)
 }
 
 func (item *mapLocalItem) response(req *RequestContext) (string, *StoredResponse) {
@@ -89,21 +87,23 @@ type MapLocal struct {
 	BasePlugin
 	Items  []*mapLocalItem `json:"items"`
 	Enable bool            `json:"enable"`
+
+	// settings guards Items and Enable against a reload swapping them while
+	// requests run.
+	settings sync.RWMutex
 }
 
 func (ml *MapLocal) OnRequest(ctx *RequestContext) error {
-	if !ml.Enable {
+	ml.settings.RLock()
+	defer ml.settings.RUnlock()
+	items := matchingRules(ml.Items, ctx)
+	if len(items) == 0 {
 		return nil
 	}
-	for _, item := range ml.Items {
-		if item.match(ctx) {
-			aurl := ctx.Request.URL.String()
-			localfile, resp := item.response(ctx)
-			log.Printf("map local %s to %s", aurl, localfile)
-			ctx.Response = resp
-			return nil
-		}
-	}
+	aurl := ctx.Request.URL.String()
+	localfile, resp := items[0].response(ctx)
+	log.Printf("map local %s to %s", aurl, localfile)
+	ctx.Response = resp
 	return nil
 }
 
@@ -125,6 +125,25 @@ func (ml *MapLocal) validate() error {
 	return nil
 }
 
+func (ml *MapLocal) enabled() bool {
+	ml.settings.RLock()
+	defer ml.settings.RUnlock()
+	return ml.Enable
+}
+
+// swapSettings takes over the items of next, a freshly loaded copy.
+func (ml *MapLocal) swapSettings(next Plugin) error {
+	loaded, ok := next.(*MapLocal)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", ml.Name(), next)
+	}
+	ml.settings.Lock()
+	defer ml.settings.Unlock()
+	ml.Items = loaded.Items
+	ml.Enable = loaded.Enable
+	return nil
+}
+
 func NewMapLocalFromFile(filename string) (*MapLocal, error) {
 	var mapLocal MapLocal
 	if err := newStructFromFile(filename, &mapLocal); err != nil {
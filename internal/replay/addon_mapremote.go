@@ -5,6 +5,7 @@ import (
 	"log"
 	"path"
 	"strings"
+	"sync"
 )
 
 // Path map rule:
@@ -26,11 +27,8 @@ type mapRemoteItem struct {
 	Enable bool         `json:"enable"`
 }
 
-func (item *mapRemoteItem) match(req *RequestContext) bool {
-	if !item.Enable {
-		return false
-	}
-	return item.From.match(req.Request)
+func (item *mapRemoteItem) selects(ctx *RequestContext) bool {
+	return item.Enable && item.From.match(ctx.Request)
 }
 
 func (item *mapRemoteItem) replace(req *RequestContext) error {
@@ -51,7 +49,7 @@ func (item *mapRemoteItem) replace(req *RequestContext) error {
 		}
 	}
 
-	key, err := buildKey(request, req.Body)
+	key, err := req.KeyPolicy.buildKey(request, req.Body)
 	if err != nil {
 		return err
 	}
@@ -63,23 +61,25 @@ type MapRemote struct {
 	BasePlugin
 	Items  []*mapRemoteItem `json:"items"`
 	Enable bool             `json:"enable"`
+
+	// settings guards Items and Enable against a reload swapping them while
+	// requests run.
+	settings sync.RWMutex
 }
 
 func (mr *MapRemote) OnRequest(ctx *RequestContext) error {
-	if !mr.Enable {
+	mr.settings.RLock()
+	defer mr.settings.RUnlock()
+	items := matchingRules(mr.Items, ctx)
+	if len(items) == 0 {
 		return nil
 	}
-	for _, item := range mr.Items {
-		if item.match(ctx) {
-			before := ctx.Request.URL.String()
-			if err := item.replace(ctx); err != nil {
-				return err
-			}
-			after := ctx.Request.URL.String()
-			log.Printf("map remote %s to %s", before, after)
-			return nil
-		}
+	before := ctx.Request.URL.String()
+	if err := items[0].replace(ctx); err != nil {
+		return err
 	}
+	after := ctx.Request.URL.String()
+	log.Printf("map remote %s to %s", before, after)
 	return nil
 }
 
@@ -104,6 +104,25 @@ func (mr *MapRemote) validate() error {
 	return nil
 }
 
+func (mr *MapRemote) enabled() bool {
+	mr.settings.RLock()
+	defer mr.settings.RUnlock()
+	return mr.Enable
+}
+
+// swapSettings takes over the items of next, a freshly loaded copy.
+func (mr *MapRemote) swapSettings(next Plugin) error {
+	loaded, ok := next.(*MapRemote)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", mr.Name(), next)
+	}
+	mr.settings.Lock()
+	defer mr.settings.Unlock()
+	mr.Items = loaded.Items
+	mr.Enable = loaded.Enable
+	return nil
+}
+
 func NewMapRemoteFromFile(filename string) (*MapRemote, error) {
 	var mapRemote MapRemote
 	if err := newStructFromFile(filename, &mapRemote); err != nil {
@@ -21,7 +21,7 @@ func TestMapRemoteItemMatch(t *testing.T) {
 		To:     nil,
 		Enable: true,
 	}
-	if !item.match(ctx) {
+	if !item.selects(ctx) {
 		t.Fatal("expected match")
 	}
 
@@ -31,7 +31,7 @@ func TestMapRemoteItemMatch(t *testing.T) {
 		Method:   []string{},
 		Path:     "/path/to/resource",
 	}
-	if !item.match(ctx) {
+	if !item.selects(ctx) {
 		t.Fatal("expected match with empty protocol/method")
 	}
 
@@ -41,7 +41,7 @@ func TestMapRemoteItemMatch(t *testing.T) {
 		Method:   []string{},
 		Path:     "/path/to/*",
 	}
-	if !item.match(ctx) {
+	if !item.selects(ctx) {
 		t.Fatal("expected match with wildcard path")
 	}
 
@@ -51,7 +51,7 @@ func TestMapRemoteItemMatch(t *testing.T) {
 		Method:   []string{},
 		Path:     "",
 	}
-	if !item.match(ctx) {
+	if !item.selects(ctx) {
 		t.Fatal("expected match with empty selectors")
 	}
 
@@ -61,7 +61,7 @@ func TestMapRemoteItemMatch(t *testing.T) {
 		Method:   []string{},
 		Path:     "/path/to/resource",
 	}
-	if item.match(ctx) {
+	if item.selects(ctx) {
 		t.Fatal("expected protocol mismatch")
 	}
 }
@@ -141,3 +141,19 @@ func TestMapRemoteItemReplace(t *testing.T) {
 		t.Fatal("expected key to be set")
 	}
 }
+
+func TestMapRemoteReplaceUsesKeyPolicy(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/v1/users", nil)
+	ctx := &RequestContext{Request: req, KeyPolicy: NewKeyPolicy(KeySchemeHost)}
+	item := &mapRemoteItem{
+		From:   &mapFrom{Host: "example.com"},
+		To:     &mapRemoteTo{Host: "staging.example.com"},
+		Enable: true,
+	}
+	if err := item.replace(ctx); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if want := "https://staging.example.com/v1/users|GET|"; ctx.Key != want {
+		t.Fatalf("got key %q want %q", ctx.Key, want)
+	}
+}
@@ -1,15 +1,18 @@
 package replay
 
 import (
+	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 type RecordRule struct {
-	Name           string       `json:"name"`
-	Enable         bool         `json:"enable"`
-	Match          RequestMatch `json:"match"`
-	AlwaysUpstream bool         `json:"always_upstream"`
-	SkipStore      bool         `json:"skip_store"`
+	RuleMatch
+	AlwaysUpstream bool `json:"always_upstream"`
+	SkipStore      bool `json:"skip_store"`
+	// TTLSeconds overrides the plugin TTL for matching requests.
+	TTLSeconds int `json:"ttl_seconds"`
 }
 
 type RecordPlugin struct {
@@ -18,6 +21,17 @@ type RecordPlugin struct {
 	Enable            bool          `json:"enable"`
 	Overwrite         bool          `json:"overwrite"`
 	IgnoreStatusCodes []int         `json:"ignore_status_codes"`
+	// Sequence appends every response to the key's sequence in addition to
+	// storing the single entry, so stateful flows can be replayed in order.
+	Sequence bool `json:"sequence"`
+	// TTLSeconds expires recorded entries; zero keeps them forever. An
+	// expired entry is a miss, so it is fetched and recorded again.
+	// Sequences are exempt: they are kept until the key is deleted.
+	TTLSeconds int `json:"ttl_seconds"`
+
+	// settings guards the exported fields against a reload swapping them
+	// while responses are recorded.
+	settings sync.RWMutex
 }
 
 func NewRecordPlugin() *RecordPlugin {
@@ -25,7 +39,9 @@ func NewRecordPlugin() *RecordPlugin {
 }
 
 func (rp *RecordPlugin) OnResponse(ctx *RequestContext, stored *StoredResponse) error {
-	if !rp.Enable || ctx == nil || ctx.Request == nil || ctx.Repository == nil || stored == nil {
+	rp.settings.RLock()
+	defer rp.settings.RUnlock()
+	if ctx == nil || ctx.Request == nil || ctx.Repository == nil || stored == nil {
 		return nil
 	}
 	if ctx.CacheHit || ctx.SkipStore {
@@ -39,21 +55,26 @@ func (rp *RecordPlugin) OnResponse(ctx *RequestContext, stored *StoredResponse)
 	}
 
 	key := ctx.KeyPrefix + ctx.Key
-	if err := ctx.Repository.Set(ctx.Request.Context(), key, *stored, rp.Overwrite); err != nil {
+	overwrite := rp.Overwrite || ctx.refresh
+	if err := ctx.Repository.SetWithTTL(ctx.Request.Context(), key, *stored, overwrite, rp.ttl(ctx)); err != nil {
 		return err
 	}
+	// A refresh replaces the entry; appending it would repeat the response
+	// in the sequence.
+	if rp.Sequence && !ctx.refresh {
+		length, err := ctx.Repository.Append(ctx.Request.Context(), key, *stored)
+		if err != nil {
+			return err
+		}
+		log.Printf("stored response %d: %s", length, key)
+		return nil
+	}
 	log.Printf("stored response: %s", key)
 	return nil
 }
 
 func (rp *RecordPlugin) shouldSkip(ctx *RequestContext) bool {
-	for _, rule := range rp.Rules {
-		if rule == nil || !rule.Enable {
-			continue
-		}
-		if !rule.Match.matches(ctx) {
-			continue
-		}
+	for _, rule := range matchingRules(rp.Rules, ctx) {
 		if rule.AlwaysUpstream || rule.SkipStore {
 			log.Printf("record rule %s: skip store", ruleName(rule.Name))
 			return true
@@ -62,6 +83,56 @@ func (rp *RecordPlugin) shouldSkip(ctx *RequestContext) bool {
 	return false
 }
 
+// ttl returns the TTL of the first matching rule that sets one, falling
+// back to the plugin TTL.
+func (rp *RecordPlugin) ttl(ctx *RequestContext) time.Duration {
+	for _, rule := range matchingRules(rp.Rules, ctx) {
+		if rule.TTLSeconds > 0 {
+			return time.Duration(rule.TTLSeconds) * time.Second
+		}
+	}
+	return time.Duration(rp.TTLSeconds) * time.Second
+}
+
+func (rp *RecordPlugin) validate() error {
+	if rp.TTLSeconds < 0 {
+		return fmt.Errorf("invalid ttl_seconds %d", rp.TTLSeconds)
+	}
+	for i, rule := range rp.Rules {
+		if rule == nil {
+			return fmt.Errorf("%d empty rule", i)
+		}
+		if rule.TTLSeconds < 0 {
+			return fmt.Errorf("%d invalid ttl_seconds %d", i, rule.TTLSeconds)
+		}
+	}
+	return nil
+}
+
+func (rp *RecordPlugin) enabled() bool {
+	rp.settings.RLock()
+	defer rp.settings.RUnlock()
+	return rp.Enable
+}
+
+// swapSettings takes over the rules and options of next, a freshly loaded
+// copy.
+func (rp *RecordPlugin) swapSettings(next Plugin) error {
+	loaded, ok := next.(*RecordPlugin)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", rp.Name(), next)
+	}
+	rp.settings.Lock()
+	defer rp.settings.Unlock()
+	rp.Rules = loaded.Rules
+	rp.Enable = loaded.Enable
+	rp.Overwrite = loaded.Overwrite
+	rp.IgnoreStatusCodes = loaded.IgnoreStatusCodes
+	rp.Sequence = loaded.Sequence
+	rp.TTLSeconds = loaded.TTLSeconds
+	return nil
+}
+
 func shouldSkipStatus(code int, codes []int) bool {
 	for _, value := range codes {
 		if value == code {
@@ -79,5 +150,8 @@ func NewRecordPluginFromFile(filename string) (*RecordPlugin, error) {
 	if record.PluginName == "" {
 		record.PluginName = "record"
 	}
+	if err := record.validate(); err != nil {
+		return nil, err
+	}
 	return &record, nil
 }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestRecordPluginStoresResponse(t *testing.T) {
@@ -52,15 +53,17 @@ func TestRecordPluginSkipRule(t *testing.T) {
 		Enable:     true,
 		Rules: []*RecordRule{
 			{
-				Name:      "skip",
-				Enable:    true,
-				SkipStore: true,
-				Match: RequestMatch{
-					Method:       []string{http.MethodPost},
-					Path:         "/submit",
-					URL:          "http://example.com/submit?a=1&b=2",
-					BodyContains: "payload",
+				RuleMatch: RuleMatch{
+					Name:   "skip",
+					Enable: true,
+					Match: RequestMatch{
+						Method:       []string{http.MethodPost},
+						Path:         "/submit",
+						URL:          "http://example.com/submit?a=1&b=2",
+						BodyContains: "payload",
+					},
 				},
+				SkipStore: true,
 			},
 		},
 	}
@@ -72,3 +75,66 @@ func TestRecordPluginSkipRule(t *testing.T) {
 		t.Fatalf("expected response to be skipped")
 	}
 }
+
+func TestRecordPluginSequence(t *testing.T) {
+	repo := newMemoryRepo()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/jobs/1", nil)
+	key, err := buildKey(req, nil)
+	if err != nil {
+		t.Fatalf("buildKey: %v", err)
+	}
+
+	plugin := NewRecordPlugin()
+	plugin.Sequence = true
+	for _, status := range []int{202, 200} {
+		ctx := &RequestContext{Request: req, Key: key, Repository: repo}
+		if err := plugin.OnResponse(ctx, &StoredResponse{StatusCode: status}); err != nil {
+			t.Fatalf("OnResponse: %v", err)
+		}
+	}
+
+	if got := repo.sequences[key]; len(got) != 2 || got[0].StatusCode != 202 || got[1].StatusCode != 200 {
+		t.Fatalf("unexpected sequence: %#v", got)
+	}
+	if stored, found, _ := repo.Get(req.Context(), key); !found || stored.StatusCode != 202 {
+		t.Fatalf("expected first response as single entry, got %#v", stored)
+	}
+
+	// A background refresh replaces the single entry only.
+	refresh := &RequestContext{Request: req, Key: key, Repository: repo, refresh: true}
+	if err := plugin.OnResponse(refresh, &StoredResponse{StatusCode: 201}); err != nil {
+		t.Fatalf("OnResponse: %v", err)
+	}
+	if got := repo.sequences[key]; len(got) != 2 {
+		t.Fatalf("refresh grew the sequence: %#v", got)
+	}
+	if stored, _, _ := repo.Get(req.Context(), key); stored.StatusCode != 201 {
+		t.Fatalf("expected the refresh to replace the entry, got %#v", stored)
+	}
+}
+
+func TestRecordPluginTTL(t *testing.T) {
+	repo := newMemoryRepo()
+	plugin := NewRecordPlugin()
+	plugin.TTLSeconds = 60
+	plugin.Rules = []*RecordRule{
+		{RuleMatch: RuleMatch{Name: "disabled", Enable: false, Match: RequestMatch{Path: "/short"}}, TTLSeconds: 1},
+		{RuleMatch: RuleMatch{Name: "short", Enable: true, Match: RequestMatch{Path: "/short"}}, TTLSeconds: 5},
+	}
+
+	cases := map[string]time.Duration{
+		"/short": 5 * time.Second,
+		"/other": 60 * time.Second,
+	}
+	for path, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		ctx := &RequestContext{Request: req, Key: path, Repository: repo}
+		if err := plugin.OnResponse(ctx, &StoredResponse{StatusCode: 200}); err != nil {
+			t.Fatalf("OnResponse: %v", err)
+		}
+		remaining := time.Until(repo.expires[path])
+		if remaining > want || remaining < want-time.Second {
+			t.Fatalf("%s expires in %v, want %v", path, remaining, want)
+		}
+	}
+}
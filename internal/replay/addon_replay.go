@@ -1,15 +1,36 @@
 package replay
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 )
 
+// Sequence exhaustion policies: what replay returns once a session has
+// consumed every recorded response of a sequence.
+const (
+	SequenceRepeatLast = "repeat-last"
+	SequenceLoop       = "loop"
+	SequenceNotFound   = "not-found"
+)
+
+// DefaultSessionHeader identifies the replay session when SessionHeader is empty.
+const DefaultSessionHeader = "X-Replay-Session"
+
+// maxSequencePositions bounds the (session, key) positions kept in memory.
+// The least recently used one is dropped first and starts over at the
+// beginning of its sequence when seen again.
+const maxSequencePositions = 100000
+
 type ReplayRule struct {
-	Name           string       `json:"name"`
-	Enable         bool         `json:"enable"`
-	Match          RequestMatch `json:"match"`
-	AlwaysUpstream bool         `json:"always_upstream"`
-	SkipReplay     bool         `json:"skip_replay"`
+	RuleMatch
+	AlwaysUpstream bool `json:"always_upstream"`
+	SkipReplay     bool `json:"skip_replay"`
 }
 
 type ReplayPlugin struct {
@@ -17,6 +38,26 @@ type ReplayPlugin struct {
 	Rules       []*ReplayRule `json:"rules"`
 	Enable      bool          `json:"enable"`
 	LogNotFound bool          `json:"log_not_found"`
+	// Sequence replays recorded response sequences in order, tracking the
+	// position per session. Keys without a sequence use the single entry.
+	// Positions are cleared by ResetSessions and bounded by
+	// maxSequencePositions.
+	Sequence          bool   `json:"sequence"`
+	SequenceExhausted string `json:"sequence_exhausted"`
+	SessionHeader     string `json:"session_header"`
+	// RefreshAfterSeconds enables stale-while-revalidate: a hit older than
+	// this is served as is while upstream is fetched in the background to
+	// replace it. Entries without a recording time count as stale. Zero
+	// disables refreshing.
+	RefreshAfterSeconds int `json:"refresh_after_seconds"`
+
+	mu         sync.Mutex
+	positions  *lruCache[string, int]
+	refreshing map[string]bool
+	refreshes  sync.WaitGroup
+	// settings guards the exported fields against a reload swapping them
+	// while requests run.
+	settings sync.RWMutex
 }
 
 func NewReplayPlugin() *ReplayPlugin {
@@ -24,7 +65,9 @@ func NewReplayPlugin() *ReplayPlugin {
 }
 
 func (rp *ReplayPlugin) OnRequest(ctx *RequestContext) error {
-	if !rp.Enable || ctx == nil || ctx.Request == nil {
+	rp.settings.RLock()
+	defer rp.settings.RUnlock()
+	if ctx == nil || ctx.Request == nil {
 		return nil
 	}
 	if rp.shouldSkip(ctx) {
@@ -39,6 +82,17 @@ func (rp *ReplayPlugin) OnRequest(ctx *RequestContext) error {
 	}
 
 	key := ctx.KeyPrefix + ctx.Key
+	if rp.Sequence {
+		stored, found, err := rp.nextInSequence(ctx, key)
+		if err != nil {
+			return err
+		}
+		if found {
+			ctx.CacheHit = true
+			ctx.Response = &stored
+			return nil
+		}
+	}
 	stored, found, err := ctx.Repository.Get(ctx.Request.Context(), key)
 	if err != nil {
 		return err
@@ -51,17 +105,144 @@ func (rp *ReplayPlugin) OnRequest(ctx *RequestContext) error {
 	}
 	ctx.CacheHit = true
 	ctx.Response = &stored
+	if rp.stale(stored) && ctx.Upstream != nil {
+		rp.refresh(ctx, key)
+	}
 	return nil
 }
 
-func (rp *ReplayPlugin) shouldSkip(ctx *RequestContext) bool {
-	for _, rule := range rp.Rules {
-		if rule == nil || !rule.Enable {
-			continue
+func (rp *ReplayPlugin) stale(stored StoredResponse) bool {
+	// An upgrade cannot be refetched with a plain request, and a refresh
+	// would flatten an event stream into a body without its timing.
+	if rp.RefreshAfterSeconds <= 0 || stored.StatusCode == http.StatusSwitchingProtocols || len(stored.Events) > 0 {
+		return false
+	}
+	age := time.Since(time.Unix(stored.RecordedAt, 0))
+	return age >= time.Duration(rp.RefreshAfterSeconds)*time.Second
+}
+
+// refresh fetches the request from upstream in the background and hands the
+// response to the chain's response plugins, so it is recorded like a miss
+// with the record plugin's TTL and rules. Only one refresh per key runs at a
+// time; failures and error statuses are logged and keep the current entry.
+func (rp *ReplayPlugin) refresh(ctx *RequestContext, key string) {
+	rp.mu.Lock()
+	if rp.refreshing[key] {
+		rp.mu.Unlock()
+		return
+	}
+	if rp.refreshing == nil {
+		rp.refreshing = make(map[string]bool)
+	}
+	rp.refreshing[key] = true
+	rp.mu.Unlock()
+
+	// The client request is finished before the refresh is, so it runs on
+	// a detached copy.
+	background := context.Background()
+	refreshCtx := *ctx
+	refreshCtx.Request = ctx.Request.Clone(background)
+	refreshCtx.Body = bytes.Clone(ctx.Body)
+	refreshCtx.Response = nil
+	refreshCtx.CacheHit = false
+	refreshCtx.refresh = true
+	upstream := ctx.Upstream
+
+	rp.refreshes.Add(1)
+	go func() {
+		defer rp.refreshes.Done()
+		defer func() {
+			rp.mu.Lock()
+			delete(rp.refreshing, key)
+			rp.mu.Unlock()
+		}()
+
+		resp, err := upstream.fetchFor(background, &refreshCtx)
+		if err != nil {
+			log.Printf("refresh %s: %v", key, err)
+			return
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("refresh %s: %v", key, err)
+			return
 		}
-		if !rule.Match.matches(ctx) {
-			continue
+		if resp.StatusCode >= http.StatusBadRequest {
+			log.Printf("refresh %s: upstream returned %d, keeping stored response", key, resp.StatusCode)
+			return
 		}
+		stored := storedResponseFromHTTP(resp, respBody)
+		if err := applyResponsePlugins(refreshCtx.plugins, &refreshCtx, &stored); err != nil {
+			log.Printf("refresh %s: %v", key, err)
+			return
+		}
+		log.Printf("refreshed response: %s", key)
+	}()
+}
+
+// drain waits for background refreshes still in flight, so their responses
+// reach the chain before any plugin closes.
+func (rp *ReplayPlugin) drain() {
+	rp.refreshes.Wait()
+}
+
+// nextInSequence returns the session's next response of the sequence at key.
+// found is false when key has no sequence.
+func (rp *ReplayPlugin) nextInSequence(ctx *RequestContext, key string) (StoredResponse, bool, error) {
+	session := ctx.Request.Header.Get(rp.sessionHeader()) + "\n" + key
+	rp.mu.Lock()
+	if rp.positions == nil {
+		rp.positions = newLRUCache[string, int](maxSequencePositions)
+	}
+	position, _ := rp.positions.get(session)
+	rp.positions.put(session, position+1)
+	rp.mu.Unlock()
+
+	stored, length, found, err := ctx.Repository.GetAt(ctx.Request.Context(), key, position)
+	if err != nil || found || length == 0 {
+		return stored, found, err
+	}
+
+	switch rp.SequenceExhausted {
+	case SequenceLoop:
+		stored, _, found, err = ctx.Repository.GetAt(ctx.Request.Context(), key, position%length)
+	case SequenceNotFound:
+		return StoredResponse{StatusCode: http.StatusNotFound, Headers: []Header{}}, true, nil
+	default:
+		stored, _, found, err = ctx.Repository.GetAt(ctx.Request.Context(), key, length-1)
+	}
+	return stored, found, err
+}
+
+// ResetSessions rewinds every session to the start of its sequences.
+func (rp *ReplayPlugin) ResetSessions() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.positions = nil
+}
+
+func (rp *ReplayPlugin) sessionHeader() string {
+	if rp.SessionHeader == "" {
+		return DefaultSessionHeader
+	}
+	return rp.SessionHeader
+}
+
+func (rp *ReplayPlugin) validate() error {
+	switch rp.SequenceExhausted {
+	case "", SequenceRepeatLast, SequenceLoop, SequenceNotFound:
+	default:
+		return fmt.Errorf("invalid sequence_exhausted %s", rp.SequenceExhausted)
+	}
+	if rp.RefreshAfterSeconds < 0 {
+		return fmt.Errorf("invalid refresh_after_seconds %d", rp.RefreshAfterSeconds)
+	}
+	return nil
+}
+
+func (rp *ReplayPlugin) shouldSkip(ctx *RequestContext) bool {
+	for _, rule := range matchingRules(rp.Rules, ctx) {
 		if rule.AlwaysUpstream || rule.SkipReplay {
 			log.Printf("replay rule %s: skip replay", ruleName(rule.Name))
 			return true
@@ -70,6 +251,31 @@ func (rp *ReplayPlugin) shouldSkip(ctx *RequestContext) bool {
 	return false
 }
 
+func (rp *ReplayPlugin) enabled() bool {
+	rp.settings.RLock()
+	defer rp.settings.RUnlock()
+	return rp.Enable
+}
+
+// swapSettings takes over the rules and options of next, a freshly loaded
+// copy. Session positions and background refreshes carry on.
+func (rp *ReplayPlugin) swapSettings(next Plugin) error {
+	loaded, ok := next.(*ReplayPlugin)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", rp.Name(), next)
+	}
+	rp.settings.Lock()
+	defer rp.settings.Unlock()
+	rp.Rules = loaded.Rules
+	rp.Enable = loaded.Enable
+	rp.LogNotFound = loaded.LogNotFound
+	rp.Sequence = loaded.Sequence
+	rp.SequenceExhausted = loaded.SequenceExhausted
+	rp.SessionHeader = loaded.SessionHeader
+	rp.RefreshAfterSeconds = loaded.RefreshAfterSeconds
+	return nil
+}
+
 func NewReplayPluginFromFile(filename string) (*ReplayPlugin, error) {
 	var replay ReplayPlugin
 	if err := newStructFromFile(filename, &replay); err != nil {
@@ -78,6 +284,9 @@ func NewReplayPluginFromFile(filename string) (*ReplayPlugin, error) {
 	if replay.PluginName == "" {
 		replay.PluginName = "replay"
 	}
+	if err := replay.validate(); err != nil {
+		return nil, err
+	}
 	return &replay, nil
 }
 
@@ -3,7 +3,10 @@ package replay
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestReplayPluginQueryOrderMatch(t *testing.T) {
@@ -55,12 +58,14 @@ func TestReplayPluginSkipRule(t *testing.T) {
 		Enable:     true,
 		Rules: []*ReplayRule{
 			{
-				Name:       "skip",
-				Enable:     true,
-				SkipReplay: true,
-				Match: RequestMatch{
-					URL: "http://example.com/path?a=1&b=2",
+				RuleMatch: RuleMatch{
+					Name:   "skip",
+					Enable: true,
+					Match: RequestMatch{
+						URL: "http://example.com/path?a=1&b=2",
+					},
 				},
+				SkipReplay: true,
 			},
 		},
 	}
@@ -72,3 +77,236 @@ func TestReplayPluginSkipRule(t *testing.T) {
 		t.Fatalf("expected skip cache to be set")
 	}
 }
+
+func TestReplayPluginSequence(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/jobs/1", nil)
+	key, err := buildKey(req, nil)
+	if err != nil {
+		t.Fatalf("buildKey: %v", err)
+	}
+
+	cases := []struct {
+		exhausted string
+		want      []int
+	}{
+		{"", []int{202, 200, 200, 200}},
+		{SequenceLoop, []int{202, 200, 202, 200}},
+		{SequenceNotFound, []int{202, 200, 404, 404}},
+	}
+	for _, tc := range cases {
+		repo := newMemoryRepo()
+		repo.sequences[key] = []StoredResponse{{StatusCode: 202}, {StatusCode: 200}}
+		plugin := NewReplayPlugin()
+		plugin.Sequence = true
+		plugin.SequenceExhausted = tc.exhausted
+		if err := plugin.validate(); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+
+		for i, want := range tc.want {
+			ctx := &RequestContext{Request: req, Key: key, Repository: repo}
+			if err := plugin.OnRequest(ctx); err != nil {
+				t.Fatalf("OnRequest: %v", err)
+			}
+			if ctx.Response == nil || ctx.Response.StatusCode != want {
+				t.Fatalf("%q request %d: expected %d, got %#v", tc.exhausted, i, want, ctx.Response)
+			}
+		}
+	}
+}
+
+func TestReplayPluginSequenceSessions(t *testing.T) {
+	repo := newMemoryRepo()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/jobs/1", nil)
+	key, err := buildKey(req, nil)
+	if err != nil {
+		t.Fatalf("buildKey: %v", err)
+	}
+	repo.sequences[key] = []StoredResponse{{StatusCode: 202}, {StatusCode: 200}}
+
+	plugin := NewReplayPlugin()
+	plugin.Sequence = true
+	next := func(session string) int {
+		sessionReq := req.Clone(req.Context())
+		sessionReq.Header.Set(DefaultSessionHeader, session)
+		ctx := &RequestContext{Request: sessionReq, Key: key, Repository: repo}
+		if err := plugin.OnRequest(ctx); err != nil {
+			t.Fatalf("OnRequest: %v", err)
+		}
+		return ctx.Response.StatusCode
+	}
+
+	if next("a") != 202 || next("a") != 200 || next("b") != 202 {
+		t.Fatal("expected independent positions per session")
+	}
+	plugin.ResetSessions()
+	if next("a") != 202 {
+		t.Fatal("expected reset to rewind sessions")
+	}
+
+	plugin.positions = newLRUCache[string, int](2)
+	next("a")
+	next("b")
+	next("c")
+	if got := plugin.positions.len(); got != 2 {
+		t.Fatalf("expected positions to stay bounded, have %d", got)
+	}
+	if next("a") != 202 {
+		t.Fatal("expected an evicted session to start over")
+	}
+
+	plugin.SequenceExhausted = "bogus"
+	if err := plugin.validate(); err == nil {
+		t.Fatal("expected invalid sequence_exhausted to fail")
+	}
+}
+
+func TestReplayPluginRefreshesStaleEntries(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("fresh"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	entries := map[string]StoredResponse{
+		"/stale":    {StatusCode: 200, BodyBase64: "b2xk", RecordedAt: old},
+		"/imported": {StatusCode: 200, BodyBase64: "b2xk"},
+		"/recent":   {StatusCode: 200, BodyBase64: "b2xk", RecordedAt: time.Now().Unix()},
+		"/broken":   {StatusCode: 200, BodyBase64: "b2xk", RecordedAt: old},
+	}
+	for path, stored := range entries {
+		repo.data[path] = stored
+	}
+
+	plugin := NewReplayPlugin()
+	plugin.RefreshAfterSeconds = 3600
+	record := NewRecordPlugin()
+	record.TTLSeconds = 60
+	for path := range entries {
+		ctx := &RequestContext{
+			Request:    httptest.NewRequest(http.MethodGet, path, nil),
+			Key:        path,
+			Repository: repo,
+			Upstream:   client,
+			plugins:    []Plugin{plugin, record},
+		}
+		if err := plugin.OnRequest(ctx); err != nil {
+			t.Fatalf("OnRequest %s: %v", path, err)
+		}
+		if ctx.Response == nil || ctx.Response.BodyBase64 != "b2xk" {
+			t.Fatalf("%s: expected the stored response right away, got %#v", path, ctx.Response)
+		}
+	}
+	plugin.refreshes.Wait()
+
+	for path, want := range map[string]string{"/stale": "ZnJlc2g=", "/imported": "ZnJlc2g=", "/recent": "b2xk", "/broken": "b2xk"} {
+		if got := repo.data[path].BodyBase64; got != want {
+			t.Fatalf("%s body = %q, want %q", path, got, want)
+		}
+	}
+	if hits["/recent"] != 0 {
+		t.Fatalf("recent entry should not be refreshed")
+	}
+	if repo.data["/stale"].RecordedAt <= old {
+		t.Fatalf("refreshed entry should record its fetch time")
+	}
+	if _, ok := repo.expires["/stale"]; !ok {
+		t.Fatalf("refreshed entry should keep the record TTL")
+	}
+	if len(plugin.refreshing) != 0 {
+		t.Fatalf("refreshes still marked in flight: %v", plugin.refreshing)
+	}
+}
+
+func TestReplayPluginDoesNotRefreshEventStreams(t *testing.T) {
+	plugin := NewReplayPlugin()
+	plugin.RefreshAfterSeconds = 1
+	old := time.Now().Add(-time.Hour).Unix()
+	if !plugin.stale(StoredResponse{StatusCode: 200, RecordedAt: old}) {
+		t.Fatal("expected an old body to be stale")
+	}
+	events := StoredResponse{StatusCode: 200, RecordedAt: old, Events: []StoredEvent{{Data: "data: one\n\n"}}}
+	if plugin.stale(events) {
+		t.Fatal("recorded event streams should not be refreshed")
+	}
+}
+
+// sinkPlugin records the order its response and close hooks run in.
+type sinkPlugin struct {
+	BasePlugin
+	mu    sync.Mutex
+	steps []string
+}
+
+func (p *sinkPlugin) OnResponse(*RequestContext, *StoredResponse) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, "response")
+	return nil
+}
+
+func (p *sinkPlugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, "close")
+	return nil
+}
+
+func TestClosePluginsWaitsForRefreshes(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		_, _ = w.Write([]byte("fresh"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	repo.data["/stale"] = StoredResponse{StatusCode: 200, BodyBase64: "b2xk"}
+	plugin := NewReplayPlugin()
+	plugin.RefreshAfterSeconds = 60
+	sink := &sinkPlugin{BasePlugin: BasePlugin{PluginName: "sink"}}
+	// The sink closes before the replay plugin in reverse chain order.
+	plugins := []Plugin{plugin, NewRecordPlugin(), sink}
+	ctx := &RequestContext{
+		Request:    httptest.NewRequest(http.MethodGet, "/stale", nil),
+		Key:        "/stale",
+		Repository: repo,
+		Upstream:   client,
+		plugins:    plugins,
+	}
+	if err := plugin.OnRequest(ctx); err != nil {
+		t.Fatalf("OnRequest: %v", err)
+	}
+	<-arrived
+
+	closed := make(chan error, 1)
+	go func() { closed <- ClosePlugins(plugins) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("ClosePlugins: %v", err)
+	}
+	if got := strings.Join(sink.steps, ","); got != "response,close" {
+		t.Fatalf("refresh reached the chain after it closed: %s", got)
+	}
+}
@@ -0,0 +1,241 @@
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminOptions configures the admin API. Keys in requests and responses are
+// relative to KeyPrefix, matching the keys the replay server builds.
+type AdminOptions struct {
+	KeyPrefix string
+	// BasePath mounts every endpoint under a path such as "/_admin".
+	BasePath string
+	// Plugins are searched for ReplayPlugins whose sessions the reset
+	// endpoint rewinds.
+	Plugins []Plugin
+}
+
+// adminEntry is the JSON view of one stored entry. Body holds the decoded
+// response body when it is valid UTF-8 text.
+type adminEntry struct {
+	Key      string         `json:"key"`
+	Response StoredResponse `json:"response"`
+	Body     *string        `json:"body,omitempty"`
+}
+
+// NewAdminRouter serves the admin API for managing recorded entries:
+//
+//	GET    /keys?prefix=p&pattern=glob   list keys; limit/cursor page them
+//	GET    /count?prefix=p&pattern=glob  count keys
+//	DELETE /keys?prefix=p                delete every key starting with p
+//	GET    /entry?key=k                  fetch one entry with its decoded body
+//	PUT    /entry?key=k                  store a StoredResponse, replacing any entry
+//	DELETE /entry?key=k                  delete one entry and its sequence
+//	POST   /sessions/reset               rewind replay sequence sessions
+func NewAdminRouter(repository Repository, options AdminOptions) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	registerAdminRoutes(router.Group(strings.TrimSuffix(options.BasePath, "/")), repository, options)
+	return router
+}
+
+func registerAdminRoutes(group *gin.RouterGroup, repository Repository, options AdminOptions) {
+	group.GET("/keys", func(c *gin.Context) {
+		scan := options.scanOptions(c)
+		if c.Query("limit") == "" && scan.Cursor == "" {
+			keys, err := repository.List(c.Request.Context(), scan)
+			if err != nil {
+				adminError(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"keys": options.trimKeys(keys)})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+		if err != nil || limit < 0 {
+			adminError(c, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		scan.Limit = limit
+		page, err := repository.Scan(c.Request.Context(), scan)
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": options.trimKeys(page.Keys), "cursor": page.Cursor})
+	})
+
+	group.GET("/count", func(c *gin.Context) {
+		count, err := repository.Count(c.Request.Context(), options.scanOptions(c))
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"count": count})
+	})
+
+	group.DELETE("/keys", func(c *gin.Context) {
+		prefix, ok := c.GetQuery("prefix")
+		if !ok {
+			adminError(c, http.StatusBadRequest, "prefix is required; use prefix= to clear every key")
+			return
+		}
+		keys, err := repository.List(c.Request.Context(), ScanOptions{Prefix: options.KeyPrefix + prefix})
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		deleted, err := repository.Delete(c.Request.Context(), keys...)
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+	})
+
+	group.GET("/entry", func(c *gin.Context) {
+		key, ok := adminKey(c)
+		if !ok {
+			return
+		}
+		stored, found, err := repository.Get(c.Request.Context(), options.KeyPrefix+key)
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !found {
+			adminError(c, http.StatusNotFound, "entry not found")
+			return
+		}
+		c.JSON(http.StatusOK, adminEntryFromStored(key, stored))
+	})
+
+	group.PUT("/entry", func(c *gin.Context) {
+		key, ok := adminKey(c)
+		if !ok {
+			return
+		}
+		var stored StoredResponse
+		if err := json.NewDecoder(c.Request.Body).Decode(&stored); err != nil {
+			adminError(c, http.StatusBadRequest, "invalid stored response: "+err.Error())
+			return
+		}
+		if stored.StatusCode < 100 || stored.StatusCode > 999 {
+			adminError(c, http.StatusBadRequest, "status_code must be a valid HTTP status")
+			return
+		}
+		if _, err := base64.StdEncoding.DecodeString(stored.BodyBase64); err != nil {
+			adminError(c, http.StatusBadRequest, "invalid body_base64: "+err.Error())
+			return
+		}
+		if stored.Headers == nil {
+			stored.Headers = []Header{}
+		}
+		if err := repository.Set(c.Request.Context(), options.KeyPrefix+key, stored, true); err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, adminEntryFromStored(key, stored))
+	})
+
+	group.DELETE("/entry", func(c *gin.Context) {
+		key, ok := adminKey(c)
+		if !ok {
+			return
+		}
+		deleted, err := repository.Delete(c.Request.Context(), options.KeyPrefix+key)
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if deleted == 0 {
+			adminError(c, http.StatusNotFound, "entry not found")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+	})
+
+	group.POST("/sessions/reset", func(c *gin.Context) {
+		reset := 0
+		for _, plugin := range allPlugins(options.Plugins) {
+			if replay, ok := plugin.(*ReplayPlugin); ok {
+				replay.ResetSessions()
+				reset++
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"reset": reset})
+	})
+}
+
+// scanOptions reads the prefix, pattern and cursor query parameters. Both
+// prefix and pattern are relative to KeyPrefix.
+func (o AdminOptions) scanOptions(c *gin.Context) ScanOptions {
+	scan := ScanOptions{Prefix: o.KeyPrefix + c.Query("prefix")}
+	if pattern := c.Query("pattern"); pattern != "" && pattern != "*" {
+		scan.Pattern = o.KeyPrefix + pattern
+	}
+	scan.Cursor = c.Query("cursor")
+	return scan
+}
+
+func (o AdminOptions) trimKeys(keys []string) []string {
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, o.KeyPrefix)
+	}
+	return keys
+}
+
+// adminHandler dispatches requests under prefix to admin before the replay
+// catch-all sees them. Only origin-form requests addressed to the listener
+// itself qualify: absolute-form and tunneled forward-proxy requests carry
+// their origin in URL.Host and are forwarded as usual.
+func adminHandler(prefix string, admin http.Handler) gin.HandlerFunc {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if c.Request.URL.Host != "" || (path != prefix && !strings.HasPrefix(path, prefix+"/")) {
+			c.Next()
+			return
+		}
+		c.Abort()
+		admin.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func adminKey(c *gin.Context) (string, bool) {
+	key := c.Query("key")
+	if key == "" {
+		adminError(c, http.StatusBadRequest, "key is required")
+		return "", false
+	}
+	return key, true
+}
+
+func adminError(c *gin.Context, status int, message string) {
+	if status >= http.StatusInternalServerError {
+		log.Printf("admin %s %s: %s", c.Request.Method, c.Request.URL.Path, message)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
+
+func adminEntryFromStored(key string, stored StoredResponse) adminEntry {
+	entry := adminEntry{Key: key, Response: stored}
+	body, err := base64.StdEncoding.DecodeString(stored.BodyBase64)
+	if err != nil {
+		return entry
+	}
+	body, _, _ = decodeFlowContent(stored.Headers, body)
+	if utf8.Valid(body) {
+		text := string(body)
+		entry.Body = &text
+	}
+	return entry
+}
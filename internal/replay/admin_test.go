@@ -0,0 +1,179 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, target, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("%s %s: decode %q: %v", method, target, rec.Body.String(), err)
+	}
+	return rec.Code, decoded
+}
+
+func TestAdminRouterEntries(t *testing.T) {
+	repo := newMemoryRepo()
+	admin := NewAdminRouter(repo, AdminOptions{KeyPrefix: "pfx:"})
+	key := url.QueryEscape("/v1/users|GET|")
+
+	status, _ := adminRequest(t, admin, http.MethodPut, "/entry?key="+key,
+		`{"status_code":200,"headers":[{"key":"Content-Type","value":"application/json"}],"body_base64":"eyJvayI6dHJ1ZX0="}`)
+	if status != http.StatusOK {
+		t.Fatalf("put status: %d", status)
+	}
+	if _, ok := repo.data["pfx:/v1/users|GET|"]; !ok {
+		t.Fatalf("expected prefixed key in repo: %#v", repo.data)
+	}
+
+	status, entry := adminRequest(t, admin, http.MethodGet, "/entry?key="+key, "")
+	if status != http.StatusOK || entry["key"] != "/v1/users|GET|" || entry["body"] != `{"ok":true}` {
+		t.Fatalf("unexpected entry: %d %#v", status, entry)
+	}
+
+	status, listed := adminRequest(t, admin, http.MethodGet, "/keys?pattern="+url.QueryEscape("/v1/*"), "")
+	keys, _ := listed["keys"].([]interface{})
+	if status != http.StatusOK || len(keys) != 1 || keys[0] != "/v1/users|GET|" {
+		t.Fatalf("unexpected keys: %d %#v", status, listed)
+	}
+
+	if status, _ := adminRequest(t, admin, http.MethodPut, "/entry?key="+key, `{"status_code":0}`); status != http.StatusBadRequest {
+		t.Fatalf("expected invalid status to be rejected, got %d", status)
+	}
+
+	if status, _ := adminRequest(t, admin, http.MethodDelete, "/entry?key="+key, ""); status != http.StatusOK {
+		t.Fatalf("delete status: %d", status)
+	}
+	if status, _ := adminRequest(t, admin, http.MethodGet, "/entry?key="+key, ""); status != http.StatusNotFound {
+		t.Fatalf("expected deleted entry to be missing, got %d", status)
+	}
+}
+
+func TestAdminRouterClearPrefix(t *testing.T) {
+	repo := newMemoryRepo()
+	for _, key := range []string{"pfx:/a/1|GET|", "pfx:/a/2|GET|", "pfx:/b|GET|", "other:/a/3|GET|"} {
+		repo.data[key] = StoredResponse{StatusCode: 200}
+	}
+	admin := NewAdminRouter(repo, AdminOptions{KeyPrefix: "pfx:"})
+
+	if status, _ := adminRequest(t, admin, http.MethodDelete, "/keys", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected missing prefix to be rejected, got %d", status)
+	}
+	status, result := adminRequest(t, admin, http.MethodDelete, "/keys?prefix=/a/", "")
+	if status != http.StatusOK || result["deleted"] != float64(2) {
+		t.Fatalf("unexpected clear result: %d %#v", status, result)
+	}
+	if len(repo.data) != 2 {
+		t.Fatalf("unexpected remaining keys: %#v", repo.data)
+	}
+}
+
+func TestServerAdminPrefix(t *testing.T) {
+	repo := newMemoryRepo()
+	replay := NewReplayPlugin()
+	replay.Sequence = true
+	router := newTestRouter(t, repo, ServerOptions{
+		AdminPrefix: "/_admin",
+		Plugins:     []Plugin{replay},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	seed, err := http.NewRequest(http.MethodPut, server.URL+"/_admin/entry?key="+url.QueryEscape("/hello|GET|"),
+		strings.NewReader(`{"status_code":201,"body_base64":"aGk="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(seed)
+	if err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("seed status: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/hello")
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "hi" {
+		t.Fatalf("unexpected replay: %d %q", resp.StatusCode, body)
+	}
+
+	repo.sequences["/seq|GET|"] = []StoredResponse{{StatusCode: 202}, {StatusCode: 200}}
+	for _, want := range []int{202, 200} {
+		resp, err = http.Get(server.URL + "/seq")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("expected %d, got %d", want, resp.StatusCode)
+		}
+	}
+	resp, err = http.Post(server.URL+"/_admin/sessions/reset", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected reset sequence, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerAdminPrefixForwardsProxiedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+		ForwardProxy: true,
+		KeyPolicy:    NewKeyPolicy(KeySchemeHost),
+		AdminPrefix:  "/_admin",
+		Upstream:     NewProxyUpstreamClient(time.Second),
+		Plugins:      []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL + "/_admin/keys")
+	if err != nil {
+		t.Fatalf("proxied request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "origin /_admin/keys" {
+		t.Fatalf("expected the request to reach its origin, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(proxy.URL + "/_admin/keys")
+	if err != nil {
+		t.Fatalf("admin request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the local admin API, got %d", resp.StatusCode)
+	}
+}
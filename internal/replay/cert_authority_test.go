@@ -0,0 +1,69 @@
+package replay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestLoadOrCreateCertAuthorityPersists(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreateCertAuthority(dir)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	second, err := LoadOrCreateCertAuthority(dir)
+	if err != nil {
+		t.Fatalf("load CA: %v", err)
+	}
+	if !first.Certificate().Equal(second.Certificate()) {
+		t.Fatal("expected the stored CA to be reused")
+	}
+	if !first.Certificate().IsCA {
+		t.Fatal("expected a CA certificate")
+	}
+}
+
+func TestCertAuthorityLeafCertificate(t *testing.T) {
+	ca, err := LoadOrCreateCertAuthority(t.TempDir())
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	leaf, err := ca.leafCertificate("api.example.com")
+	if err != nil {
+		t.Fatalf("leafCertificate: %v", err)
+	}
+	cached, _ := ca.leafCertificate("api.example.com")
+	if cached != leaf {
+		t.Fatal("expected leaf certificate to be cached")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: roots}); err != nil {
+		t.Fatalf("verify leaf: %v", err)
+	}
+}
+
+func TestCertAuthorityLeafCacheIsBounded(t *testing.T) {
+	ca, err := LoadOrCreateCertAuthority(t.TempDir())
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	ca.leaves = newLRUCache[string, *tls.Certificate](2)
+
+	first, _ := ca.leafCertificate("a.example.com")
+	ca.leafCertificate("b.example.com")
+	ca.leafCertificate("a.example.com")
+	ca.leafCertificate("c.example.com")
+
+	if got := ca.leaves.len(); got != 2 {
+		t.Fatalf("expected 2 cached leaves, got %d", got)
+	}
+	if _, ok := ca.leaves.get("b.example.com"); ok {
+		t.Fatal("expected the least recently used leaf to be evicted")
+	}
+	if cached, _ := ca.leafCertificate("a.example.com"); cached != first {
+		t.Fatal("expected the recently used leaf to stay cached")
+	}
+}
@@ -1,14 +1,58 @@
 package replay
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-yaml"
 )
 
-func newStructFromFile(filename string, value interface{}) error {
+// readConfigFile returns the contents of a JSON or YAML file as JSON, so
+// every config type is described by its json tags alone. Files ending in
+// .yaml or .yml are YAML.
+func readConfigFile(filename string) ([]byte, error) {
 	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		converted, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", filename, err)
+		}
+		return converted, nil
+	}
+	return data, nil
+}
+
+func newStructFromFile(filename string, value interface{}) error {
+	data, err := readConfigFile(filename)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal(data, value)
 }
+
+// LoadConfigFile decodes a JSON or YAML file into value. Unlike the rule
+// files it rejects unknown fields, so typos in a config are reported.
+func LoadConfigFile(filename string, value interface{}) error {
+	data, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := decodeStrict(data, value); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
@@ -3,6 +3,7 @@ package replay
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -23,3 +24,32 @@ func TestNewStructFromFile(t *testing.T) {
 		t.Fatalf("unexpected value: %s", payload.Value)
 	}
 }
+
+func TestNewStructFromYAMLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("enable: true\nrules:\n  - name: prices\n    enable: true\n    match:\n      path: /v1/prices*\n"), 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	replay, err := NewReplayPluginFromFile(path)
+	if err != nil {
+		t.Fatalf("NewReplayPluginFromFile: %v", err)
+	}
+	if !replay.Enable || len(replay.Rules) != 1 || replay.Rules[0].Match.Path != "/v1/prices*" {
+		t.Fatalf("unexpected plugin: %#v", replay)
+	}
+}
+
+func TestLoadConfigFileRejectsUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("value: ok\nvalu: typo\n"), 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var payload struct {
+		Value string `json:"value"`
+	}
+	if err := LoadConfigFile(path, &payload); err == nil || !strings.Contains(err.Error(), "valu") {
+		t.Fatalf("expected an unknown field error, got %v", err)
+	}
+}
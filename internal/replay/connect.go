@@ -0,0 +1,183 @@
+package replay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+const connectDialTimeout = 10 * time.Second
+
+// connectHandler answers CONNECT requests in forward-proxy mode. With a CA the
+// tunnel is decrypted and each inner request is dispatched through handler as
+// an absolute https:// request; without one the bytes are relayed untouched.
+func connectHandler(handler http.Handler, ca *CertAuthority) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodConnect {
+			c.Next()
+			return
+		}
+		c.Abort()
+
+		target := c.Request.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "443")
+		}
+
+		conn, buffered, err := c.Writer.Hijack()
+		if err != nil {
+			log.Printf("connect %s: hijack failed: %v", target, err)
+			return
+		}
+		clientConn := &bufferedConn{Conn: conn, reader: buffered.Reader}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		if ca == nil {
+			tunnelConnect(clientConn, target)
+			return
+		}
+		interceptConnect(clientConn, target, handler, ca)
+	}
+}
+
+// interceptConnect terminates TLS with a leaf certificate for target and
+// serves the decrypted requests with handler.
+func interceptConnect(conn net.Conn, target string, handler http.Handler, ca *CertAuthority) {
+	hostname, port, _ := net.SplitHostPort(target)
+	authority := target
+	if port == "443" {
+		authority = hostname
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return ca.leafCertificate(name)
+		},
+	})
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = authority
+		handler.ServeHTTP(w, r)
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("connect %s: TLS handshake failed: %v", target, err)
+		_ = tlsConn.Close()
+		return
+	}
+	// Clients offering h2, gRPC ones among them, are served HTTP/2.
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		(&http2.Server{}).ServeConn(tlsConn, &http2.ServeConnOpts{Handler: inner})
+		_ = tlsConn.Close()
+		return
+	}
+
+	listener := newSingleConnListener(tlsConn)
+	server := &http.Server{
+		Handler: inner,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("connect %s: %v", target, err)
+	}
+}
+
+// tunnelConnect relays raw bytes between the client and target.
+func tunnelConnect(conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", target, connectDialTimeout)
+	if err != nil {
+		log.Printf("connect %s: dial failed: %v", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(upstream, conn)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if bc, ok := conn.(*bufferedConn); ok {
+		conn = bc.Conn
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// bufferedConn reads through the bufio.Reader returned by Hijack so bytes the
+// client sent right after CONNECT are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// singleConnListener hands out one connection, then blocks until closed.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+	mu   sync.Mutex
+	used bool
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.used {
+		l.used = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnectInterceptsHTTPS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	ca, err := LoadOrCreateCertAuthority(t.TempDir())
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	upstreamClient := NewProxyUpstreamClient(time.Second)
+	upstreamClient.client = upstream.Client()
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		ForwardProxy:  true,
+		KeyPolicy:     NewKeyPolicy(KeySchemeHost),
+		CertAuthority: ca,
+		Upstream:      upstreamClient,
+		Plugins:       []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	resp, err := client.Get(upstream.URL + "/hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	payload, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(payload) != "secure /hello" {
+		t.Fatalf("unexpected body: %q", payload)
+	}
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].Issuer.CommonName != ca.Certificate().Subject.CommonName {
+		t.Fatal("expected the response to be served with a CA-minted certificate")
+	}
+	key := upstream.URL + "/hello|GET|"
+	if _, ok := repo.data[key]; !ok {
+		t.Fatalf("expected intercepted response under %q, have %v", key, repo.data)
+	}
+}
+
+func TestConnectTunnelWithoutCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("tunneled"))
+	}))
+	defer upstream.Close()
+
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{ForwardProxy: true})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := upstream.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	resp, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	payload, _ := io.ReadAll(resp.Body)
+	if string(payload) != "tunneled" {
+		t.Fatalf("unexpected body: %q", payload)
+	}
+}
@@ -0,0 +1,101 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxJSONLLineSize bounds a single exported entry, body included.
+const maxJSONLLineSize = 256 << 20
+
+// Entry is one stored key/response pair as written by ExportJSONL.
+// Keys are stored without the repository key prefix.
+type Entry struct {
+	Key      string         `json:"key"`
+	Response StoredResponse `json:"response"`
+}
+
+// ExportOptions selects which entries are exported.
+type ExportOptions struct {
+	KeyPrefix string
+	// Pattern is a glob applied after KeyPrefix; empty means "*".
+	Pattern string
+	// BaseURL is prepended to key paths by formats that need absolute URLs.
+	BaseURL string
+}
+
+func (o ExportOptions) scanOptions() ScanOptions {
+	return prefixScanOptions(o.KeyPrefix, o.Pattern)
+}
+
+// prefixScanOptions selects keys under keyPrefix whose remainder matches the
+// glob pattern. Empty and "*" patterns scan the prefix range only.
+func prefixScanOptions(keyPrefix, pattern string) ScanOptions {
+	options := ScanOptions{Prefix: keyPrefix}
+	if pattern != "" && pattern != "*" {
+		options.Pattern = keyPrefix + pattern
+	}
+	return options
+}
+
+// ImportJSONL reads one Entry per line from r and stores it in repository.
+func ImportJSONL(ctx context.Context, r io.Reader, repository Repository, options ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLLineSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		stats.Read++
+
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return stats, fmt.Errorf("line %d: %w", stats.Read, err)
+		}
+		if entry.Key == "" {
+			return stats, fmt.Errorf("line %d: missing key", stats.Read)
+		}
+		if err := repository.Set(ctx, options.KeyPrefix+entry.Key, entry.Response, options.Overwrite); err != nil {
+			return stats, err
+		}
+		stats.Stored++
+	}
+	return stats, scanner.Err()
+}
+
+// ExportJSONL writes every matching entry in repository to w, one per line.
+func ExportJSONL(ctx context.Context, w io.Writer, repository Repository, options ExportOptions) (int, error) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return exportEntries(ctx, repository, options, func(entry Entry) error {
+		return encoder.Encode(entry)
+	})
+}
+
+func exportEntries(ctx context.Context, repository Repository, options ExportOptions, write func(Entry) error) (int, error) {
+	keys, err := repository.List(ctx, options.scanOptions())
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for _, key := range keys {
+		response, found, err := repository.Get(ctx, key)
+		if err != nil {
+			return written, fmt.Errorf("%s: %w", key, err)
+		}
+		if !found {
+			continue
+		}
+		if err := write(Entry{Key: strings.TrimPrefix(key, options.KeyPrefix), Response: response}); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
@@ -0,0 +1,47 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONLRoundTrip(t *testing.T) {
+	source := newMemoryRepo()
+	source.data["pfx:/a|GET|"] = StoredResponse{StatusCode: 200, BodyBase64: "YQ=="}
+	source.data["pfx:/b|GET|"] = StoredResponse{StatusCode: 204, Headers: []Header{{Key: "X-Test", Value: "ok"}}}
+	source.data["other:/c|GET|"] = StoredResponse{StatusCode: 200}
+
+	var buf bytes.Buffer
+	written, err := ExportJSONL(context.Background(), &buf, source, ExportOptions{KeyPrefix: "pfx:"})
+	if err != nil {
+		t.Fatalf("ExportJSONL: %v", err)
+	}
+	if written != 2 {
+		t.Fatalf("unexpected export count: %d", written)
+	}
+	if strings.Contains(buf.String(), "pfx:") {
+		t.Fatalf("expected prefix to be stripped: %s", buf.String())
+	}
+
+	target := newMemoryRepo()
+	stats, err := ImportJSONL(context.Background(), &buf, target, ImportOptions{KeyPrefix: "new:"})
+	if err != nil {
+		t.Fatalf("ImportJSONL: %v", err)
+	}
+	if stats.Stored != 2 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if !reflect.DeepEqual(target.data["new:/b|GET|"], source.data["pfx:/b|GET|"]) {
+		t.Fatalf("mismatch: %#v", target.data)
+	}
+}
+
+func TestImportJSONLMissingKey(t *testing.T) {
+	_, err := ImportJSONL(context.Background(), strings.NewReader(`{"response":{"status_code":200}}`), newMemoryRepo(), ImportOptions{})
+	if err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
@@ -0,0 +1,97 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+var errFlightAborted = errors.New("coalesced fetch did not complete")
+
+// flightGroup coalesces concurrent fetches of the same key: the first caller
+// runs fetch while later callers wait for and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done     chan struct{}
+	once     sync.Once
+	response StoredResponse
+	err      error
+}
+
+// finish publishes the result to the followers; only the first call counts.
+func (c *flightCall) finish(response StoredResponse, err error) {
+	c.once.Do(func() {
+		c.response, c.err = response, err
+		close(c.done)
+	})
+}
+
+// do returns the result of fetch for key. shared is true for followers,
+// which receive their own copy of the leader's response. A follower whose
+// ctx ends stops waiting; the leader's fetch is unaffected.
+func (g *flightGroup) do(ctx context.Context, key string, fetch func() (StoredResponse, error)) (response StoredResponse, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return cloneStoredResponse(call.response), true, call.err
+		case <-ctx.Done():
+			return StoredResponse{}, true, ctx.Err()
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// Followers see errFlightAborted if fetch panics.
+	response, err = StoredResponse{}, errFlightAborted
+	defer func() {
+		g.forget(key, call)
+		call.finish(response, err)
+	}()
+	response, err = fetch()
+	return cloneStoredResponse(response), false, err
+}
+
+// release lets the followers of key's running fetch go before it returns:
+// they get errNotRecorded and fetch on their own, and later callers start a
+// new fetch. Leaders use it for responses that followers cannot wait for,
+// such as live event streams.
+func (g *flightGroup) release(key string) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	if ok {
+		call.finish(StoredResponse{}, errNotRecorded)
+	}
+}
+
+func (g *flightGroup) forget(key string, call *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// cloneStoredResponse copies the slices of response so plugins can edit each
+// copy.
+func cloneStoredResponse(response StoredResponse) StoredResponse {
+	response.Headers = slices.Clone(response.Headers)
+	response.Trailers = slices.Clone(response.Trailers)
+	response.Events = slices.Clone(response.Events)
+	response.WebSocket = slices.Clone(response.WebSocket)
+	return response
+}
@@ -0,0 +1,96 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var group flightGroup
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func() (StoredResponse, error) {
+		fetches.Add(1)
+		<-release
+		return StoredResponse{StatusCode: 200, Headers: []Header{{Key: "X-Test", Value: "1"}}}, nil
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	var sharedCount atomic.Int32
+	responses := make([]StoredResponse, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, shared, err := group.do(context.Background(), "key", fetch)
+			if err != nil {
+				t.Errorf("do: %v", err)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+			responses[i] = response
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("fetch ran %d times, want 1", got)
+	}
+	if got := sharedCount.Load(); got != callers-1 {
+		t.Fatalf("%d followers, want %d", got, callers-1)
+	}
+	responses[0].Headers[0].Value = "changed"
+	if responses[1].Headers[0].Value != "1" {
+		t.Fatalf("followers share the leader's headers")
+	}
+
+	// The key is released once the fetch is done.
+	if _, shared, _ := group.do(context.Background(), "key", fetch); shared {
+		t.Fatalf("a later call should fetch again")
+	}
+}
+
+func TestFlightGroupFollowerContext(t *testing.T) {
+	var group flightGroup
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		_, _, _ = group.do(context.Background(), "key", func() (StoredResponse, error) {
+			<-release
+			return StoredResponse{}, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := group.do(ctx, "key", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("follower should stop waiting with its context, got %v", err)
+	}
+}
+
+func TestCloneStoredResponseCopiesSlices(t *testing.T) {
+	original := StoredResponse{
+		Headers:   []Header{{Key: "A", Value: "1"}},
+		Trailers:  []Header{{Key: "Grpc-Status", Value: "0"}},
+		Events:    []StoredEvent{{Data: "data: one\n\n"}},
+		WebSocket: []StoredWSMessage{{Data: "hi"}},
+	}
+	clone := cloneStoredResponse(original)
+	clone.Headers[0].Value = "2"
+	clone.Trailers[0].Value = "13"
+	clone.Events[0].Data = "data: two\n\n"
+	clone.WebSocket[0].Data = "bye"
+	if original.Headers[0].Value != "1" || original.Trailers[0].Value != "0" ||
+		original.Events[0].Data != "data: one\n\n" || original.WebSocket[0].Data != "hi" {
+		t.Fatalf("editing the clone changed the original: %#v", original)
+	}
+}
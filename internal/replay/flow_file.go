@@ -0,0 +1,245 @@
+package replay
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ImportOptions controls how imported entries are written to a Repository.
+// IncludeEmpty and IncludeErrors filter captured traffic (.flow files);
+// JSONL dumps are restored as-is.
+type ImportOptions struct {
+	KeyPrefix     string
+	Overwrite     bool
+	IncludeEmpty  bool
+	IncludeErrors bool
+	// KeyPolicy builds keys for captured requests; nil uses KeySchemePath.
+	KeyPolicy *KeyPolicy
+}
+
+// ImportStats summarizes an import run.
+type ImportStats struct {
+	Read    int
+	Stored  int
+	Skipped int
+}
+
+// ImportFlowFile reads a mitmproxy .flow file and stores every HTTP flow in repository.
+func ImportFlowFile(ctx context.Context, filename string, repository Repository, options ImportOptions) (ImportStats, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer file.Close()
+	return ImportFlows(ctx, file, repository, options)
+}
+
+// ImportFlows reads mitmproxy flows from r and stores every HTTP flow in repository.
+func ImportFlows(ctx context.Context, r io.Reader, repository Repository, options ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	reader := newTNetstringReader(r)
+	for {
+		value, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("flow %d: %w", stats.Read+1, err)
+		}
+		stats.Read++
+
+		state, ok := value.(map[string]interface{})
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+		entry, ok, err := flowEntryFromState(state, options.KeyPolicy)
+		if err != nil {
+			log.Printf("skip flow %d: %v", stats.Read, err)
+			stats.Skipped++
+			continue
+		}
+		if !ok || !options.accepts(entry.response) {
+			stats.Skipped++
+			continue
+		}
+
+		if err := repository.Set(ctx, options.KeyPrefix+entry.key, entry.response, options.Overwrite); err != nil {
+			return stats, err
+		}
+		stats.Stored++
+	}
+}
+
+// accepts reports whether a captured response passes the import filters.
+func (o ImportOptions) accepts(response StoredResponse) bool {
+	if !o.IncludeEmpty && response.BodyBase64 == "" {
+		return false
+	}
+	if !o.IncludeErrors && response.StatusCode >= http.StatusBadRequest {
+		return false
+	}
+	return true
+}
+
+type flowEntry struct {
+	key      string
+	response StoredResponse
+}
+
+// flowEntryFromState converts the state dict of one mitmproxy flow.
+// Non-HTTP flows and flows without a response report ok=false.
+func flowEntryFromState(state map[string]interface{}, policy *KeyPolicy) (flowEntry, bool, error) {
+	if flowType := stateString(state, "type"); flowType != "" && flowType != "http" {
+		return flowEntry{}, false, nil
+	}
+	requestState, ok := state["request"].(map[string]interface{})
+	if !ok {
+		return flowEntry{}, false, nil
+	}
+	responseState, ok := state["response"].(map[string]interface{})
+	if !ok {
+		return flowEntry{}, false, nil
+	}
+
+	req, body, err := requestFromFlowState(requestState)
+	if err != nil {
+		return flowEntry{}, false, err
+	}
+	key, err := policy.buildKey(req, body)
+	if err != nil {
+		return flowEntry{}, false, err
+	}
+	return flowEntry{key: key, response: responseFromFlowState(responseState)}, true, nil
+}
+
+func requestFromFlowState(state map[string]interface{}) (*http.Request, []byte, error) {
+	method := stateString(state, "method")
+	if method == "" {
+		return nil, nil, errors.New("flow request has no method")
+	}
+	if method == http.MethodConnect {
+		return nil, nil, errors.New("CONNECT flows are not replayable")
+	}
+	headers := flowHeaders(state["headers"])
+	scheme := stateString(state, "scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	host := stateString(state, "authority")
+	if host == "" {
+		host, _ = findHeader(headers, "Host")
+	}
+	if host == "" {
+		host = flowHostPort(scheme, stateString(state, "host"), stateInt(state, "port"))
+	}
+
+	target, err := url.ParseRequestURI(stateString(state, "path"))
+	if err != nil {
+		return nil, nil, err
+	}
+	target.Scheme = scheme
+	target.Host = host
+
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = storedHeaderToHTTP(headers)
+	req.Host = host
+
+	body, _, _ := decodeFlowContent(headers, []byte(stateString(state, "content")))
+	return req, body, nil
+}
+
+func responseFromFlowState(state map[string]interface{}) StoredResponse {
+	headers := flowHeaders(state["headers"])
+	body, remaining, decoded := decodeFlowContent(headers, []byte(stateString(state, "content")))
+	if decoded {
+		if len(remaining) == 0 {
+			removeHeader(&headers, "Content-Encoding")
+		} else {
+			updateHeader(&headers, "Content-Encoding", strings.Join(remaining, ", "))
+		}
+	}
+
+	encoded := ""
+	if len(body) > 0 {
+		encoded = base64.StdEncoding.EncodeToString(body)
+	}
+	return StoredResponse{
+		StatusCode: int(stateInt(state, "status_code")),
+		Headers:    headers,
+		BodyBase64: encoded,
+	}
+}
+
+// decodeFlowContent undoes Content-Encoding on raw flow content.
+// mitmproxy stores bodies exactly as they were sent on the wire.
+// decoded is false when the body was left untouched.
+func decodeFlowContent(headers []Header, content []byte) ([]byte, []string, bool) {
+	encHeader, _ := findHeader(headers, "Content-Encoding")
+	encodings := parseHeaderTokens(encHeader)
+	if len(content) == 0 || len(encodings) == 0 {
+		return content, nil, false
+	}
+	body, remaining, err := decodeBody(content, encodings)
+	if err != nil {
+		return content, nil, false
+	}
+	return body, remaining, true
+}
+
+func flowHeaders(value interface{}) []Header {
+	fields, _ := value.([]interface{})
+	headers := make([]Header, 0, len(fields))
+	for _, field := range fields {
+		pair, ok := field.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		key, _ := pair[0].(string)
+		val, _ := pair[1].(string)
+		if key == "" {
+			continue
+		}
+		headers = append(headers, Header{Key: key, Value: val})
+	}
+	return headers
+}
+
+func flowHostPort(scheme, host string, port int64) string {
+	if host == "" || port == 0 {
+		return host
+	}
+	if (scheme == "http" && port == 80) || (scheme == "https" && port == 443) {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+}
+
+func stateString(state map[string]interface{}, key string) string {
+	value, _ := state[key].(string)
+	return value
+}
+
+func stateInt(state map[string]interface{}, key string) int64 {
+	switch value := state[key].(type) {
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// encodeTNetstring is a minimal encoder used to build .flow fixtures.
+func encodeTNetstring(value interface{}) string {
+	var payload, tag string
+	switch v := value.(type) {
+	case nil:
+		tag = "~"
+	case string:
+		payload, tag = v, ","
+	case int:
+		payload, tag = fmt.Sprint(v), "#"
+	case bool:
+		payload, tag = fmt.Sprint(v), "!"
+	case []interface{}:
+		var builder strings.Builder
+		for _, item := range v {
+			builder.WriteString(encodeTNetstring(item))
+		}
+		payload, tag = builder.String(), "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var builder strings.Builder
+		for _, key := range keys {
+			builder.WriteString(fmt.Sprintf("%d:%s;", len(key), key))
+			builder.WriteString(encodeTNetstring(v[key]))
+		}
+		payload, tag = builder.String(), "}"
+	default:
+		panic(fmt.Sprintf("unsupported type %T", value))
+	}
+	return fmt.Sprintf("%d:%s%s", len(payload), payload, tag)
+}
+
+func testFlow(method, path string, headers []interface{}, content interface{}, status int, respHeaders []interface{}, respContent interface{}) string {
+	return encodeTNetstring(map[string]interface{}{
+		"type":    "http",
+		"version": 20,
+		"request": map[string]interface{}{
+			"method":    method,
+			"scheme":    "https",
+			"host":      "httpbin.org",
+			"port":      443,
+			"authority": "",
+			"path":      path,
+			"headers":   headers,
+			"content":   content,
+		},
+		"response": map[string]interface{}{
+			"status_code": status,
+			"reason":      "OK",
+			"headers":     respHeaders,
+			"content":     respContent,
+		},
+	})
+}
+
+func TestImportFlows(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(`{"ok":true}`))
+	_ = zw.Close()
+
+	stream := testFlow(
+		"POST", "/post?name=hello",
+		[]interface{}{
+			[]interface{}{"Host", "httpbin.org"},
+			[]interface{}{"Content-Type", "application/json"},
+		},
+		`{"b":2,"a":1}`,
+		200,
+		[]interface{}{
+			[]interface{}{"Content-Type", "application/json"},
+			[]interface{}{"Content-Encoding", "gzip"},
+		},
+		gz.String(),
+	) + testFlow("GET", "/missing", nil, nil, 404, nil, "nope") +
+		encodeTNetstring(map[string]interface{}{"type": "tcp"})
+
+	repo := newMemoryRepo()
+	stats, err := ImportFlows(context.Background(), strings.NewReader(stream), repo, ImportOptions{KeyPrefix: "pfx:"})
+	if err != nil {
+		t.Fatalf("ImportFlows: %v", err)
+	}
+	if stats.Read != 3 || stats.Stored != 1 || stats.Skipped != 2 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	stored, found, _ := repo.Get(context.Background(), `pfx:/post|POST|name=hello|{"a":1,"b":2}`)
+	if !found {
+		t.Fatalf("expected flow to be stored, have %v", repo.data)
+	}
+	body, _ := base64.StdEncoding.DecodeString(stored.BodyBase64)
+	if string(body) != `{"ok":true}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	if _, ok := findHeader(stored.Headers, "Content-Encoding"); ok {
+		t.Fatalf("expected Content-Encoding to be removed: %#v", stored.Headers)
+	}
+}
+
+func TestImportFlowsIncludeErrors(t *testing.T) {
+	stream := testFlow("GET", "/missing", nil, nil, 404, nil, "nope")
+	repo := newMemoryRepo()
+	stats, err := ImportFlows(context.Background(), strings.NewReader(stream), repo, ImportOptions{IncludeErrors: true})
+	if err != nil {
+		t.Fatalf("ImportFlows: %v", err)
+	}
+	if stats.Stored != 1 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if _, found, _ := repo.Get(context.Background(), "/missing|GET|"); !found {
+		t.Fatal("expected error response to be stored")
+	}
+}
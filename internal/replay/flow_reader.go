@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 	"unicode/utf16"
 )
 
@@ -18,23 +19,42 @@ type flowRequest struct {
 	body []byte
 }
 
-func readFlowRequest(req *http.Request) (flowRequest, error) {
+func readFlowRequest(req *http.Request, policy *KeyPolicy) (flowRequest, error) {
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		return flowRequest{}, err
 	}
 	req.Body = io.NopCloser(bytes.NewReader(body))
 
-	key, err := buildKey(req, body)
+	key, err := policy.buildKey(req, body)
 	if err != nil {
 		return flowRequest{}, err
 	}
 	return flowRequest{key: key, body: body}, nil
 }
 
+// storedResponseFromHTTP converts resp, whose body was read into body, so
+// its trailers are known.
 func storedResponseFromHTTP(resp *http.Response, body []byte) StoredResponse {
-	headers := make([]Header, 0, len(resp.Header))
-	for key, values := range resp.Header {
+	bodyEncoded := ""
+	if len(body) > 0 {
+		bodyEncoded = base64.StdEncoding.EncodeToString(body)
+	}
+	stored := StoredResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    sortedHeaders(resp.Header),
+		BodyBase64: bodyEncoded,
+		RecordedAt: time.Now().Unix(),
+	}
+	if len(resp.Trailer) > 0 {
+		stored.Trailers = sortedHeaders(resp.Trailer)
+	}
+	return stored
+}
+
+func sortedHeaders(header http.Header) []Header {
+	headers := make([]Header, 0, len(header))
+	for key, values := range header {
 		for _, value := range values {
 			headers = append(headers, Header{Key: key, Value: value})
 		}
@@ -45,35 +65,42 @@ func storedResponseFromHTTP(resp *http.Response, body []byte) StoredResponse {
 		}
 		return headers[i].Key < headers[j].Key
 	})
+	return headers
+}
 
-	bodyEncoded := ""
-	if len(body) > 0 {
-		bodyEncoded = base64.StdEncoding.EncodeToString(body)
+func writeStoredResponse(w http.ResponseWriter, stored StoredResponse) error {
+	writeStoredHeaders(w, stored)
+	if stored.BodyBase64 != "" {
+		// Decode while writing instead of holding a second copy of the body.
+		if _, err := io.Copy(w, base64.NewDecoder(base64.StdEncoding, strings.NewReader(stored.BodyBase64))); err != nil {
+			return err
+		}
 	}
-	return StoredResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    headers,
-		BodyBase64: bodyEncoded,
+	for _, trailer := range stored.Trailers {
+		w.Header().Add(trailer.Key, trailer.Value)
 	}
+	return nil
 }
 
-func writeStoredResponse(w http.ResponseWriter, stored StoredResponse) error {
+// writeStoredHeaders writes the status line and the stored headers, leaving
+// framing headers to the server. Stored trailers are announced so the server
+// can send them after the body.
+func writeStoredHeaders(w http.ResponseWriter, stored StoredResponse) {
 	for _, header := range stored.Headers {
 		if shouldSkipHeader(header.Key, header.Value) {
 			continue
 		}
 		w.Header().Add(header.Key, header.Value)
 	}
-	w.WriteHeader(stored.StatusCode)
-	if stored.BodyBase64 == "" {
-		return nil
-	}
-	bodyBytes, err := base64.StdEncoding.DecodeString(stored.BodyBase64)
-	if err != nil {
-		return err
+	announced := make(map[string]bool)
+	for _, trailer := range stored.Trailers {
+		key := http.CanonicalHeaderKey(trailer.Key)
+		if !announced[key] {
+			announced[key] = true
+			w.Header().Add("Trailer", key)
+		}
 	}
-	_, err = w.Write(bodyBytes)
-	return err
+	w.WriteHeader(stored.StatusCode)
 }
 
 type queryPair struct {
@@ -82,6 +109,11 @@ type queryPair struct {
 }
 
 func sortQueryParams(rawQuery string) (string, error) {
+	return sortQueryParamsExcept(rawQuery, nil)
+}
+
+// sortQueryParamsExcept sorts rawQuery after dropping the parameters in ignore.
+func sortQueryParamsExcept(rawQuery string, ignore map[string]bool) (string, error) {
 	if rawQuery == "" {
 		return "", nil
 	}
@@ -92,6 +124,9 @@ func sortQueryParams(rawQuery string) (string, error) {
 
 	pairs := make([]queryPair, 0)
 	for key, vals := range values {
+		if ignore[key] {
+			continue
+		}
 		if len(vals) == 0 {
 			pairs = append(pairs, queryPair{key: key, value: ""})
 			continue
@@ -160,12 +195,20 @@ func normalizeJSON(value interface{}) interface{} {
 }
 
 func canonicalJSON(body []byte) (string, error) {
+	return canonicalJSONWithout(body, nil)
+}
+
+// canonicalJSONWithout normalizes body after removing the fields at ignore.
+func canonicalJSONWithout(body []byte, ignore [][]string) (string, error) {
 	decoder := json.NewDecoder(bytes.NewReader(body))
 	decoder.UseNumber()
 	var value interface{}
 	if err := decoder.Decode(&value); err != nil {
 		return "", err
 	}
+	for _, path := range ignore {
+		value = removeJSONPath(value, path)
+	}
 	normalized := normalizeJSON(value)
 	encoded, err := json.Marshal(normalized)
 	if err != nil {
@@ -200,37 +243,35 @@ func escapeJSONASCII(input string) string {
 	return builder.String()
 }
 
+// buildKey builds a key with the default KeyPolicy: path, method, sorted query
+// and normalized JSON or form body.
 func buildKey(req *http.Request, body []byte) (string, error) {
-	path := req.URL.Path
-	method := req.Method
+	var policy *KeyPolicy
+	return policy.buildKey(req, body)
+}
 
-	sortedQuery, err := sortQueryParams(req.URL.RawQuery)
-	if err != nil {
-		return "", err
-	}
+// keyParts are the fields of a key produced by KeyPolicy.buildKey. With
+// KeySchemeHost path starts with scheme://host; headers holds the
+// ";"-separated name=value pairs of included headers.
+type keyParts struct {
+	path    string
+	method  string
+	headers string
+	query   string
+	body    string
+}
 
-	parts := []string{path, method, sortedQuery}
-	if method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch {
-		body = bytes.TrimSpace(body)
-		if len(body) > 0 {
-			contentType := req.Header.Get("Content-Type")
-			if strings.Contains(contentType, "application/json") {
-				normalized, err := canonicalJSON(body)
-				if err != nil {
-					return "", err
-				}
-				parts = append(parts, normalized)
-			} else if strings.Contains(contentType, "application/x-www-form-urlencoded") {
-				encoded, err := sortQueryParams(string(body))
-				if err != nil {
-					return "", err
-				}
-				parts = append(parts, encoded)
-			}
-		}
+func splitKey(key string) (keyParts, error) {
+	parts := strings.SplitN(key, "|", 4)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+		return keyParts{}, fmt.Errorf("malformed key: %q", key)
 	}
-
-	return strings.Join(parts, "|"), nil
+	method, headers, _ := strings.Cut(parts[1], ";")
+	split := keyParts{path: parts[0], method: method, headers: headers, query: parts[2]}
+	if len(parts) == 4 {
+		split.body = parts[3]
+	}
+	return split, nil
 }
 
 func shouldSkipHeader(key, value string) bool {
@@ -0,0 +1,134 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// isGRPC reports whether header describes a gRPC message stream
+// (application/grpc, application/grpc+proto, ...).
+func isGRPC(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// grpcMessages splits a gRPC body into its length-prefixed messages,
+// decompressing gzip messages when encoding is "gzip".
+func grpcMessages(body []byte, encoding string) ([][]byte, error) {
+	var messages [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errors.New("grpc: truncated message prefix")
+		}
+		compressed := body[0] == 1
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(length) {
+			return nil, errors.New("grpc: truncated message")
+		}
+		message := body[5 : 5+length]
+		body = body[5+length:]
+		if compressed {
+			if encoding != "gzip" {
+				return nil, fmt.Errorf("grpc: unsupported message encoding %q", encoding)
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(message))
+			if err != nil {
+				return nil, err
+			}
+			message, err = io.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// grpcKeyBody renders the request messages of a gRPC call for its key. With
+// a descriptor for the method the messages are decoded and rendered as
+// canonical JSON, which ignore_json_fields applies to; otherwise they are
+// keyed by their base64 bytes. Messages are joined with ",".
+func (p *KeyPolicy) grpcKeyBody(req *http.Request, body []byte, ignore [][]string) (string, error) {
+	messages, err := grpcMessages(body, req.Header.Get("Grpc-Encoding"))
+	if err != nil {
+		return "", err
+	}
+	var input protoreflect.MessageDescriptor
+	if p != nil {
+		input = p.grpcInputs[req.URL.Path]
+	}
+	encoded := make([]string, 0, len(messages))
+	for _, message := range messages {
+		if input == nil {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString(message))
+			continue
+		}
+		decoded := dynamicpb.NewMessage(input)
+		if err := proto.Unmarshal(message, decoded); err != nil {
+			return "", fmt.Errorf("grpc: decode %s request: %w", req.URL.Path, err)
+		}
+		rendered, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(decoded)
+		if err != nil {
+			return "", err
+		}
+		normalized, err := canonicalJSONWithout(rendered, ignore)
+		if err != nil {
+			return "", err
+		}
+		encoded = append(encoded, normalized)
+	}
+	return strings.Join(encoded, ","), nil
+}
+
+// LoadGRPCDescriptorSet reads a FileDescriptorSet (protoc
+// --descriptor_set_out --include_imports) so gRPC request messages of its
+// services are keyed by their decoded content instead of their bytes.
+func (p *KeyPolicy) LoadGRPCDescriptorSet(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse descriptor set %s: %w", filename, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return fmt.Errorf("load descriptor set %s: %w", filename, err)
+	}
+	inputs := make(map[string]protoreflect.MessageDescriptor)
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			service := services.Get(i)
+			methods := service.Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := methods.Get(j)
+				inputs["/"+string(service.FullName())+"/"+string(method.Name())] = method.Input()
+			}
+		}
+		return true
+	})
+	p.grpcInputs = inputs
+	return nil
+}
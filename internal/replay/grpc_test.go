@@ -0,0 +1,208 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// grpcFrame wraps message in the gRPC length prefix.
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func newGRPCRequest(t *testing.T, url string, message []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(grpcFrame(message)))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	return req
+}
+
+// writeEchoDescriptorSet writes a descriptor set for
+// "service pkg.Echo { rpc Say(Req) returns (Req); }" with
+// "message Req { string name = 1; int32 count = 2; }".
+func writeEchoDescriptorSet(t *testing.T) string {
+	t.Helper()
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("echo.proto"),
+		Package: proto.String("pkg"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Req"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), JsonName: proto.String("name")},
+				{Name: proto.String("count"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), JsonName: proto.String("count")},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Say"),
+				InputType:  proto.String(".pkg.Req"),
+				OutputType: proto.String(".pkg.Req"),
+			}},
+		}},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatalf("marshal descriptor set: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "echo.pb")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write descriptor set: %v", err)
+	}
+	return path
+}
+
+func TestGRPCKeyUsesMessageBytes(t *testing.T) {
+	// name: "a", count: 3
+	req := newGRPCRequest(t, "http://example.com/pkg.Echo/Say", []byte{0x0a, 0x01, 'a', 0x10, 0x03})
+	body, _ := io.ReadAll(req.Body)
+	key, err := buildKey(req, body)
+	if err != nil {
+		t.Fatalf("buildKey: %v", err)
+	}
+	if want := "/pkg.Echo/Say|POST||CgFhEAM="; key != want {
+		t.Fatalf("key %q, want %q", key, want)
+	}
+}
+
+func TestGRPCKeyWithDescriptorSet(t *testing.T) {
+	policy := &KeyPolicy{
+		GRPCDescriptorSet: writeEchoDescriptorSet(t),
+		Rules: []*KeyRule{{
+			RuleMatch:        RuleMatch{Name: "ignore count", Enable: true, Match: RequestMatch{Path: "/pkg.Echo/Say"}},
+			IgnoreJSONFields: []string{"count"},
+		}},
+	}
+	if err := policy.LoadGRPCDescriptorSet(policy.GRPCDescriptorSet); err != nil {
+		t.Fatalf("LoadGRPCDescriptorSet: %v", err)
+	}
+
+	// Field order and the ignored field do not change the key.
+	keys := make(map[string]bool)
+	for _, message := range [][]byte{
+		{0x0a, 0x01, 'a', 0x10, 0x03},
+		{0x10, 0x04, 0x0a, 0x01, 'a'},
+	} {
+		req := newGRPCRequest(t, "http://example.com/pkg.Echo/Say", message)
+		key, err := policy.buildKey(req, grpcFrame(message))
+		if err != nil {
+			t.Fatalf("buildKey: %v", err)
+		}
+		keys[key] = true
+	}
+	if len(keys) != 1 || !keys[`/pkg.Echo/Say|POST||{"name":"a"}`] {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// Unknown methods fall back to the message bytes.
+	message := []byte{0x0a, 0x01, 'a'}
+	key, err := policy.buildKey(newGRPCRequest(t, "http://example.com/pkg.Other/Say", message), grpcFrame(message))
+	if err != nil {
+		t.Fatalf("buildKey: %v", err)
+	}
+	if want := "/pkg.Other/Say|POST||CgFh"; key != want {
+		t.Fatalf("key %q, want %q", key, want)
+	}
+}
+
+func TestGRPCMessagesRejectTruncatedBody(t *testing.T) {
+	if _, err := grpcMessages([]byte{0, 0, 0, 0, 9, 1}, ""); err == nil {
+		t.Fatalf("expected an error for a truncated message")
+	}
+}
+
+// newH2CTestClient speaks cleartext HTTP/2 with prior knowledge.
+func newH2CTestClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func TestServerRecordsAndReplaysGRPC(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "")
+	}), &http2.Server{}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream: client,
+		H2C:      true,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router.Handler())
+	defer server.Close()
+
+	message := []byte{0x0a, 0x01, 'a'}
+	h2 := newH2CTestClient()
+	for i := 0; i < 2; i++ {
+		resp, err := h2.Do(newGRPCRequest(t, server.URL+"/pkg.Echo/Say", message))
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("call %d: read body: %v", i, err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatalf("call %d: status %d over HTTP/%d", i, resp.StatusCode, resp.ProtoMajor)
+		}
+		if !bytes.Equal(body, grpcFrame(message)) {
+			t.Fatalf("call %d: unexpected body %x", i, body)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Fatalf("call %d: grpc-status trailer %q", i, got)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the second call to be replayed, upstream saw %d calls", calls)
+	}
+
+	stored, found, _ := repo.Get(context.Background(), "/pkg.Echo/Say|POST||CgFh")
+	if !found || len(stored.Trailers) != 2 {
+		t.Fatalf("expected the call to be recorded with its trailers, got %#v", stored)
+	}
+}
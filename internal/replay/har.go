@@ -0,0 +1,332 @@
+package replay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultHARBaseURL is used for exported request URLs when keys carry no host.
+const defaultHARBaseURL = "http://localhost"
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []harNameValue `json:"params,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// ImportHAR reads a HAR 1.2 log from r and stores every entry in repository.
+func ImportHAR(ctx context.Context, r io.Reader, repository Repository, options ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	var file harFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return stats, err
+	}
+
+	for i, entry := range file.Log.Entries {
+		stats.Read++
+		key, response, err := harEntryToStored(entry, options.KeyPolicy)
+		if err != nil {
+			log.Printf("skip har entry %d: %v", i, err)
+			stats.Skipped++
+			continue
+		}
+		if response.StatusCode == 0 || !options.accepts(response) {
+			stats.Skipped++
+			continue
+		}
+		if err := repository.Set(ctx, options.KeyPrefix+key, response, options.Overwrite); err != nil {
+			return stats, err
+		}
+		stats.Stored++
+	}
+	return stats, nil
+}
+
+func harEntryToStored(entry harEntry, policy *KeyPolicy) (string, StoredResponse, error) {
+	req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, nil)
+	if err != nil {
+		return "", StoredResponse{}, err
+	}
+	for _, header := range entry.Request.Headers {
+		// Browsers export HTTP/2 pseudo headers such as :authority.
+		if strings.HasPrefix(header.Name, ":") {
+			continue
+		}
+		req.Header.Add(header.Name, header.Value)
+	}
+
+	var body []byte
+	if postData := entry.Request.PostData; postData != nil {
+		if req.Header.Get("Content-Type") == "" && postData.MimeType != "" {
+			req.Header.Set("Content-Type", postData.MimeType)
+		}
+		body = []byte(postData.Text)
+		if len(body) == 0 && len(postData.Params) > 0 {
+			form := url.Values{}
+			for _, param := range postData.Params {
+				form.Add(param.Name, param.Value)
+			}
+			body = []byte(form.Encode())
+		}
+	}
+
+	key, err := policy.buildKey(req, body)
+	if err != nil {
+		return "", StoredResponse{}, err
+	}
+
+	response, err := harResponseToStored(entry.Response)
+	if err != nil {
+		return "", StoredResponse{}, err
+	}
+	return key, response, nil
+}
+
+func harResponseToStored(resp harResponse) (StoredResponse, error) {
+	headers := make([]Header, 0, len(resp.Headers))
+	for _, header := range resp.Headers {
+		if strings.HasPrefix(header.Name, ":") {
+			continue
+		}
+		headers = append(headers, Header{Key: header.Name, Value: header.Value})
+	}
+	// HAR content is always decoded, so the wire encoding no longer applies.
+	removeHeader(&headers, "Content-Encoding")
+	removeHeader(&headers, "Content-Length")
+	if _, ok := findHeader(headers, "Content-Type"); !ok && resp.Content.MimeType != "" {
+		headers = append(headers, Header{Key: "Content-Type", Value: resp.Content.MimeType})
+	}
+
+	encoded := resp.Content.Text
+	if resp.Content.Encoding == "base64" {
+		if _, err := base64.StdEncoding.DecodeString(encoded); err != nil {
+			return StoredResponse{}, err
+		}
+	} else if resp.Content.Encoding != "" {
+		return StoredResponse{}, errors.New("unsupported content encoding: " + resp.Content.Encoding)
+	} else if encoded != "" {
+		encoded = base64.StdEncoding.EncodeToString([]byte(encoded))
+	}
+
+	return StoredResponse{
+		StatusCode: resp.Status,
+		Headers:    headers,
+		BodyBase64: encoded,
+	}, nil
+}
+
+// ExportHAR writes every matching entry in repository to w as a HAR 1.2 log.
+// Request URLs are rebuilt from the storage key; keys without a host are
+// resolved against options.BaseURL. Recorded server-sent events become the
+// response text without their timing. HAR cannot hold WebSocket messages or
+// trailers, so such entries are skipped with a log line.
+func ExportHAR(ctx context.Context, w io.Writer, repository Repository, options ExportOptions) (int, error) {
+	baseURL := options.BaseURL
+	if baseURL == "" {
+		baseURL = defaultHARBaseURL
+	}
+	started := time.Now().UTC().Format(time.RFC3339Nano)
+
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "mitmredis", Version: "1"},
+		Entries: make([]harEntry, 0),
+	}}
+	written, err := exportEntries(ctx, repository, options, func(entry Entry) error {
+		request, err := harRequestFromKey(entry.Key, baseURL)
+		if err != nil {
+			log.Printf("skip har export of %s: %v", entry.Key, err)
+			return nil
+		}
+		if reason := harUnsupported(entry.Response); reason != "" {
+			log.Printf("skip har export of %s: %s", entry.Key, reason)
+			return nil
+		}
+		file.Log.Entries = append(file.Log.Entries, harEntry{
+			StartedDateTime: started,
+			Request:         request,
+			Response:        harResponseFromStored(entry.Response),
+		})
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return len(file.Log.Entries), encoder.Encode(file)
+}
+
+func harRequestFromKey(key, baseURL string) (harRequest, error) {
+	parts, err := splitKey(key)
+	if err != nil {
+		return harRequest{}, err
+	}
+
+	target := parts.path
+	if !strings.Contains(target, "://") {
+		target = strings.TrimSuffix(baseURL, "/") + target
+	}
+	if parts.query != "" {
+		target += "?" + parts.query
+	}
+	request := harRequest{
+		Method:      parts.method,
+		URL:         target,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+	if parts.query != "" {
+		for _, field := range strings.Split(parts.query, "&") {
+			name, value, _ := strings.Cut(field, "=")
+			name, _ = url.QueryUnescape(name)
+			value, _ = url.QueryUnescape(value)
+			request.QueryString = append(request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if parts.headers != "" {
+		for _, field := range strings.Split(parts.headers, ";") {
+			name, value, _ := strings.Cut(field, "=")
+			value, _ = url.QueryUnescape(value)
+			request.Headers = append(request.Headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	if parts.body != "" {
+		mimeType := "application/x-www-form-urlencoded"
+		if trimmed := strings.TrimSpace(parts.body); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			mimeType = "application/json"
+		}
+		request.Headers = append(request.Headers, harNameValue{Name: "Content-Type", Value: mimeType})
+		request.PostData = &harPostData{MimeType: mimeType, Text: parts.body}
+		request.BodySize = len(parts.body)
+	}
+	return request, nil
+}
+
+// harUnsupported returns why stored cannot be exported to HAR, or "".
+func harUnsupported(stored StoredResponse) string {
+	switch {
+	case len(stored.WebSocket) > 0 || stored.StatusCode == http.StatusSwitchingProtocols:
+		return "HAR has no WebSocket messages"
+	case len(stored.Trailers) > 0:
+		return "HAR has no trailers"
+	default:
+		return ""
+	}
+}
+
+func harResponseFromStored(stored StoredResponse) harResponse {
+	if len(stored.Events) > 0 {
+		var text strings.Builder
+		for _, event := range stored.Events {
+			text.WriteString(event.Data)
+		}
+		stored.BodyBase64 = base64.StdEncoding.EncodeToString([]byte(text.String()))
+	}
+
+	headers := make([]harNameValue, 0, len(stored.Headers))
+	for _, header := range stored.Headers {
+		headers = append(headers, harNameValue{Name: header.Key, Value: header.Value})
+	}
+	mimeType, _ := findHeader(stored.Headers, "Content-Type")
+
+	size := 0
+	if body, err := base64.StdEncoding.DecodeString(stored.BodyBase64); err == nil {
+		size = len(body)
+	}
+	content := harContent{Size: size, MimeType: mimeType}
+	if stored.BodyBase64 != "" {
+		content.Text = stored.BodyBase64
+		content.Encoding = "base64"
+	}
+	return harResponse{
+		Status:      stored.StatusCode,
+		StatusText:  http.StatusText(stored.StatusCode),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     headers,
+		Content:     content,
+		HeadersSize: -1,
+		BodySize:    size,
+	}
+}
@@ -0,0 +1,180 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleHAR = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "devtools", "version": "1"},
+    "entries": [
+      {
+        "startedDateTime": "2024-01-01T00:00:00.000Z",
+        "time": 12,
+        "request": {
+          "method": "POST",
+          "url": "https://api.example.com/items?b=2&a=1",
+          "httpVersion": "HTTP/2",
+          "headers": [{"name": ":authority", "value": "api.example.com"}],
+          "queryString": [],
+          "cookies": [],
+          "postData": {"mimeType": "application/json", "text": "{\"z\":1,\"y\":[2,1]}"},
+          "headersSize": -1,
+          "bodySize": 17
+        },
+        "response": {
+          "status": 201,
+          "statusText": "Created",
+          "httpVersion": "HTTP/2",
+          "headers": [
+            {"name": "content-type", "value": "application/json"},
+            {"name": "content-encoding", "value": "br"}
+          ],
+          "cookies": [],
+          "content": {"size": 11, "mimeType": "application/json", "text": "{\"ok\":true}"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": -1
+        },
+        "cache": {},
+        "timings": {"send": 0, "wait": 10, "receive": 2}
+      },
+      {
+        "startedDateTime": "2024-01-01T00:00:00.000Z",
+        "time": 0,
+        "request": {"method": "GET", "url": "https://api.example.com/blocked", "httpVersion": "", "headers": [], "queryString": [], "cookies": [], "headersSize": -1, "bodySize": 0},
+        "response": {"status": 0, "statusText": "", "httpVersion": "", "headers": [], "cookies": [], "content": {"size": 0, "mimeType": ""}, "redirectURL": "", "headersSize": -1, "bodySize": 0},
+        "cache": {},
+        "timings": {"send": 0, "wait": 0, "receive": 0}
+      }
+    ]
+  }
+}`
+
+func TestImportHAR(t *testing.T) {
+	repo := newMemoryRepo()
+	stats, err := ImportHAR(context.Background(), strings.NewReader(sampleHAR), repo, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportHAR: %v", err)
+	}
+	if stats.Read != 2 || stats.Stored != 1 || stats.Skipped != 1 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	stored, found, _ := repo.Get(context.Background(), `/items|POST|a=1&b=2|{"y":[1,2],"z":1}`)
+	if !found {
+		t.Fatalf("expected entry to be stored, have %v", repo.data)
+	}
+	body, _ := base64.StdEncoding.DecodeString(stored.BodyBase64)
+	if stored.StatusCode != 201 || string(body) != `{"ok":true}` {
+		t.Fatalf("unexpected response: %d %s", stored.StatusCode, body)
+	}
+	if _, ok := findHeader(stored.Headers, "Content-Encoding"); ok {
+		t.Fatalf("expected Content-Encoding to be dropped: %#v", stored.Headers)
+	}
+}
+
+func TestHARRoundTrip(t *testing.T) {
+	source := newMemoryRepo()
+	source.data[`/items|POST|a=1&b=2|{"y":[1,2],"z":1}`] = StoredResponse{
+		StatusCode: 201,
+		Headers:    []Header{{Key: "Content-Type", Value: "application/octet-stream"}},
+		BodyBase64: base64.StdEncoding.EncodeToString([]byte{0x00, 0xff, 0x10}),
+	}
+	source.data["/form|POST||a=0&b=1"] = StoredResponse{StatusCode: 200, Headers: []Header{}}
+	source.data["/plain|GET|"] = StoredResponse{StatusCode: 200, Headers: []Header{}, BodyBase64: "aGk="}
+
+	var buf bytes.Buffer
+	written, err := ExportHAR(context.Background(), &buf, source, ExportOptions{BaseURL: "https://api.example.com"})
+	if err != nil {
+		t.Fatalf("ExportHAR: %v", err)
+	}
+	if written != 3 {
+		t.Fatalf("unexpected export count: %d", written)
+	}
+
+	var file harFile
+	if err := json.Unmarshal(buf.Bytes(), &file); err != nil {
+		t.Fatalf("decode har: %v", err)
+	}
+	if file.Log.Version != "1.2" || len(file.Log.Entries) != 3 {
+		t.Fatalf("unexpected log: %#v", file.Log)
+	}
+
+	target := newMemoryRepo()
+	if _, err := ImportHAR(context.Background(), &buf, target, ImportOptions{IncludeEmpty: true}); err != nil {
+		t.Fatalf("ImportHAR: %v", err)
+	}
+	if !reflect.DeepEqual(target.data, source.data) {
+		t.Fatalf("round trip mismatch:\n%#v\n%#v", target.data, source.data)
+	}
+}
+
+func TestExportHARHostKeys(t *testing.T) {
+	source := newMemoryRepo()
+	source.data["https://api.example.com/v1/users|GET|a=1"] = StoredResponse{StatusCode: 200, Headers: []Header{}}
+
+	var buf bytes.Buffer
+	if _, err := ExportHAR(context.Background(), &buf, source, ExportOptions{}); err != nil {
+		t.Fatalf("ExportHAR: %v", err)
+	}
+	var file harFile
+	if err := json.Unmarshal(buf.Bytes(), &file); err != nil {
+		t.Fatalf("decode har: %v", err)
+	}
+	if got := file.Log.Entries[0].Request.URL; got != "https://api.example.com/v1/users?a=1" {
+		t.Fatalf("unexpected url: %s", got)
+	}
+
+	target := newMemoryRepo()
+	if _, err := ImportHAR(context.Background(), &buf, target, ImportOptions{IncludeEmpty: true, KeyPolicy: NewKeyPolicy(KeySchemeHost)}); err != nil {
+		t.Fatalf("ImportHAR: %v", err)
+	}
+	if !reflect.DeepEqual(target.data, source.data) {
+		t.Fatalf("round trip mismatch: %#v", target.data)
+	}
+}
+
+func TestExportHARStreamsAndUpgrades(t *testing.T) {
+	source := newMemoryRepo()
+	source.data["/events|GET|"] = StoredResponse{
+		StatusCode: 200,
+		Headers:    []Header{{Key: "Content-Type", Value: "text/event-stream"}},
+		Events:     []StoredEvent{{Data: "data: one\n\n"}, {OffsetMillis: 100, Data: "data: two\n\n"}},
+	}
+	source.data["/socket|GET|"] = StoredResponse{
+		StatusCode: 101,
+		Headers:    []Header{},
+		WebSocket:  []StoredWSMessage{{Data: "hi"}},
+	}
+	source.data["/pkg.Echo/Say|POST|"] = StoredResponse{
+		StatusCode: 200,
+		Headers:    []Header{},
+		Trailers:   []Header{{Key: "Grpc-Status", Value: "0"}},
+	}
+
+	var buf bytes.Buffer
+	written, err := ExportHAR(context.Background(), &buf, source, ExportOptions{})
+	if err != nil {
+		t.Fatalf("ExportHAR: %v", err)
+	}
+	if written != 1 {
+		t.Fatalf("expected only the event stream to be exported, got %d", written)
+	}
+	var file harFile
+	if err := json.Unmarshal(buf.Bytes(), &file); err != nil {
+		t.Fatalf("decode har: %v", err)
+	}
+	content := file.Log.Entries[0].Response.Content
+	text, _ := base64.StdEncoding.DecodeString(content.Text)
+	if string(text) != "data: one\n\ndata: two\n\n" || content.MimeType != "text/event-stream" {
+		t.Fatalf("unexpected event stream content: %#v", content)
+	}
+}
@@ -59,7 +59,42 @@ func TestReplaySampleFlowSQLite(t *testing.T) {
 	}
 	defer repository.Close()
 
-	router := NewReplayRouter(repository, ServerOptions{
+	router := newTestRouter(t, repository, ServerOptions{
+		Plugins: []Plugin{NewReplayPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	assertSampleFlowResponse(t, http.MethodPost, server.URL+"/post?name=hello", "https://httpbin.org/post?name=hello")
+	assertSampleFlowResponse(t, http.MethodGet, server.URL+"/get?name=hello", "https://httpbin.org/get?name=hello")
+}
+
+func TestReplaySampleFlowNative(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to resolve test file location")
+	}
+	repoRoot := filepath.Clean(filepath.Join(filepath.Dir(filename), "..", ".."))
+	samplePath := filepath.Join(repoRoot, "testdata", "sample.flow")
+	if _, err := os.Stat(samplePath); err != nil {
+		t.Skipf("sample flow file missing: %v", err)
+	}
+
+	repository, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "flows.sqlite"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("open sqlite repository: %v", err)
+	}
+	defer repository.Close()
+
+	stats, err := ImportFlowFile(context.Background(), samplePath, repository, ImportOptions{Overwrite: true})
+	if err != nil {
+		t.Fatalf("import flow file: %v", err)
+	}
+	if stats.Stored == 0 {
+		t.Fatalf("no flows imported: %#v", stats)
+	}
+
+	router := newTestRouter(t, repository, ServerOptions{
 		Plugins: []Plugin{NewReplayPlugin()},
 	})
 	server := httptest.NewServer(router)
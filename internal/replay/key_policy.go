@@ -0,0 +1,258 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// KeyScheme selects which parts of the request URL identify a stored entry.
+type KeyScheme string
+
+const (
+	// KeySchemePath keys entries by path, method, query and body only.
+	// It is the historical scheme and matches existing databases.
+	KeySchemePath KeyScheme = "path"
+	// KeySchemeHost additionally prefixes the path with scheme://host so the
+	// same path on different APIs maps to different entries.
+	KeySchemeHost KeyScheme = "host"
+)
+
+func ParseKeyScheme(value string) (KeyScheme, error) {
+	switch KeyScheme(value) {
+	case "", KeySchemePath:
+		return KeySchemePath, nil
+	case KeySchemeHost:
+		return KeySchemeHost, nil
+	default:
+		return "", fmt.Errorf("unsupported key scheme: %s", value)
+	}
+}
+
+// KeyRule adjusts the key of requests matching Match.
+// JSON field paths are dot separated; "*" matches every key or array element.
+type KeyRule struct {
+	RuleMatch
+	IgnoreQuery      []string `json:"ignore_query"`
+	IgnoreJSONFields []string `json:"ignore_json_fields"`
+	IncludeHeaders   []string `json:"include_headers"`
+}
+
+// KeyPolicy controls how storage keys are built from requests. It is applied
+// both when recording and when replaying. A nil policy uses KeySchemePath and
+// no rules. An empty Scheme lets the server pick its mode's default.
+type KeyPolicy struct {
+	Scheme KeyScheme  `json:"scheme"`
+	Rules  []*KeyRule `json:"rules"`
+	// GRPCDescriptorSet names a FileDescriptorSet file whose services' gRPC
+	// requests are keyed by decoded content; see LoadGRPCDescriptorSet.
+	GRPCDescriptorSet string `json:"grpc_descriptor_set"`
+
+	// grpcInputs maps gRPC paths ("/package.Service/Method") to their
+	// request message types.
+	grpcInputs map[string]protoreflect.MessageDescriptor
+}
+
+func NewKeyPolicy(scheme KeyScheme) *KeyPolicy {
+	return &KeyPolicy{Scheme: scheme}
+}
+
+func NewKeyPolicyFromFile(filename string) (*KeyPolicy, error) {
+	var policy KeyPolicy
+	if err := newStructFromFile(filename, &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	if policy.GRPCDescriptorSet != "" {
+		if err := policy.LoadGRPCDescriptorSet(policy.GRPCDescriptorSet); err != nil {
+			return nil, err
+		}
+	}
+	return &policy, nil
+}
+
+func (p *KeyPolicy) validate() error {
+	if p.Scheme != "" {
+		if _, err := ParseKeyScheme(string(p.Scheme)); err != nil {
+			return err
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return fmt.Errorf("%d empty rule", i)
+		}
+		for _, field := range rule.IgnoreJSONFields {
+			for _, segment := range strings.Split(field, ".") {
+				if segment == "" {
+					return fmt.Errorf("%d invalid ignore_json_fields path %q", i, field)
+				}
+			}
+		}
+		for _, header := range rule.IncludeHeaders {
+			if strings.TrimSpace(header) == "" {
+				return fmt.Errorf("%d empty include_headers entry", i)
+			}
+		}
+	}
+	return nil
+}
+
+// withScheme returns a copy of p using scheme.
+func (p *KeyPolicy) withScheme(scheme KeyScheme) *KeyPolicy {
+	copied := KeyPolicy{Scheme: scheme}
+	if p != nil {
+		copied.Rules = p.Rules
+		copied.GRPCDescriptorSet = p.GRPCDescriptorSet
+		copied.grpcInputs = p.grpcInputs
+	}
+	return &copied
+}
+
+// keyAdjustments is the union of every enabled rule matching a request.
+type keyAdjustments struct {
+	ignoreQuery map[string]bool
+	ignoreJSON  [][]string
+	headers     []string
+}
+
+func (p *KeyPolicy) adjustments(req *http.Request, body []byte) keyAdjustments {
+	var adjust keyAdjustments
+	if p == nil || len(p.Rules) == 0 {
+		return adjust
+	}
+	ctx := &RequestContext{Request: req, Body: body}
+	seenHeaders := make(map[string]bool)
+	for _, rule := range matchingRules(p.Rules, ctx) {
+		for _, name := range rule.IgnoreQuery {
+			if adjust.ignoreQuery == nil {
+				adjust.ignoreQuery = make(map[string]bool)
+			}
+			adjust.ignoreQuery[name] = true
+		}
+		for _, field := range rule.IgnoreJSONFields {
+			adjust.ignoreJSON = append(adjust.ignoreJSON, strings.Split(field, "."))
+		}
+		for _, name := range rule.IncludeHeaders {
+			canonical := strings.ToLower(strings.TrimSpace(name))
+			if !seenHeaders[canonical] {
+				seenHeaders[canonical] = true
+				adjust.headers = append(adjust.headers, canonical)
+			}
+		}
+	}
+	sort.Strings(adjust.headers)
+	return adjust
+}
+
+// buildKey joins path, method (plus included headers), sorted query and the
+// normalized JSON, form or gRPC body with "|".
+func (p *KeyPolicy) buildKey(req *http.Request, body []byte) (string, error) {
+	adjust := p.adjustments(req, body)
+
+	path := req.URL.Path
+	if p != nil && p.Scheme == KeySchemeHost {
+		path = requestOrigin(req) + path
+	}
+	method := req.Method
+	if len(adjust.headers) > 0 {
+		method += ";" + encodeKeyHeaders(req.Header, adjust.headers)
+	}
+
+	sortedQuery, err := sortQueryParamsExcept(req.URL.RawQuery, adjust.ignoreQuery)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{path, method, sortedQuery}
+	if req.Method == http.MethodPost && isGRPC(req.Header) {
+		// Message bytes are binary, so they are not trimmed.
+		encoded, err := p.grpcKeyBody(req, body, adjust.ignoreJSON)
+		if err != nil {
+			return "", err
+		}
+		if encoded != "" {
+			parts = append(parts, encoded)
+		}
+		return strings.Join(parts, "|"), nil
+	}
+	if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 {
+			contentType := req.Header.Get("Content-Type")
+			if strings.Contains(contentType, "application/json") {
+				normalized, err := canonicalJSONWithout(body, adjust.ignoreJSON)
+				if err != nil {
+					return "", err
+				}
+				parts = append(parts, normalized)
+			} else if strings.Contains(contentType, "application/x-www-form-urlencoded") {
+				encoded, err := sortQueryParams(string(body))
+				if err != nil {
+					return "", err
+				}
+				parts = append(parts, encoded)
+			}
+		}
+	}
+
+	return strings.Join(parts, "|"), nil
+}
+
+// encodeKeyHeaders renders the named headers as name=value pairs. Values are
+// query-escaped so they cannot contain the key separators.
+func encodeKeyHeaders(headers http.Header, names []string) string {
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(headers.Values(name), ",")
+		pairs = append(pairs, name+"="+url.QueryEscape(value))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// removeJSONPath deletes the field at path from a decoded JSON value.
+func removeJSONPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	segment, rest := path[0], path[1:]
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			if segment != "*" && segment != key {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(val, key)
+				continue
+			}
+			val[key] = removeJSONPath(item, rest)
+		}
+	case []interface{}:
+		if segment == "*" {
+			for i, item := range val {
+				val[i] = removeJSONPath(item, rest)
+			}
+			if len(rest) == 0 {
+				return []interface{}{}
+			}
+			return val
+		}
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(val) {
+			return val
+		}
+		if len(rest) == 0 {
+			return append(val[:index:index], val[index+1:]...)
+		}
+		val[index] = removeJSONPath(val[index], rest)
+	}
+	return value
+}
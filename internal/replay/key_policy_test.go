@@ -0,0 +1,118 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyPolicySchemes(t *testing.T) {
+	first := httptest.NewRequest(http.MethodGet, "https://one.example.com/v1/users?b=2&a=1", nil)
+	second := httptest.NewRequest(http.MethodGet, "https://two.example.com/v1/users?a=1&b=2", nil)
+
+	var nilPolicy *KeyPolicy
+	pathKey, _ := nilPolicy.buildKey(first, nil)
+	otherPathKey, _ := NewKeyPolicy(KeySchemePath).buildKey(second, nil)
+	if pathKey != "/v1/users|GET|a=1&b=2" || pathKey != otherPathKey {
+		t.Fatalf("unexpected path keys: %q %q", pathKey, otherPathKey)
+	}
+
+	hostPolicy := NewKeyPolicy(KeySchemeHost)
+	hostKey, _ := hostPolicy.buildKey(first, nil)
+	otherHostKey, _ := hostPolicy.buildKey(second, nil)
+	if hostKey != "https://one.example.com/v1/users|GET|a=1&b=2" {
+		t.Fatalf("unexpected host key: %q", hostKey)
+	}
+	if hostKey == otherHostKey {
+		t.Fatal("expected different hosts to produce different keys")
+	}
+}
+
+func TestParseKeyScheme(t *testing.T) {
+	if scheme, err := ParseKeyScheme(""); err != nil || scheme != KeySchemePath {
+		t.Fatalf("unexpected default scheme: %q, %v", scheme, err)
+	}
+	if scheme, err := ParseKeyScheme("host"); err != nil || scheme != KeySchemeHost {
+		t.Fatalf("unexpected host scheme: %q, %v", scheme, err)
+	}
+	if _, err := ParseKeyScheme("bogus"); err == nil {
+		t.Fatal("expected error for unknown scheme")
+	}
+}
+
+func TestKeyPolicyRules(t *testing.T) {
+	policy := &KeyPolicy{Rules: []*KeyRule{
+		{
+			RuleMatch:        RuleMatch{Enable: true, Match: RequestMatch{Path: "/v1/search*"}},
+			IgnoreQuery:      []string{"ts"},
+			IgnoreJSONFields: []string{"request_id", "items.*.nonce"},
+			IncludeHeaders:   []string{"X-Tenant"},
+		},
+		{
+			RuleMatch:   RuleMatch{Enable: false, Match: RequestMatch{Path: "/v1/search*"}},
+			IgnoreQuery: []string{"page"},
+		},
+	}}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	build := func(target, body string) string {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant", "acme corp")
+		key, err := policy.buildKey(req, []byte(body))
+		if err != nil {
+			t.Fatalf("buildKey: %v", err)
+		}
+		return key
+	}
+
+	first := build("/v1/search?page=2&ts=1", `{"request_id":"a","q":"x","items":[{"id":1,"nonce":"n1"}]}`)
+	second := build("/v1/search?ts=2&page=2", `{"q":"x","request_id":"b","items":[{"nonce":"n2","id":1}]}`)
+	want := `/v1/search|POST;x-tenant=acme+corp|page=2|{"items":[{"id":1}],"q":"x"}`
+	if first != want || second != want {
+		t.Fatalf("unexpected keys:\n%q\n%q\nwant %q", first, second, want)
+	}
+
+	other := build("/v1/users?ts=1", `{"request_id":"a"}`)
+	if other != `/v1/users|POST|ts=1|{"request_id":"a"}` {
+		t.Fatalf("unmatched rule changed key: %q", other)
+	}
+
+	parts, err := splitKey(want)
+	if err != nil {
+		t.Fatalf("splitKey: %v", err)
+	}
+	if parts.method != http.MethodPost || parts.headers != "x-tenant=acme+corp" {
+		t.Fatalf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestNewKeyPolicyFromFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "policy.json")
+	content := `{"scheme":"host","rules":[{"name":"ts","enable":true,"ignore_query":["ts"]}]}`
+	if err := os.WriteFile(valid, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewKeyPolicyFromFile(valid)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	key, _ := policy.buildKey(httptest.NewRequest(http.MethodGet, "http://api.example.com/a?ts=1&b=2", nil), nil)
+	if key != "http://api.example.com/a|GET|b=2" {
+		t.Fatalf("unexpected key: %q", key)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"scheme":"bogus"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyPolicyFromFile(invalid); err == nil {
+		t.Fatal("expected error for invalid scheme")
+	}
+}
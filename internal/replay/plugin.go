@@ -3,22 +3,34 @@ package replay
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 )
 
 // RequestContext carries mutable request state for plugin hooks.
 // Plugins may update Key or Body to influence cache lookup and upstream fetch.
 type RequestContext struct {
-	Request    *http.Request
-	Body       []byte
-	Key        string
-	KeyPrefix  string
+	Request   *http.Request
+	Body      []byte
+	Key       string
+	KeyPrefix string
+	// KeyPolicy is the policy Key was built with; plugins that rewrite the
+	// request should rebuild Key with it.
+	KeyPolicy  *KeyPolicy
 	CacheHit   bool
 	Repository Repository
 	SkipCache  bool
 	SkipStore  bool
 	// Response allows plugins to short-circuit cache/upstream handling.
 	Response *StoredResponse
+	// Upstream fetches cache misses; nil when no upstream is configured.
+	Upstream *UpstreamClient
+	// plugins is the chain handling the request; its upstream request
+	// plugins see every request sent upstream on the request's behalf.
+	plugins []Plugin
+	// refresh marks a background refresh of a stale entry, which replaces
+	// the entry even when recording does not overwrite.
+	refresh bool
 }
 
 // Plugin is the base interface for replay plugins.
@@ -45,10 +57,79 @@ type RequestPlugin interface {
 }
 
 // ResponsePlugin is invoked before a response is written to the client.
+// Streamed responses, event streams and WebSocket connections are written as
+// they arrive, so for them it only sees what is recorded.
 type ResponsePlugin interface {
 	OnResponse(*RequestContext, *StoredResponse) error
 }
 
+// UpstreamRequestPlugin is invoked just before a cache miss, refresh or
+// WebSocket handshake is sent upstream, with the outgoing request, so it can
+// sign or modify it. The request's body holds ctx.Body; a plugin that
+// replaces the body also sets ContentLength and GetBody.
+type UpstreamRequestPlugin interface {
+	OnUpstreamRequest(ctx *RequestContext, req *http.Request) error
+}
+
+// Initializer is implemented by plugins that acquire resources before the
+// server starts. InitPlugins calls it.
+type Initializer interface {
+	Init() error
+}
+
+// Closer is implemented by plugins that release resources or flush state
+// when the server stops. ClosePlugins calls it.
+type Closer interface {
+	Close() error
+}
+
+// drainer is implemented by plugins that run work in the background which
+// hands responses to the chain, such as replay refreshes. ClosePlugins waits
+// for it before any plugin of the chain is closed.
+type drainer interface {
+	drain()
+}
+
+// InitPlugins initializes the plugins in chain order. When one fails, those
+// already initialized are closed again and the error is returned.
+func InitPlugins(plugins []Plugin) error {
+	for i, plugin := range plugins {
+		hook, ok := plugin.(Initializer)
+		if !ok {
+			continue
+		}
+		if err := hook.Init(); err != nil {
+			if closeErr := ClosePlugins(plugins[:i]); closeErr != nil {
+				log.Printf("close plugins: %v", closeErr)
+			}
+			return pluginCallError{plugin: plugin.Name(), err: err}
+		}
+	}
+	return nil
+}
+
+// ClosePlugins waits for the background work of every plugin, routed ones
+// included, then closes the plugins in reverse chain order and returns their
+// errors joined.
+func ClosePlugins(plugins []Plugin) error {
+	for _, plugin := range allPlugins(plugins) {
+		if hook, ok := plugin.(drainer); ok {
+			hook.drain()
+		}
+	}
+	var errs []error
+	for i := len(plugins) - 1; i >= 0; i-- {
+		hook, ok := plugins[i].(Closer)
+		if !ok {
+			continue
+		}
+		if err := hook.Close(); err != nil {
+			errs = append(errs, pluginCallError{plugin: plugins[i].Name(), err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // PluginError allows plugins to control the HTTP status returned on failure.
 type PluginError struct {
 	Status int
@@ -111,6 +192,29 @@ func applyResponsePlugins(plugins []Plugin, ctx *RequestContext, stored *StoredR
 	return nil
 }
 
+func applyUpstreamRequestPlugins(plugins []Plugin, ctx *RequestContext, req *http.Request) error {
+	for _, plugin := range plugins {
+		if plugin == nil {
+			continue
+		}
+		hook, ok := plugin.(UpstreamRequestPlugin)
+		if !ok {
+			continue
+		}
+		if err := hook.OnUpstreamRequest(ctx, req); err != nil {
+			return pluginCallError{plugin: plugin.Name(), err: err}
+		}
+	}
+	return nil
+}
+
+// isPluginError reports whether err came from a plugin hook rather than
+// from the upstream itself.
+func isPluginError(err error) bool {
+	var callErr pluginCallError
+	return errors.As(err, &callErr)
+}
+
 func statusFromPluginError(err error) int {
 	var pluginErr PluginError
 	if errors.As(err, &pluginErr) && pluginErr.Status > 0 {
@@ -0,0 +1,195 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PluginConfig declares one plugin of a configured chain.
+type PluginConfig struct {
+	// Type is one of replay, record, decoder, dumper, map-local,
+	// map-remote, header-rewrite or route.
+	Type string `json:"type"`
+	// Name overrides the plugin's default name.
+	Name string `json:"name"`
+	// Settings holds the plugin's options in the form of its rules file.
+	// Plugins with rules (replay, record, map-local, map-remote and
+	// header-rewrite) are enabled unless the settings say "enable": false;
+	// decoder, dumper and route have no such switch.
+	Settings json.RawMessage `json:"settings"`
+	// File reads the settings from a separate JSON or YAML file instead.
+	File string `json:"file"`
+}
+
+// dumperSettings configures a Dumper: Output is a file appended to, or
+// standard output when empty; Level 1 adds the bodies.
+type dumperSettings struct {
+	Output string `json:"output"`
+	Level  int    `json:"level"`
+}
+
+// routeSettings configures a Route: the plugins of the chain run for the
+// requests Match selects.
+type routeSettings struct {
+	Match   RequestMatch   `json:"match"`
+	Plugins []PluginConfig `json:"plugins"`
+}
+
+// NewPluginsFromConfig builds a plugin chain in the declared order.
+func NewPluginsFromConfig(configs []PluginConfig) ([]Plugin, error) {
+	plugins := make([]Plugin, 0, len(configs))
+	for i, config := range configs {
+		plugin, err := NewPluginFromConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %d (%s): %w", i, config.Type, err)
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+// decodeSettings decodes the plugin's settings or file into value; without
+// either, value keeps its defaults.
+func (config PluginConfig) decodeSettings(value interface{}) error {
+	settings := []byte(config.Settings)
+	if config.File != "" {
+		if len(settings) > 0 {
+			return errors.New("settings and file are mutually exclusive")
+		}
+		data, err := readConfigFile(config.File)
+		if err != nil {
+			return err
+		}
+		settings = data
+	}
+	if len(settings) == 0 || string(settings) == "null" {
+		return nil
+	}
+	return decodeStrict(settings, value)
+}
+
+// route reads the settings of a route.
+func (config PluginConfig) route() (routeSettings, error) {
+	var options routeSettings
+	if err := config.decodeSettings(&options); err != nil {
+		return routeSettings{}, err
+	}
+	if len(options.Plugins) == 0 {
+		return routeSettings{}, errors.New("route has no plugins")
+	}
+	return options, nil
+}
+
+// NewPluginFromConfig builds and validates a single plugin.
+func NewPluginFromConfig(config PluginConfig) (Plugin, error) {
+	decode := config.decodeSettings
+
+	var plugin Plugin
+	var base *BasePlugin
+	switch config.Type {
+	case "replay":
+		replay := NewReplayPlugin()
+		if err := decode(replay); err != nil {
+			return nil, err
+		}
+		if err := replay.validate(); err != nil {
+			return nil, err
+		}
+		plugin, base = replay, &replay.BasePlugin
+	case "record":
+		record := NewRecordPlugin()
+		if err := decode(record); err != nil {
+			return nil, err
+		}
+		if err := record.validate(); err != nil {
+			return nil, err
+		}
+		plugin, base = record, &record.BasePlugin
+	case "decoder":
+		decoder := NewDecoder()
+		if err := decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+		plugin, base = decoder, &decoder.BasePlugin
+	case "dumper":
+		var options dumperSettings
+		if err := decode(&options); err != nil {
+			return nil, err
+		}
+		if options.Level != 0 && options.Level != 1 {
+			return nil, fmt.Errorf("invalid dumper level %d", options.Level)
+		}
+		dumper := NewDumper(os.Stdout, options.Level)
+		if options.Output != "" {
+			var err error
+			if dumper, err = NewDumperWithFilename(options.Output, options.Level); err != nil {
+				return nil, err
+			}
+		}
+		plugin, base = dumper, &dumper.BasePlugin
+	case "map-local":
+		mapLocal := &MapLocal{BasePlugin: BasePlugin{PluginName: "map-local"}, Enable: true}
+		if err := decode(mapLocal); err != nil {
+			return nil, err
+		}
+		if err := mapLocal.validate(); err != nil {
+			return nil, err
+		}
+		plugin, base = mapLocal, &mapLocal.BasePlugin
+	case "map-remote":
+		mapRemote := &MapRemote{BasePlugin: BasePlugin{PluginName: "map-remote"}, Enable: true}
+		if err := decode(mapRemote); err != nil {
+			return nil, err
+		}
+		if err := mapRemote.validate(); err != nil {
+			return nil, err
+		}
+		plugin, base = mapRemote, &mapRemote.BasePlugin
+	case "header-rewrite":
+		headerRewrite := &HeaderRewrite{BasePlugin: BasePlugin{PluginName: "header-rewrite"}, Enable: true}
+		if err := decode(headerRewrite); err != nil {
+			return nil, err
+		}
+		if err := headerRewrite.validate(); err != nil {
+			return nil, err
+		}
+		plugin, base = headerRewrite, &headerRewrite.BasePlugin
+	case "route":
+		options, err := config.route()
+		if err != nil {
+			return nil, err
+		}
+		plugins, err := NewPluginsFromConfig(options.Plugins)
+		if err != nil {
+			return nil, err
+		}
+		route := NewRoute(options.Match, plugins...)
+		plugin, base = route, &route.BasePlugin
+	default:
+		return nil, fmt.Errorf("unknown plugin type %q", config.Type)
+	}
+	if config.Name != "" {
+		base.PluginName = config.Name
+	}
+	return plugin, nil
+}
+
+// RuleFiles lists the files configs read settings from, including those of
+// the plugins of routes, so they can be watched for changes.
+func RuleFiles(configs []PluginConfig) []string {
+	var files []string
+	for _, config := range configs {
+		if config.File != "" {
+			files = append(files, config.File)
+		}
+		if config.Type != "route" {
+			continue
+		}
+		if options, err := config.route(); err == nil {
+			files = append(files, RuleFiles(options.Plugins)...)
+		}
+	}
+	return files
+}
@@ -0,0 +1,72 @@
+package replay
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPluginsFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "record.yaml")
+	if err := os.WriteFile(rules, []byte("overwrite: true\nignore_status_codes: [429, 503]\n"), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	dump := filepath.Join(dir, "dump.log")
+
+	var configs []PluginConfig
+	raw := `[
+		{"type": "map-local", "settings": {"items": [{"enable": true, "from": {"path": "/local/*"}, "to": {"path": "` + filepath.ToSlash(dir) + `"}}]}},
+		{"type": "replay", "name": "cache", "settings": {"log_not_found": true}},
+		{"type": "decoder"},
+		{"type": "dumper", "settings": {"output": "` + filepath.ToSlash(dump) + `", "level": 1}},
+		{"type": "record", "file": "` + filepath.ToSlash(rules) + `"}
+	]`
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	plugins, err := NewPluginsFromConfig(configs)
+	if err != nil {
+		t.Fatalf("NewPluginsFromConfig: %v", err)
+	}
+
+	var names []string
+	for _, plugin := range plugins {
+		names = append(names, plugin.Name())
+	}
+	if got := strings.Join(names, ","); got != "map-local,cache,decoder,dumper,record" {
+		t.Fatalf("unexpected chain %s", got)
+	}
+	if mapLocal := plugins[0].(*MapLocal); !mapLocal.Enable {
+		t.Fatalf("configured plugins should default to enabled")
+	}
+	if replay := plugins[1].(*ReplayPlugin); !replay.Enable || !replay.LogNotFound {
+		t.Fatalf("unexpected replay plugin: %#v", replay)
+	}
+	record := plugins[4].(*RecordPlugin)
+	if !record.Enable || !record.Overwrite || len(record.IgnoreStatusCodes) != 2 {
+		t.Fatalf("unexpected record plugin: %#v", record)
+	}
+	if _, err := os.Stat(dump); err != nil {
+		t.Fatalf("expected the dump file to be created: %v", err)
+	}
+}
+
+func TestNewPluginFromConfigErrors(t *testing.T) {
+	cases := map[string]PluginConfig{
+		"unknown type":      {Type: "compress"},
+		"unknown setting":   {Type: "record", Settings: json.RawMessage(`{"overwrit": true}`)},
+		"invalid settings":  {Type: "replay", Settings: json.RawMessage(`{"sequence_exhausted": "never"}`)},
+		"invalid item":      {Type: "map-remote", Settings: json.RawMessage(`{"items": [{"enable": true}]}`)},
+		"invalid level":     {Type: "dumper", Settings: json.RawMessage(`{"level": 3}`)},
+		"invalid header op": {Type: "header-rewrite", Settings: json.RawMessage(`{"rules": [{"response": [{"op": "drop", "name": "Set-Cookie"}]}]}`)},
+		"settings and file": {Type: "record", Settings: json.RawMessage(`{}`), File: "record.json"},
+	}
+	for name, config := range cases {
+		if _, err := NewPluginFromConfig(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
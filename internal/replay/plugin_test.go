@@ -2,6 +2,7 @@ package replay
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -103,3 +104,73 @@ func TestApplyResponsePlugins(t *testing.T) {
 		t.Fatalf("unexpected headers: %#v", stored.Headers)
 	}
 }
+
+type lifecyclePlugin struct {
+	BasePlugin
+	steps   *[]string
+	initErr error
+}
+
+func (p *lifecyclePlugin) Init() error {
+	*p.steps = append(*p.steps, "init "+p.Name())
+	return p.initErr
+}
+
+func (p *lifecyclePlugin) Close() error {
+	*p.steps = append(*p.steps, "close "+p.Name())
+	return nil
+}
+
+func TestPluginLifecycleOrder(t *testing.T) {
+	var steps []string
+	plugins := []Plugin{
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "first"}, steps: &steps},
+		testPlugin{name: "stateless"},
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "second"}, steps: &steps},
+	}
+	if err := InitPlugins(plugins); err != nil {
+		t.Fatalf("InitPlugins: %v", err)
+	}
+	if err := ClosePlugins(plugins); err != nil {
+		t.Fatalf("ClosePlugins: %v", err)
+	}
+	if got := strings.Join(steps, ","); got != "init first,init second,close second,close first" {
+		t.Fatalf("unexpected steps: %s", got)
+	}
+}
+
+func TestInitPluginsClosesOnFailure(t *testing.T) {
+	var steps []string
+	plugins := []Plugin{
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "first"}, steps: &steps},
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "broken"}, steps: &steps, initErr: errors.New("no key")},
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "last"}, steps: &steps},
+	}
+	err := InitPlugins(plugins)
+	if err == nil || !strings.Contains(err.Error(), "plugin broken: no key") {
+		t.Fatalf("expected the init error, got %v", err)
+	}
+	if got := strings.Join(steps, ","); got != "init first,init broken,close first" {
+		t.Fatalf("unexpected steps: %s", got)
+	}
+}
+
+func TestReplayRouterRunsPluginLifecycle(t *testing.T) {
+	var steps []string
+	plugins := []Plugin{&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "dump"}, steps: &steps}}
+	_, closePlugins, err := NewReplayRouter(newMemoryRepo(), ServerOptions{Plugins: plugins})
+	if err != nil {
+		t.Fatalf("NewReplayRouter: %v", err)
+	}
+	if err := closePlugins(); err != nil {
+		t.Fatalf("close plugins: %v", err)
+	}
+	if got := strings.Join(steps, ","); got != "init dump,close dump" {
+		t.Fatalf("unexpected steps: %s", got)
+	}
+
+	broken := []Plugin{&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "broken"}, steps: &steps, initErr: errors.New("no key")}}
+	if _, _, err := NewReplayRouter(newMemoryRepo(), ServerOptions{Plugins: broken}); err == nil {
+		t.Fatal("expected the router to report the init error")
+	}
+}
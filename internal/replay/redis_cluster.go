@@ -0,0 +1,317 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	redisSlotCount = 16384
+	// maxClusterRedirects bounds MOVED/ASK hops for one command.
+	maxClusterRedirects = 5
+)
+
+// redisRedirect is a parsed MOVED or ASK error reply.
+type redisRedirect struct {
+	ask  bool
+	slot int
+	addr string
+}
+
+// parseRedisRedirect recognizes "MOVED <slot> <host:port>" and
+// "ASK <slot> <host:port>" error payloads.
+func parseRedisRedirect(text string) *redisRedirect {
+	fields := strings.Fields(text)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return nil
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= redisSlotCount {
+		return nil
+	}
+	return &redisRedirect{ask: fields[0] == "ASK", slot: slot, addr: fields[2]}
+}
+
+// redisSlot maps a key to its cluster hash slot. Only the first non-empty
+// {hash tag} is hashed, so related keys can share a slot.
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisSlotCount
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis Cluster uses for key slots.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// redisCluster routes commands to the node owning each key's slot. The slot
+// map is loaded with CLUSTER SLOTS and corrected by MOVED redirects; ASK
+// redirects are followed once with ASKING without updating the map.
+type redisCluster struct {
+	options RedisOptions
+	seeds   []string
+
+	mu     sync.RWMutex
+	slots  [redisSlotCount]string
+	loaded bool
+	pools  map[string]*redisPool
+}
+
+func newRedisCluster(options RedisOptions) *redisCluster {
+	// Cluster nodes only have database 0.
+	options.DB = 0
+	return &redisCluster{
+		options: options,
+		seeds:   options.ClusterAddrs,
+		pools:   make(map[string]*redisPool),
+	}
+}
+
+// do sends cmds, which must all address the slot of cmds[0][1], to its node.
+func (c *redisCluster) do(ctx context.Context, cmds [][]string) ([]redisReply, error) {
+	slot := 0
+	if len(cmds[0]) > 1 {
+		slot = redisSlot(cmds[0][1])
+	}
+	addr, err := c.addrForSlot(ctx, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	asking := false
+	for hop := 0; hop <= maxClusterRedirects; hop++ {
+		send := cmds
+		if asking {
+			send = append([][]string{{"ASKING"}}, cmds...)
+		}
+		replies, err := c.roundTrip(ctx, addr, send)
+		if err != nil {
+			// The node may have failed over; reload the slots next time.
+			c.invalidate()
+			return nil, err
+		}
+		if asking {
+			replies = replies[1:]
+		}
+
+		redirect := firstRedirect(replies)
+		if redirect == nil {
+			return replies, nil
+		}
+		addr = redirect.addr
+		asking = redirect.ask
+		if !redirect.ask {
+			c.setSlot(redirect.slot, redirect.addr)
+		}
+	}
+	return nil, fmt.Errorf("redis cluster: too many redirects for slot %d", slot)
+}
+
+func (c *redisCluster) roundTrip(ctx context.Context, addr string, cmds [][]string) ([]redisReply, error) {
+	pool := c.pool(addr)
+	conn, err := pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.roundTrip(ctx, cmds)
+	pool.put(conn)
+	return replies, err
+}
+
+func firstRedirect(replies []redisReply) *redisRedirect {
+	for _, reply := range replies {
+		if reply.redirect != nil {
+			return reply.redirect
+		}
+	}
+	return nil
+}
+
+func (c *redisCluster) pool(addr string) *redisPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool, ok := c.pools[addr]
+	if !ok {
+		options := c.options
+		options.Addr = addr
+		pool = newRedisPool(options)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+func (c *redisCluster) addrForSlot(ctx context.Context, slot int) (string, error) {
+	if err := c.ensureSlots(ctx); err != nil {
+		return "", err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if addr := c.slots[slot]; addr != "" {
+		return addr, nil
+	}
+	return c.seeds[0], nil
+}
+
+func (c *redisCluster) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = false
+}
+
+func (c *redisCluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// ensureSlots loads the slot map from the first seed that answers CLUSTER
+// SLOTS. Until then every command goes to the first seed and MOVED replies
+// fill the map in.
+func (c *redisCluster) ensureSlots(ctx context.Context) error {
+	if len(c.seeds) == 0 {
+		return errors.New("redis cluster: no seed addresses")
+	}
+	c.mu.RLock()
+	loaded := c.loaded
+	c.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	for _, seed := range c.seeds {
+		replies, err := c.roundTrip(ctx, seed, [][]string{{"CLUSTER", "SLOTS"}})
+		if err != nil || replies[0].kind != replyArray {
+			continue
+		}
+		c.mu.Lock()
+		c.slots = [redisSlotCount]string{}
+		for _, item := range replies[0].items {
+			c.applySlotRange(item)
+		}
+		c.loaded = true
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Lock()
+	c.loaded = true
+	c.mu.Unlock()
+	return nil
+}
+
+// applySlotRange records one CLUSTER SLOTS entry: start, end, then the
+// primary as [host, port, ...].
+func (c *redisCluster) applySlotRange(item redisReply) {
+	if item.kind != replyArray || len(item.items) < 3 {
+		return
+	}
+	start, err1 := strconv.Atoi(item.items[0].text)
+	end, err2 := strconv.Atoi(item.items[1].text)
+	primary := item.items[2]
+	if err1 != nil || err2 != nil || primary.kind != replyArray || len(primary.items) < 2 {
+		return
+	}
+	addr := net.JoinHostPort(string(primary.items[0].data), primary.items[1].text)
+	for slot := start; slot <= end && slot < redisSlotCount; slot++ {
+		if slot >= 0 {
+			c.slots[slot] = addr
+		}
+	}
+}
+
+// nodes returns the known primaries in a stable order, for SCAN.
+func (c *redisCluster) nodes(ctx context.Context) ([]string, error) {
+	if err := c.ensureSlots(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]bool)
+	for _, addr := range c.slots {
+		if addr != "" {
+			seen[addr] = true
+		}
+	}
+	if len(seen) == 0 {
+		return c.seeds[:1], nil
+	}
+	nodes := make([]string, 0, len(seen))
+	for addr := range seen {
+		nodes = append(nodes, addr)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// scan runs one SCAN step across the cluster. The cursor is
+// "<node index>:<node cursor>"; "0" starts at the first node and is
+// returned after the last one.
+func (c *redisCluster) scan(ctx context.Context, cursor string, args []string) (string, redisReply, error) {
+	nodes, err := c.nodes(ctx)
+	if err != nil {
+		return "", redisReply{}, err
+	}
+	index, nodeCursor := 0, "0"
+	if cursor != "0" {
+		rawIndex, rest, ok := strings.Cut(cursor, ":")
+		index, err = strconv.Atoi(rawIndex)
+		if !ok || err != nil || index < 0 || index >= len(nodes) {
+			return "", redisReply{}, fmt.Errorf("redis cluster: invalid scan cursor %q", cursor)
+		}
+		nodeCursor = rest
+	}
+
+	cmd := append([]string{"SCAN", nodeCursor}, args...)
+	replies, err := c.roundTrip(ctx, nodes[index], [][]string{cmd})
+	if err != nil {
+		return "", redisReply{}, err
+	}
+	reply := replies[0]
+	if reply.kind == replyError {
+		return "", redisReply{}, redisReplyError(reply)
+	}
+	if reply.kind != replyArray || len(reply.items) != 2 {
+		return "", redisReply{}, unexpectedRedisReply(reply)
+	}
+
+	next := string(reply.items[0].data)
+	switch {
+	case next != "0":
+		next = strconv.Itoa(index) + ":" + next
+	case index+1 < len(nodes):
+		next = strconv.Itoa(index+1) + ":0"
+	}
+	return next, reply.items[1], nil
+}
+
+func (c *redisCluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, pool := range c.pools {
+		if closeErr := pool.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisSlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31C3 {
+		t.Fatalf("crc16 = %#x, want 0x31c3", got)
+	}
+	cases := map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": redisSlot("user1000"),
+		"foo{}{bar}":           int(crc16("foo{}{bar}")) % redisSlotCount,
+		"foo{{bar}}":           redisSlot("{bar"),
+	}
+	for key, want := range cases {
+		if got := redisSlot(key); got != want {
+			t.Fatalf("redisSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestParseRedisRedirect(t *testing.T) {
+	got := parseRedisRedirect("ASK 3999 127.0.0.1:6381")
+	want := &redisRedirect{ask: true, slot: 3999, addr: "127.0.0.1:6381"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v want %#v", got, want)
+	}
+	for _, text := range []string{"ERR unknown", "MOVED x 127.0.0.1:1", "MOVED 16384 127.0.0.1:1"} {
+		if redirect := parseRedisRedirect(text); redirect != nil {
+			t.Fatalf("%q parsed as redirect %#v", text, redirect)
+		}
+	}
+}
+
+// clusterSlotsReply assigns every slot to addr.
+func clusterSlotsReply(t *testing.T, addr string) string {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("split %s: %v", addr, err)
+	}
+	return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", redisSlotCount-1, len(host), host, port)
+}
+
+func TestRedisClusterRedirects(t *testing.T) {
+	first := startRESPStub(t)
+	second := startRESPStub(t)
+	second.data["asked"] = `{"status_code":201,"headers":[],"body_base64":""}`
+
+	first.mu.Lock()
+	first.clusterSlots = clusterSlotsReply(t, first.addr())
+	first.redirect = func(args []string) string {
+		if len(args) < 2 {
+			return ""
+		}
+		switch args[1] {
+		case "moved":
+			return fmt.Sprintf("MOVED %d %s", redisSlot("moved"), second.addr())
+		case "asked":
+			return fmt.Sprintf("ASK %d %s", redisSlot("asked"), second.addr())
+		}
+		return ""
+	}
+	first.mu.Unlock()
+
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		ClusterAddrs: []string{first.addr()},
+		DB:           3,
+		Timeout:      time.Second,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	for _, key := range []string{"home", "moved"} {
+		if err := repo.Set(ctx, key, StoredResponse{StatusCode: 200}, true); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+	if _, ok := second.data["moved"]; !ok {
+		t.Fatalf("MOVED was not followed: %v", second.data)
+	}
+	if _, ok := first.data["home"]; !ok {
+		t.Fatalf("home stored on the wrong node: %v", first.data)
+	}
+
+	// MOVED updates the slot map, so the next command goes straight to
+	// the owner.
+	firstGets := first.seen("GET")
+	if _, found, err := repo.Get(ctx, "moved"); err != nil || !found {
+		t.Fatalf("Get moved: %v %v", found, err)
+	}
+	if first.seen("GET") != firstGets {
+		t.Fatalf("Get moved was not routed to the new owner")
+	}
+
+	// ASK is followed once with ASKING and leaves the slot map alone.
+	for i := 1; i <= 2; i++ {
+		stored, found, err := repo.Get(ctx, "asked")
+		if err != nil || !found || stored.StatusCode != 201 {
+			t.Fatalf("Get asked: %#v %v %v", stored, found, err)
+		}
+		if got := second.seen("ASKING"); got != i {
+			t.Fatalf("ASKING sent %d times, want %d", got, i)
+		}
+	}
+	if first.seen("SELECT") != 0 || second.seen("SELECT") != 0 {
+		t.Fatalf("SELECT sent in cluster mode")
+	}
+
+	keys, err := repo.List(ctx, ScanOptions{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"asked", "home", "moved"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("List across nodes = %v, want %v", keys, want)
+	}
+	page, err := repo.Scan(ctx, ScanOptions{})
+	if err != nil || page.Cursor == "" {
+		t.Fatalf("first Scan page should continue to the next node: %#v %v", page, err)
+	}
+
+	deleted, err := repo.Delete(ctx, "home", "moved", "missing")
+	if err != nil || deleted != 2 {
+		t.Fatalf("Delete = %d %v, want 2", deleted, err)
+	}
+}
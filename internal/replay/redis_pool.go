@@ -0,0 +1,460 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisPoolSize = 10
+	// maxPipelineBatch bounds the commands written in one pipelined batch.
+	maxPipelineBatch = 128
+)
+
+var errRedisClosed = errors.New("redis: client is closed")
+
+// redisConn is one connection with its reply reader. After a transport error
+// reset closes it and the pool discards it instead of reusing it.
+type redisConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	lastUsed   time.Time
+	generation int
+}
+
+// roundTrip writes every command, then reads one reply per command.
+func (c *redisConn) roundTrip(ctx context.Context, cmds [][]string) ([]redisReply, error) {
+	if err := c.writeCommands(ctx, cmds); err != nil {
+		c.reset()
+		return nil, err
+	}
+	replies := make([]redisReply, 0, len(cmds))
+	for range cmds {
+		reply, err := c.readReply(ctx)
+		if err != nil {
+			c.reset()
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	c.lastUsed = time.Now()
+	return replies, nil
+}
+
+// simpleCommand runs a handshake command that must answer +OK or similar.
+func (c *redisConn) simpleCommand(ctx context.Context, args ...string) error {
+	replies, err := c.roundTrip(ctx, [][]string{args})
+	if err != nil {
+		return err
+	}
+	reply := replies[0]
+	if reply.kind == replyError {
+		return redisReplyError(reply)
+	}
+	if reply.kind != replySimple {
+		return unexpectedRedisReply(reply)
+	}
+	return nil
+}
+
+func (c *redisConn) reset() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.conn = nil
+	c.reader = nil
+}
+
+func (c *redisConn) writeCommands(ctx context.Context, cmds [][]string) error {
+	if c.conn == nil {
+		return errors.New("redis connection is not established")
+	}
+	_ = c.conn.SetDeadline(c.deadline(ctx))
+	var payload []byte
+	for _, args := range cmds {
+		payload = append(payload, buildRESPCommand(args...)...)
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+func (c *redisConn) readReply(ctx context.Context) (redisReply, error) {
+	if c.reader == nil {
+		return redisReply{kind: replyUnknown}, errors.New("redis reader is not initialized")
+	}
+	_ = c.conn.SetDeadline(c.deadline(ctx))
+	return readRESPReply(c.reader)
+}
+
+func (c *redisConn) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// redisPool bounds the open connections to PoolSize. Idle connections older
+// than IdleTimeout are closed; idle connections unused for longer than
+// HealthCheckInterval are PINGed before reuse. resolve, when set, picks the
+// address for every new connection, such as the primary named by Sentinel.
+type redisPool struct {
+	options RedisOptions
+	slots   chan struct{}
+	resolve func(ctx context.Context) (string, error)
+
+	mu         sync.Mutex
+	idle       []*redisConn
+	generation int
+	closed     bool
+	done       chan struct{}
+}
+
+func newRedisPool(options RedisOptions) *redisPool {
+	size := options.PoolSize
+	if size <= 0 {
+		size = defaultRedisPoolSize
+	}
+	pool := &redisPool{
+		options: options,
+		slots:   make(chan struct{}, size),
+		done:    make(chan struct{}),
+	}
+	if options.IdleTimeout > 0 {
+		go pool.reap(options.IdleTimeout)
+	}
+	return pool
+}
+
+// get returns an idle or new connection, waiting for a free slot.
+func (p *redisPool) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, errRedisClosed
+	}
+
+	for {
+		conn := p.popIdle()
+		if conn == nil {
+			break
+		}
+		if p.healthy(ctx, conn) {
+			return conn, nil
+		}
+		conn.reset()
+	}
+
+	conn, err := p.connect(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put returns conn to the pool; connections reset after an error are dropped.
+func (p *redisPool) put(conn *redisConn) {
+	defer func() { <-p.slots }()
+	if conn.conn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || conn.generation != p.generation {
+		conn.reset()
+		return
+	}
+	p.idle = append(p.idle, conn)
+}
+
+// discard closes the idle connections; connections in use are closed when
+// they are put back. New connections resolve the address again.
+func (p *redisPool) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generation++
+	for _, conn := range p.idle {
+		conn.reset()
+	}
+	p.idle = nil
+}
+
+func (p *redisPool) popIdle() *redisConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return conn
+}
+
+func (p *redisPool) healthy(ctx context.Context, conn *redisConn) bool {
+	idleFor := time.Since(conn.lastUsed)
+	if p.options.IdleTimeout > 0 && idleFor > p.options.IdleTimeout {
+		return false
+	}
+	if p.options.HealthCheckInterval > 0 && idleFor > p.options.HealthCheckInterval {
+		replies, err := conn.roundTrip(ctx, [][]string{{"PING"}})
+		return err == nil && replies[0].kind == replySimple
+	}
+	return true
+}
+
+// connect dials, optionally over TLS, and runs the AUTH/SELECT handshake.
+func (p *redisPool) connect(ctx context.Context) (*redisConn, error) {
+	p.mu.Lock()
+	generation := p.generation
+	p.mu.Unlock()
+	netConn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		conn:       netConn,
+		reader:     bufio.NewReader(netConn),
+		timeout:    p.options.Timeout,
+		lastUsed:   time.Now(),
+		generation: generation,
+	}
+
+	if auth := p.authCommand(); auth != nil {
+		if err := conn.simpleCommand(ctx, auth...); err != nil {
+			conn.reset()
+			return nil, err
+		}
+	}
+	if p.options.DB != 0 {
+		if err := conn.simpleCommand(ctx, "SELECT", strconv.Itoa(p.options.DB)); err != nil {
+			conn.reset()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *redisPool) dial(ctx context.Context) (net.Conn, error) {
+	addr := p.options.Addr
+	if p.resolve != nil {
+		var err error
+		if addr, err = p.resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	dialer := &net.Dialer{Timeout: p.options.Timeout}
+	if p.options.TLSConfig == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	config := p.options.TLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+	return tlsDialer.DialContext(ctx, "tcp", addr)
+}
+
+// authCommand returns AUTH user password for ACL users, the legacy
+// AUTH password otherwise, or nil without credentials.
+func (p *redisPool) authCommand() []string {
+	if p.options.Username != "" {
+		return []string{"AUTH", p.options.Username, p.options.Password}
+	}
+	if p.options.Password != "" {
+		return []string{"AUTH", p.options.Password}
+	}
+	return nil
+}
+
+// reap periodically closes idle connections past the idle timeout.
+func (p *redisPool) reap(idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		kept := p.idle[:0]
+		for _, conn := range p.idle {
+			if time.Since(conn.lastUsed) > idleTimeout {
+				conn.reset()
+				continue
+			}
+			kept = append(kept, conn)
+		}
+		p.idle = kept
+		p.mu.Unlock()
+	}
+}
+
+func (p *redisPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	var err error
+	for _, conn := range p.idle {
+		if closeErr := conn.conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	p.idle = nil
+	return err
+}
+
+// redisPipeline batches commands from concurrent callers. Each of its
+// workers drains the queued requests, writes them on one pooled connection
+// and reads the replies back in order, saving a round trip per command.
+type redisPipeline struct {
+	pool     *redisPool
+	requests chan *pipelineRequest
+}
+
+type pipelineRequest struct {
+	ctx     context.Context
+	cmds    [][]string
+	replies []redisReply
+	err     error
+	done    chan struct{}
+}
+
+func newRedisPipeline(pool *redisPool, workers int) *redisPipeline {
+	pipeline := &redisPipeline{pool: pool, requests: make(chan *pipelineRequest)}
+	for i := 0; i < workers; i++ {
+		go pipeline.work()
+	}
+	return pipeline
+}
+
+func (p *redisPipeline) do(ctx context.Context, cmds [][]string) ([]redisReply, error) {
+	req := &pipelineRequest{ctx: ctx, cmds: cmds, done: make(chan struct{})}
+	select {
+	case p.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.pool.done:
+		return nil, errRedisClosed
+	}
+	select {
+	case <-req.done:
+		return req.replies, req.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *redisPipeline) work() {
+	for {
+		var first *pipelineRequest
+		select {
+		case first = <-p.requests:
+		case <-p.pool.done:
+			return
+		}
+
+		batch := []*pipelineRequest{first}
+		queued := len(first.cmds)
+	drain:
+		for queued < maxPipelineBatch {
+			select {
+			case req := <-p.requests:
+				batch = append(batch, req)
+				queued += len(req.cmds)
+			default:
+				break drain
+			}
+		}
+		p.flush(batch)
+	}
+}
+
+func (p *redisPipeline) flush(batch []*pipelineRequest) {
+	live := batch[:0]
+	cmds := make([][]string, 0, len(batch))
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.err = err
+			close(req.done)
+			continue
+		}
+		live = append(live, req)
+		cmds = append(cmds, req.cmds...)
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	ctx, cancel := batchContext(live)
+	defer cancel()
+	conn, err := p.pool.get(ctx)
+	var replies []redisReply
+	if err == nil {
+		replies, err = conn.roundTrip(ctx, cmds)
+		p.pool.put(conn)
+	}
+	for _, req := range live {
+		if err != nil {
+			req.err = err
+		} else {
+			req.replies = replies[:len(req.cmds)]
+			replies = replies[len(req.cmds):]
+		}
+		close(req.done)
+	}
+}
+
+// batchContext ends once every request of batch has given up, so a flush
+// stops waiting for a pool slot nobody needs any more. When every request
+// has a deadline, the latest one bounds the round trip.
+func batchContext(batch []*pipelineRequest) (context.Context, context.CancelFunc) {
+	var latest time.Time
+	for _, req := range batch {
+		deadline, ok := req.ctx.Deadline()
+		if !ok {
+			latest = time.Time{}
+			break
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !latest.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, latest)
+		cancelAll := cancel
+		cancel = func() {
+			cancelDeadline()
+			cancelAll()
+		}
+	}
+	go func() {
+		for _, req := range batch {
+			select {
+			case <-req.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
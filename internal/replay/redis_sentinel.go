@@ -0,0 +1,99 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// redisSentinel asks Redis Sentinel for the current primary. The sentinel
+// that answered last is tried first next time.
+type redisSentinel struct {
+	master   string
+	password string
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newRedisSentinel(options RedisOptions) *redisSentinel {
+	return &redisSentinel{
+		master:   options.SentinelMaster,
+		password: options.SentinelPassword,
+		timeout:  options.Timeout,
+		addrs:    append([]string(nil), options.SentinelAddrs...),
+	}
+}
+
+// primary returns the address of the primary, trying each sentinel in turn.
+func (s *redisSentinel) primary(ctx context.Context) (string, error) {
+	if s.master == "" {
+		return "", errors.New("redis sentinel: no master name")
+	}
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		primary, err := s.query(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.promote(addr)
+		return primary, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no sentinel addresses")
+	}
+	return "", fmt.Errorf("redis sentinel: %w", lastErr)
+}
+
+func (s *redisSentinel) query(ctx context.Context, addr string) (string, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn), timeout: s.timeout}
+	defer conn.reset()
+
+	if s.password != "" {
+		if err := conn.simpleCommand(ctx, "AUTH", s.password); err != nil {
+			return "", err
+		}
+	}
+	replies, err := conn.roundTrip(ctx, [][]string{{"SENTINEL", "get-master-addr-by-name", s.master}})
+	if err != nil {
+		return "", err
+	}
+	reply := replies[0]
+	switch {
+	case reply.kind == replyError:
+		return "", redisReplyError(reply)
+	case reply.kind == replyNil:
+		return "", fmt.Errorf("%s does not know master %q", addr, s.master)
+	case reply.kind != replyArray || len(reply.items) != 2:
+		return "", unexpectedRedisReply(reply)
+	}
+	return net.JoinHostPort(string(reply.items[0].data), string(reply.items[1].data)), nil
+}
+
+// promote moves addr to the front of the sentinel list.
+func (s *redisSentinel) promote(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, candidate := range s.addrs {
+		if candidate == addr {
+			copy(s.addrs[1:i+1], s.addrs[:i])
+			s.addrs[0] = addr
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisSentinelFailover(t *testing.T) {
+	oldPrimary := startRESPStub(t)
+	newPrimary := startRESPStub(t)
+	sentinel := startRESPStub(t)
+	sentinel.masters = map[string]string{"mymaster": oldPrimary.addr()}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadSentinel := listener.Addr().String()
+	_ = listener.Close()
+
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		SentinelAddrs:    []string{deadSentinel, sentinel.addr()},
+		SentinelMaster:   "mymaster",
+		SentinelPassword: "watch",
+		Password:         "secret",
+		Timeout:          time.Second,
+		PoolSize:         2,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.Set(ctx, "before", StoredResponse{StatusCode: 200}, true); err != nil {
+		t.Fatalf("Set before failover: %v", err)
+	}
+	if _, ok := oldPrimary.data["before"]; !ok {
+		t.Fatalf("primary was not discovered through the sentinel")
+	}
+	if got := repo.client.sentinel.addrs; got[0] != sentinel.addr() {
+		t.Fatalf("working sentinel was not tried first: %v", got)
+	}
+	if want := [][]string{{"watch"}}; !reflect.DeepEqual(sentinel.auth, want) {
+		t.Fatalf("sentinel AUTH = %v, want %v", sentinel.auth, want)
+	}
+
+	// Fail over: the old primary turns into a replica and the sentinel
+	// names the new one.
+	sentinel.mu.Lock()
+	sentinel.masters["mymaster"] = newPrimary.addr()
+	sentinel.mu.Unlock()
+	oldPrimary.mu.Lock()
+	oldPrimary.readOnly = true
+	oldPrimary.mu.Unlock()
+
+	if err := repo.Set(ctx, "after", StoredResponse{StatusCode: 200}, true); err != nil {
+		t.Fatalf("Set after failover: %v", err)
+	}
+	if _, ok := newPrimary.data["after"]; !ok {
+		t.Fatalf("write did not follow the failover")
+	}
+	if _, ok := oldPrimary.data["after"]; ok {
+		t.Fatalf("write landed on the demoted primary")
+	}
+	if want := [][]string{{"secret"}}; !reflect.DeepEqual(newPrimary.auth, want) {
+		t.Fatalf("new primary AUTH = %v, want %v", newPrimary.auth, want)
+	}
+}
+
+func TestRedisSentinelUnknownMaster(t *testing.T) {
+	sentinel := startRESPStub(t)
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		SentinelAddrs:  []string{sentinel.addr()},
+		SentinelMaster: "missing",
+		Timeout:        time.Second,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	if _, _, err := repo.Get(context.Background(), "key"); err == nil {
+		t.Fatalf("expected an error for an unknown master")
+	}
+}
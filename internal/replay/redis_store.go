@@ -4,25 +4,74 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 var errRedisNil = errors.New("redis: nil")
 
+// redisSequenceSuffix marks the list holding the response sequence of a key.
+const redisSequenceSuffix = "#sequence"
+
+// redisDeleteBatch bounds the keys sent in one UNLINK.
+const redisDeleteBatch = 1000
+
+// RedisOptions configures a RedisRepository. Zero durations disable the
+// idle timeout and health checks; a zero PoolSize uses 10 connections.
+type RedisOptions struct {
+	Addr string
+	// Username selects a Redis 6 ACL user; AUTH then sends user and password.
+	Username string
+	Password string
+	DB       int
+	// TLSConfig enables TLS; an empty ServerName defaults to the Addr host.
+	TLSConfig *tls.Config
+	// Timeout bounds each command round trip and the dial.
+	Timeout time.Duration
+
+	PoolSize int
+	// IdleTimeout closes connections left idle for longer.
+	IdleTimeout time.Duration
+	// HealthCheckInterval PINGs idle connections unused for longer before
+	// handing them out again.
+	HealthCheckInterval time.Duration
+	// Pipeline batches commands from concurrent callers onto shared
+	// connections instead of one command per connection round trip.
+	Pipeline bool
+
+	// SentinelAddrs discovers the primary of SentinelMaster through Redis
+	// Sentinel instead of dialing Addr, and follows failovers.
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+	// ClusterAddrs seeds Redis Cluster mode: commands are routed by key
+	// slot and MOVED/ASK redirects are followed. It takes precedence over
+	// Addr and SentinelAddrs; DB and Pipeline are ignored in cluster mode.
+	ClusterAddrs []string
+}
+
 type RedisRepository struct {
 	client *redisClient
 }
 
 func NewRedisRepository(addr, password string, db int, timeout time.Duration) *RedisRepository {
+	return NewRedisRepositoryWithOptions(RedisOptions{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+		Timeout:  timeout,
+	})
+}
+
+func NewRedisRepositoryWithOptions(options RedisOptions) *RedisRepository {
 	return &RedisRepository{
-		client: newRedisClient(addr, password, db, timeout),
+		client: newRedisClient(options),
 	}
 }
 
@@ -42,181 +91,367 @@ func (r *RedisRepository) Get(ctx context.Context, key string) (StoredResponse,
 }
 
 func (r *RedisRepository) Set(ctx context.Context, key string, value StoredResponse, overwrite bool) error {
+	return r.SetWithTTL(ctx, key, value, overwrite, 0)
+}
+
+// SetWithTTL leaves expiry to Redis with SET ... PX.
+func (r *RedisRepository) SetWithTTL(ctx context.Context, key string, value StoredResponse, overwrite bool, ttl time.Duration) error {
 	payload, err := encodeStoredResponse(value)
 	if err != nil {
 		return err
 	}
-	return r.client.Set(ctx, key, payload, overwrite)
+	return r.client.Set(ctx, key, payload, overwrite, ttl)
 }
 
-func (r *RedisRepository) Close() error {
-	return r.client.Close()
+func (r *RedisRepository) Scan(ctx context.Context, options ScanOptions) (ScanPage, error) {
+	cursor := options.Cursor
+	if cursor == "" {
+		cursor = "0"
+	}
+	next, keys, err := r.client.Scan(ctx, cursor, redisScanPattern(options), options.limit())
+	if err != nil {
+		return ScanPage{}, err
+	}
+	page := ScanPage{Keys: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, redisSequenceSuffix) && options.matches(key) {
+			page.Keys = append(page.Keys, key)
+		}
+	}
+	if next != "0" {
+		page.Cursor = next
+	}
+	return page, nil
 }
 
-type redisClient struct {
-	addr     string
-	password string
-	db       int
-	timeout  time.Duration
+// List walks every SCAN page, so large databases are read incrementally
+// instead of blocking the server like KEYS would.
+func (r *RedisRepository) List(ctx context.Context, options ScanOptions) ([]string, error) {
+	keys := make([]string, 0)
+	err := r.scanAll(ctx, options, func(page []string) {
+		keys = append(keys, page...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
 
-	mu     sync.Mutex
-	conn   net.Conn
-	reader *bufio.Reader
+func (r *RedisRepository) Count(ctx context.Context, options ScanOptions) (int, error) {
+	count := 0
+	err := r.scanAll(ctx, options, func(page []string) {
+		count += len(page)
+	})
+	return count, err
 }
 
-func newRedisClient(addr, password string, db int, timeout time.Duration) *redisClient {
-	return &redisClient{
-		addr:     addr,
-		password: password,
-		db:       db,
-		timeout:  timeout,
+func (r *RedisRepository) scanAll(ctx context.Context, options ScanOptions, visit func([]string)) error {
+	options.Cursor = ""
+	for {
+		page, err := r.Scan(ctx, options)
+		if err != nil {
+			return err
+		}
+		visit(page.Keys)
+		if page.Cursor == "" {
+			return nil
+		}
+		options.Cursor = page.Cursor
 	}
 }
 
-func (c *redisClient) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conn == nil {
-		return nil
+// Delete removes keys with UNLINK, which frees memory in the background,
+// in batches of redisDeleteBatch.
+func (r *RedisRepository) Delete(ctx context.Context, keys ...string) (int, error) {
+	deleted := 0
+	for start := 0; start < len(keys); start += redisDeleteBatch {
+		end := start + redisDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		sequences := make([]string, len(batch))
+		for i, key := range batch {
+			sequences[i] = key + redisSequenceSuffix
+		}
+		count, err := r.client.Unlink(ctx, sequences, batch)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += count
 	}
-	err := c.conn.Close()
-	c.conn = nil
-	c.reader = nil
-	return err
+	return deleted, nil
 }
 
-func (c *redisClient) Get(ctx context.Context, key string) ([]byte, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (r *RedisRepository) Append(ctx context.Context, key string, value StoredResponse) (int, error) {
+	payload, err := encodeStoredResponse(value)
+	if err != nil {
+		return 0, err
+	}
+	return r.client.RPush(ctx, key+redisSequenceSuffix, payload)
+}
 
-	if err := c.ensureConn(ctx); err != nil {
-		return nil, err
+func (r *RedisRepository) GetAt(ctx context.Context, key string, index int) (StoredResponse, int, bool, error) {
+	length, payload, err := r.client.LIndex(ctx, key+redisSequenceSuffix, index)
+	if err != nil {
+		if errors.Is(err, errRedisNil) {
+			return StoredResponse{}, length, false, nil
+		}
+		return StoredResponse{}, 0, false, err
 	}
+	response, err := decodeStoredResponse(payload)
+	if err != nil {
+		return StoredResponse{}, length, false, err
+	}
+	return response, length, true, nil
+}
 
-	if err := c.writeCommand(ctx, "GET", key); err != nil {
-		c.reset()
-		return nil, err
+func (r *RedisRepository) Close() error {
+	return r.client.Close()
+}
+
+// redisClient runs commands on pooled connections, through a pipeline
+// when RedisOptions.Pipeline is set, or across a Redis Cluster.
+type redisClient struct {
+	pool     *redisPool
+	pipeline *redisPipeline
+	cluster  *redisCluster
+	sentinel *redisSentinel
+}
+
+func newRedisClient(options RedisOptions) *redisClient {
+	if len(options.ClusterAddrs) > 0 {
+		return &redisClient{cluster: newRedisCluster(options)}
+	}
+	client := &redisClient{pool: newRedisPool(options)}
+	if len(options.SentinelAddrs) > 0 {
+		client.sentinel = newRedisSentinel(options)
+		client.pool.resolve = client.sentinel.primary
+	}
+	if options.Pipeline {
+		client.pipeline = newRedisPipeline(client.pool, cap(client.pool.slots))
 	}
+	return client
+}
+
+func (c *redisClient) Close() error {
+	if c.cluster != nil {
+		return c.cluster.Close()
+	}
+	return c.pool.Close()
+}
 
-	reply, err := c.readReply(ctx)
+func (c *redisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.command(ctx, "GET", key)
 	if err != nil {
-		c.reset()
 		return nil, err
 	}
-
 	switch reply.kind {
 	case replyBulk:
 		return reply.data, nil
 	case replyNil:
 		return nil, errRedisNil
-	case replyError:
-		return nil, fmt.Errorf("redis error: %s", reply.text)
 	default:
-		return nil, fmt.Errorf("unexpected redis reply: %v", reply.kind)
+		return nil, unexpectedRedisReply(reply)
 	}
 }
 
-func (c *redisClient) Set(ctx context.Context, key string, value []byte, overwrite bool) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if err := c.ensureConn(ctx); err != nil {
-		return err
-	}
-
+// Set stores value at key; a positive ttl sets the expiry in milliseconds,
+// rounded up so sub-millisecond TTLs still expire.
+func (c *redisClient) Set(ctx context.Context, key string, value []byte, overwrite bool, ttl time.Duration) error {
 	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		millis := (ttl + time.Millisecond - 1) / time.Millisecond
+		args = append(args, "PX", strconv.FormatInt(int64(millis), 10))
+	}
 	if !overwrite {
 		args = append(args, "NX")
 	}
-	if err := c.writeCommand(ctx, args...); err != nil {
-		c.reset()
-		return err
-	}
-
-	reply, err := c.readReply(ctx)
+	reply, err := c.command(ctx, args...)
 	if err != nil {
-		c.reset()
 		return err
 	}
-	if reply.kind == replyNil {
-		return nil
+	if reply.kind != replySimple && reply.kind != replyNil {
+		return unexpectedRedisReply(reply)
+	}
+	return nil
+}
+
+// Scan runs one SCAN step and returns the next cursor with the page of keys.
+// In cluster mode the cursor also selects the node being scanned.
+func (c *redisClient) Scan(ctx context.Context, cursor, pattern string, count int) (string, []string, error) {
+	args := []string{"MATCH", pattern, "COUNT", strconv.Itoa(count)}
+	if c.cluster != nil {
+		next, page, err := c.cluster.scan(ctx, cursor, args)
+		if err != nil {
+			return "", nil, err
+		}
+		keys, err := redisKeys(page)
+		return next, keys, err
 	}
-	if reply.kind == replyError {
-		return fmt.Errorf("redis error: %s", reply.text)
+	reply, err := c.command(ctx, append([]string{"SCAN", cursor}, args...)...)
+	if err != nil {
+		return "", nil, err
 	}
-	if reply.kind != replySimple {
-		return fmt.Errorf("unexpected redis reply: %v", reply.kind)
+	if reply.kind != replyArray || len(reply.items) != 2 {
+		return "", nil, unexpectedRedisReply(reply)
 	}
-	return nil
+	keys, err := redisKeys(reply.items[1])
+	return string(reply.items[0].data), keys, err
 }
 
-func (c *redisClient) ensureConn(ctx context.Context) error {
-	if c.conn != nil {
-		return nil
+func redisKeys(reply redisReply) ([]string, error) {
+	if reply.kind != replyArray {
+		return nil, unexpectedRedisReply(reply)
 	}
-	return c.connect(ctx)
+	keys := make([]string, 0, len(reply.items))
+	for _, item := range reply.items {
+		keys = append(keys, string(item.data))
+	}
+	return keys, nil
 }
 
-func (c *redisClient) connect(ctx context.Context) error {
-	dialer := net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+// Unlink deletes sequences and keys in one round trip and reports how many
+// of keys existed.
+func (c *redisClient) Unlink(ctx context.Context, sequences, keys []string) (int, error) {
+	if c.cluster != nil {
+		return c.unlinkEach(ctx, sequences, keys)
+	}
+	replies, err := c.commands(ctx,
+		append([]string{"UNLINK"}, sequences...),
+		append([]string{"UNLINK"}, keys...),
+	)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	c.conn = conn
-	c.reader = bufio.NewReader(conn)
+	return redisInt(replies[1])
+}
 
-	if c.password != "" {
-		if err := c.simpleCommand(ctx, "AUTH", c.password); err != nil {
-			c.reset()
-			return err
+// unlinkEach sends one UNLINK per key, since a cluster rejects multi-key
+// commands whose keys hash to different slots.
+func (c *redisClient) unlinkEach(ctx context.Context, sequences, keys []string) (int, error) {
+	for _, key := range sequences {
+		if _, err := c.command(ctx, "UNLINK", key); err != nil {
+			return 0, err
 		}
 	}
-	if c.db != 0 {
-		if err := c.simpleCommand(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
-			c.reset()
-			return err
+	deleted := 0
+	for _, key := range keys {
+		reply, err := c.command(ctx, "UNLINK", key)
+		if err != nil {
+			return deleted, err
+		}
+		count, err := redisInt(reply)
+		if err != nil {
+			return deleted, err
 		}
+		deleted += count
 	}
-	return nil
+	return deleted, nil
 }
 
-func (c *redisClient) simpleCommand(ctx context.Context, args ...string) error {
-	if err := c.writeCommand(ctx, args...); err != nil {
-		return err
+// RPush appends value to the list at key and returns the list length.
+func (c *redisClient) RPush(ctx context.Context, key string, value []byte) (int, error) {
+	reply, err := c.command(ctx, "RPUSH", key, string(value))
+	if err != nil {
+		return 0, err
 	}
-	reply, err := c.readReply(ctx)
+	return redisInt(reply)
+}
+
+// LIndex returns the list length at key and the element at index, or
+// errRedisNil when index is out of range.
+func (c *redisClient) LIndex(ctx context.Context, key string, index int) (int, []byte, error) {
+	replies, err := c.commands(ctx,
+		[]string{"LLEN", key},
+		[]string{"LINDEX", key, strconv.Itoa(index)},
+	)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	if reply.kind == replyError {
-		return fmt.Errorf("redis error: %s", reply.text)
+	length, err := redisInt(replies[0])
+	if err != nil {
+		return 0, nil, err
 	}
-	if reply.kind != replySimple {
-		return fmt.Errorf("unexpected redis reply: %v", reply.kind)
+	switch replies[1].kind {
+	case replyBulk:
+		return length, replies[1].data, nil
+	case replyNil:
+		return length, nil, errRedisNil
+	default:
+		return 0, nil, unexpectedRedisReply(replies[1])
 	}
-	return nil
 }
 
-func (c *redisClient) reset() {
-	if c.conn != nil {
-		_ = c.conn.Close()
+// command sends one command and converts an error reply to a Go error.
+func (c *redisClient) command(ctx context.Context, args ...string) (redisReply, error) {
+	replies, err := c.commands(ctx, args)
+	if err != nil {
+		return redisReply{}, err
 	}
-	c.conn = nil
-	c.reader = nil
+	return replies[0], nil
 }
 
-func (c *redisClient) writeCommand(ctx context.Context, args ...string) error {
-	if c.conn == nil {
-		return errors.New("redis connection is not established")
+// commands sends cmds back to back on one connection and reads their
+// replies. Transport errors reset the connection so the pool redials. With
+// Sentinel, a READONLY reply means the primary was demoted: the pooled
+// connections are dropped and the commands retried once on the new primary.
+func (c *redisClient) commands(ctx context.Context, cmds ...[]string) ([]redisReply, error) {
+	replies, err := c.send(ctx, cmds)
+	if err == nil && c.sentinel != nil && readOnlyReply(replies) {
+		c.pool.discard()
+		replies, err = c.send(ctx, cmds)
+	}
+	if err != nil {
+		return nil, err
 	}
-	deadline := time.Now().Add(c.timeout)
-	if ctxDeadline, ok := ctx.Deadline(); ok {
-		deadline = ctxDeadline
+	for _, reply := range replies {
+		if reply.kind == replyError {
+			return nil, redisReplyError(reply)
+		}
 	}
-	_ = c.conn.SetDeadline(deadline)
-	_, err := c.conn.Write(buildRESPCommand(args...))
-	return err
+	return replies, nil
+}
+
+func (c *redisClient) send(ctx context.Context, cmds [][]string) ([]redisReply, error) {
+	if c.cluster != nil {
+		return c.cluster.do(ctx, cmds)
+	}
+	if c.pipeline != nil {
+		return c.pipeline.do(ctx, cmds)
+	}
+	conn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.roundTrip(ctx, cmds)
+	c.pool.put(conn)
+	return replies, err
+}
+
+func readOnlyReply(replies []redisReply) bool {
+	for _, reply := range replies {
+		if reply.kind == replyError && strings.HasPrefix(reply.text, "READONLY") {
+			return true
+		}
+	}
+	return false
+}
+
+func redisInt(reply redisReply) (int, error) {
+	if reply.kind != replyInt {
+		return 0, unexpectedRedisReply(reply)
+	}
+	return strconv.Atoi(reply.text)
+}
+
+func redisReplyError(reply redisReply) error {
+	return fmt.Errorf("redis error: %s", reply.text)
+}
+
+func unexpectedRedisReply(reply redisReply) error {
+	return fmt.Errorf("unexpected redis reply: %v", reply.kind)
 }
 
 type replyKind int
@@ -228,25 +463,21 @@ const (
 	replyInt
 	replyBulk
 	replyNil
+	replyArray
 )
 
+// redisReply is one parsed RESP value. MOVED and ASK error replies also
+// carry the parsed cluster redirect.
 type redisReply struct {
-	kind replyKind
-	text string
-	data []byte
+	kind     replyKind
+	text     string
+	data     []byte
+	items    []redisReply
+	redirect *redisRedirect
 }
 
-func (c *redisClient) readReply(ctx context.Context) (redisReply, error) {
-	if c.reader == nil {
-		return redisReply{kind: replyUnknown}, errors.New("redis reader is not initialized")
-	}
-	deadline := time.Now().Add(c.timeout)
-	if ctxDeadline, ok := ctx.Deadline(); ok {
-		deadline = ctxDeadline
-	}
-	_ = c.conn.SetDeadline(deadline)
-
-	line, err := c.reader.ReadString('\n')
+func readRESPReply(reader *bufio.Reader) (redisReply, error) {
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		return redisReply{kind: replyUnknown}, err
 	}
@@ -262,7 +493,7 @@ func (c *redisClient) readReply(ctx context.Context) (redisReply, error) {
 	case '+':
 		return redisReply{kind: replySimple, text: payload}, nil
 	case '-':
-		return redisReply{kind: replyError, text: payload}, nil
+		return redisReply{kind: replyError, text: payload, redirect: parseRedisRedirect(payload)}, nil
 	case ':':
 		return redisReply{kind: replyInt, text: payload}, nil
 	case '$':
@@ -274,15 +505,70 @@ func (c *redisClient) readReply(ctx context.Context) (redisReply, error) {
 			return redisReply{kind: replyNil}, nil
 		}
 		buf := make([]byte, size+2)
-		if _, err := io.ReadFull(c.reader, buf); err != nil {
+		if _, err := io.ReadFull(reader, buf); err != nil {
 			return redisReply{kind: replyUnknown}, err
 		}
 		return redisReply{kind: replyBulk, data: buf[:size]}, nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return redisReply{kind: replyUnknown}, err
+		}
+		if count == -1 {
+			return redisReply{kind: replyNil}, nil
+		}
+		items := make([]redisReply, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readRESPReply(reader)
+			if err != nil {
+				return redisReply{kind: replyUnknown}, err
+			}
+			items = append(items, item)
+		}
+		return redisReply{kind: replyArray, items: items}, nil
 	default:
 		return redisReply{kind: replyUnknown}, fmt.Errorf("unknown redis reply prefix: %q", prefix)
 	}
 }
 
+// redisScanPattern narrows SCAN on the server. A glob Pattern is sent as is;
+// otherwise the escaped Prefix is matched. Results are still filtered by
+// ScanOptions.matches.
+func redisScanPattern(options ScanOptions) string {
+	if options.Pattern != "" {
+		return redisGlob(options.Pattern)
+	}
+	var builder strings.Builder
+	for _, r := range options.Prefix {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(r)
+	}
+	builder.WriteByte('*')
+	return builder.String()
+}
+
+// redisGlob turns a ScanOptions pattern into MATCH syntax, where brackets
+// would start a character class.
+func redisGlob(pattern string) string {
+	var builder strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '[' || r == ']':
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
 func buildRESPCommand(args ...string) []byte {
 	var buffer bytes.Buffer
 	fmt.Fprintf(&buffer, "*%d\r\n", len(args))
@@ -1,6 +1,20 @@
 package replay
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/match"
+)
 
 func TestBuildRESPCommand(t *testing.T) {
 	got := string(buildRESPCommand("GET", "alpha"))
@@ -9,3 +23,579 @@ func TestBuildRESPCommand(t *testing.T) {
 		t.Fatalf("got %q want %q", got, want)
 	}
 }
+
+func TestReadRESPReplyArray(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*2\r\n$1\r\n0\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n"))
+	reply, err := readRESPReply(reader)
+	if err != nil {
+		t.Fatalf("readRESPReply: %v", err)
+	}
+	if reply.kind != replyArray || len(reply.items) != 2 {
+		t.Fatalf("unexpected reply: %#v", reply)
+	}
+	keys := reply.items[1]
+	if keys.kind != replyArray || len(keys.items) != 2 || string(keys.items[1].data) != "b" {
+		t.Fatalf("unexpected nested reply: %#v", keys)
+	}
+}
+
+func TestRedisScanPattern(t *testing.T) {
+	if got := redisScanPattern(ScanOptions{Prefix: "p:/a*b?[c]"}); got != `p:/a\*b\?\[c\]*` {
+		t.Fatalf("unexpected prefix pattern: %q", got)
+	}
+	if got := redisScanPattern(ScanOptions{Prefix: "p:", Pattern: "p:/v1/*"}); got != "p:/v1/*" {
+		t.Fatalf("unexpected glob pattern: %q", got)
+	}
+	if got := redisScanPattern(ScanOptions{Pattern: `p:/a[1]\*`}); got != `p:/a\[1\]\*` {
+		t.Fatalf("unexpected bracket pattern: %q", got)
+	}
+}
+
+// respStub is a minimal in-memory Redis speaking RESP for tests. latency is
+// applied once per batch of commands read together, like a network round trip.
+// readOnly makes it answer writes like a demoted replica, masters answers
+// SENTINEL queries, redirect may answer a command with a MOVED or ASK error
+// and clusterSlots is the raw CLUSTER SLOTS reply.
+type respStub struct {
+	listener net.Listener
+	latency  time.Duration
+
+	mu           sync.Mutex
+	expires      map[string]time.Time
+	readOnly     bool
+	masters      map[string]string
+	redirect     func(args []string) string
+	clusterSlots string
+	data         map[string]string
+	lists        map[string][]string
+	commands     []string
+	auth         [][]string
+	dials        int
+	conns        []net.Conn
+}
+
+func startRESPStub(t testing.TB) *respStub {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return serveRESPStub(t, listener)
+}
+
+func serveRESPStub(t testing.TB, listener net.Listener) *respStub {
+	stub := &respStub{
+		listener: listener,
+		data:     make(map[string]string),
+		lists:    make(map[string][]string),
+		expires:  make(map[string]time.Time),
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		stub.dropConnections()
+	})
+	go stub.serve()
+	return stub
+}
+
+func (s *respStub) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.dials++
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// dropConnections closes every accepted connection, simulating a restart.
+func (s *respStub) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *respStub) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *respStub) seen(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, command := range s.commands {
+		if command == name {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *respStub) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		request, err := readRESPReply(reader)
+		if err != nil {
+			return
+		}
+		args := make([]string, 0, len(request.items))
+		for _, item := range request.items {
+			args = append(args, string(item.data))
+		}
+		writer.WriteString(s.execute(args))
+		if reader.Buffered() == 0 {
+			if s.latency > 0 {
+				time.Sleep(s.latency)
+			}
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *respStub) execute(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	name := strings.ToUpper(args[0])
+	s.commands = append(s.commands, name)
+	bulk := func(value string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	}
+	if len(args) > 1 {
+		if expiry, ok := s.expires[args[1]]; ok && !time.Now().Before(expiry) {
+			delete(s.data, args[1])
+			delete(s.expires, args[1])
+		}
+	}
+	if s.redirect != nil {
+		if redirect := s.redirect(args); redirect != "" {
+			return "-" + redirect + "\r\n"
+		}
+	}
+	switch name {
+	case "SET", "UNLINK", "DEL", "RPUSH":
+		if s.readOnly {
+			return "-READONLY You can't write against a read only replica.\r\n"
+		}
+	}
+	switch name {
+	case "ASKING":
+		return "+OK\r\n"
+	case "SENTINEL":
+		host, port, err := net.SplitHostPort(s.masters[args[2]])
+		if err != nil {
+			return "*-1\r\n"
+		}
+		return "*2\r\n" + bulk(host) + bulk(port)
+	case "CLUSTER":
+		if s.clusterSlots == "" {
+			return "-ERR This instance has cluster support disabled\r\n"
+		}
+		return s.clusterSlots
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH":
+		s.auth = append(s.auth, args[1:])
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "SET":
+		nx, ttl := false, time.Duration(0)
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				millis, _ := strconv.Atoi(args[i])
+				ttl = time.Duration(millis) * time.Millisecond
+			}
+		}
+		if _, ok := s.data[args[1]]; ok && nx {
+			return "$-1\r\n"
+		}
+		s.data[args[1]] = args[2]
+		delete(s.expires, args[1])
+		if ttl > 0 {
+			s.expires[args[1]] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "UNLINK", "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				deleted++
+			}
+			if _, ok := s.lists[key]; ok {
+				delete(s.lists, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "RPUSH":
+		s.lists[args[1]] = append(s.lists[args[1]], args[2:]...)
+		return fmt.Sprintf(":%d\r\n", len(s.lists[args[1]]))
+	case "LLEN":
+		return fmt.Sprintf(":%d\r\n", len(s.lists[args[1]]))
+	case "LINDEX":
+		index, _ := strconv.Atoi(args[2])
+		list := s.lists[args[1]]
+		if index < 0 || index >= len(list) {
+			return "$-1\r\n"
+		}
+		return bulk(list[index])
+	case "SCAN":
+		keys := make([]string, 0)
+		for key := range s.data {
+			if match.Match(key, args[3]) {
+				keys = append(keys, key)
+			}
+		}
+		for key := range s.lists {
+			if match.Match(key, args[3]) {
+				keys = append(keys, key)
+			}
+		}
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", bulk("0"), len(keys))
+		for _, key := range keys {
+			reply += bulk(key)
+		}
+		return reply
+	default:
+		return "-ERR unknown command '" + name + "'\r\n"
+	}
+}
+
+func TestRedisRepositoryWithStub(t *testing.T) {
+	stub := startRESPStub(t)
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		Addr:     stub.addr(),
+		Password: "secret",
+		DB:       2,
+		Timeout:  time.Second,
+		PoolSize: 2,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.Set(ctx, "p:/a|GET|", StoredResponse{StatusCode: 200}, false); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := repo.Set(ctx, "p:/a|GET|", StoredResponse{StatusCode: 500}, false); err != nil {
+		t.Fatalf("Set NX: %v", err)
+	}
+	stored, found, err := repo.Get(ctx, "p:/a|GET|")
+	if err != nil || !found || stored.StatusCode != 200 {
+		t.Fatalf("unexpected Get: %#v %v %v", stored, found, err)
+	}
+	if _, err := repo.Append(ctx, "p:/a|GET|", StoredResponse{StatusCode: 202}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if stored, length, found, err := repo.GetAt(ctx, "p:/a|GET|", 0); err != nil || !found || length != 1 || stored.StatusCode != 202 {
+		t.Fatalf("unexpected GetAt: %#v %d %v %v", stored, length, found, err)
+	}
+	if keys, err := repo.List(ctx, ScanOptions{Prefix: "p:"}); err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected List: %#v %v", keys, err)
+	}
+	if deleted, err := repo.Delete(ctx, "p:/a|GET|"); err != nil || deleted != 1 {
+		t.Fatalf("unexpected Delete: %d %v", deleted, err)
+	}
+	if _, found, _ := repo.Get(ctx, "p:/a|GET|"); found {
+		t.Fatal("expected key to be deleted")
+	}
+
+	if dials := stub.dialCount(); dials != 1 {
+		t.Fatalf("expected one pooled connection for sequential use, got %d", dials)
+	}
+	if stub.seen("AUTH") != 1 || stub.seen("SELECT") != 1 {
+		t.Fatalf("expected AUTH and SELECT once per connection, got %d and %d", stub.seen("AUTH"), stub.seen("SELECT"))
+	}
+}
+
+func TestRedisRepositoryTTL(t *testing.T) {
+	stub := startRESPStub(t)
+	repo := NewRedisRepositoryWithOptions(RedisOptions{Addr: stub.addr(), Timeout: time.Second})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.SetWithTTL(ctx, "short", StoredResponse{StatusCode: 200}, false, 30*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if _, found, _ := repo.Get(ctx, "short"); !found {
+		t.Fatal("expected entry before expiry")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, found, err := repo.Get(ctx, "short"); err != nil || found {
+		t.Fatalf("expected expired entry to miss: %v %v", found, err)
+	}
+	if err := repo.Set(ctx, "short", StoredResponse{StatusCode: 201}, false); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if stored, found, _ := repo.Get(ctx, "short"); !found || stored.StatusCode != 201 {
+		t.Fatalf("expected refreshed entry, got %#v %v", stored, found)
+	}
+}
+
+func TestRedisRepositoryTLSWithACLUser(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCertAuthority(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCertAuthority: %v", err)
+	}
+	leaf, err := ca.leafCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("leafCertificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*leaf}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stub := serveRESPStub(t, listener)
+
+	options, err := ParseRedisURL("rediss://app:s3cret@" + stub.addr() + "/3")
+	if err != nil {
+		t.Fatalf("ParseRedisURL: %v", err)
+	}
+	options.TLSConfig, err = RedisTLSOptions{CAFile: filepath.Join(dir, caCertFile)}.Config("127.0.0.1")
+	if err != nil {
+		t.Fatalf("TLS config: %v", err)
+	}
+	options.Timeout = time.Second
+	repo := NewRedisRepositoryWithOptions(options)
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.Set(ctx, "k", StoredResponse{StatusCode: 200}, true); err != nil {
+		t.Fatalf("Set over TLS: %v", err)
+	}
+	stub.mu.Lock()
+	auth := stub.auth
+	stub.mu.Unlock()
+	if len(auth) != 1 || strings.Join(auth[0], " ") != "app s3cret" {
+		t.Fatalf("expected ACL AUTH, got %#v", auth)
+	}
+
+	untrusted := NewRedisRepositoryWithOptions(RedisOptions{
+		Addr:      stub.addr(),
+		Timeout:   time.Second,
+		TLSConfig: &tls.Config{},
+	})
+	t.Cleanup(func() {
+		_ = untrusted.Close()
+	})
+	if _, _, err := untrusted.Get(ctx, "k"); err == nil {
+		t.Fatal("expected verification failure without the CA")
+	}
+}
+
+func TestRedisPoolRecoversFromDroppedConnection(t *testing.T) {
+	stub := startRESPStub(t)
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		Addr:                stub.addr(),
+		Timeout:             time.Second,
+		HealthCheckInterval: time.Nanosecond,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.Set(ctx, "k", StoredResponse{StatusCode: 200}, true); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	stub.dropConnections()
+	if _, found, err := repo.Get(ctx, "k"); err != nil || !found {
+		t.Fatalf("expected health check to replace the dropped connection: %v %v", found, err)
+	}
+	if _, _, err := repo.Get(ctx, "k"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stub.seen("PING") == 0 || stub.dialCount() != 2 {
+		t.Fatalf("unexpected pings %d, dials %d", stub.seen("PING"), stub.dialCount())
+	}
+
+	noCheck := NewRedisRepositoryWithOptions(RedisOptions{Addr: stub.addr(), Timeout: time.Second})
+	t.Cleanup(func() {
+		_ = noCheck.Close()
+	})
+	if _, _, err := noCheck.Get(ctx, "k"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	stub.dropConnections()
+	if _, _, err := noCheck.Get(ctx, "k"); err == nil {
+		t.Fatal("expected error on dropped connection")
+	}
+	if _, found, err := noCheck.Get(ctx, "k"); err != nil || !found {
+		t.Fatalf("expected reset connection to be redialed: %v %v", found, err)
+	}
+}
+
+func TestRedisPoolIdleTimeout(t *testing.T) {
+	stub := startRESPStub(t)
+	repo := NewRedisRepositoryWithOptions(RedisOptions{
+		Addr:        stub.addr(),
+		Timeout:     time.Second,
+		IdleTimeout: 20 * time.Millisecond,
+	})
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if _, _, err := repo.Get(ctx, "k"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, _, err := repo.Get(ctx, "k"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials := stub.dialCount(); dials != 2 {
+		t.Fatalf("expected idle connection to be replaced, got %d dials", dials)
+	}
+}
+
+func TestRedisPoolConcurrency(t *testing.T) {
+	for _, pipeline := range []bool{false, true} {
+		stub := startRESPStub(t)
+		repo := NewRedisRepositoryWithOptions(RedisOptions{
+			Addr:     stub.addr(),
+			Timeout:  time.Second,
+			PoolSize: 4,
+			Pipeline: pipeline,
+		})
+
+		ctx := context.Background()
+		var wg sync.WaitGroup
+		errs := make(chan error, 64)
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprintf("/k/%d|GET|", i)
+				if err := repo.Set(ctx, key, StoredResponse{StatusCode: 200 + i}, true); err != nil {
+					errs <- err
+					return
+				}
+				stored, found, err := repo.Get(ctx, key)
+				if err != nil || !found || stored.StatusCode != 200+i {
+					errs <- fmt.Errorf("%s: %#v %v %v", key, stored, found, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("pipeline=%v: %v", pipeline, err)
+		}
+		if dials := stub.dialCount(); dials > 4 {
+			t.Errorf("pipeline=%v: pool opened %d connections, limit 4", pipeline, dials)
+		}
+		_ = repo.Close()
+	}
+}
+
+func TestRedisPipelineBatchContext(t *testing.T) {
+	soon := time.Now().Add(time.Minute)
+	later := soon.Add(time.Minute)
+	first, cancelFirst := context.WithDeadline(context.Background(), soon)
+	defer cancelFirst()
+	second, cancelSecond := context.WithDeadline(context.Background(), later)
+	defer cancelSecond()
+
+	ctx, cancel := batchContext([]*pipelineRequest{{ctx: first}, {ctx: second}})
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(later) {
+		t.Fatalf("expected the latest deadline %v, got %v %v", later, deadline, ok)
+	}
+
+	cancelFirst()
+	select {
+	case <-ctx.Done():
+		t.Fatal("expected the batch to wait while a request is still live")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancelSecond()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the batch to end once every request gave up")
+	}
+
+	unbounded, cancelUnbounded := batchContext([]*pipelineRequest{{ctx: context.Background()}, {ctx: first}})
+	defer cancelUnbounded()
+	if _, ok := unbounded.Deadline(); ok {
+		t.Fatal("expected no deadline while a request has none")
+	}
+}
+
+func BenchmarkRedisRepositoryGet(b *testing.B) {
+	for _, bench := range []struct {
+		name     string
+		poolSize int
+		pipeline bool
+	}{
+		{"pool-1", 1, false},
+		{"pool-4", 4, false},
+		{"pool-16", 16, false},
+		{"pipeline-4", 4, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			stub := startRESPStub(b)
+			stub.latency = 100 * time.Microsecond
+			repo := NewRedisRepositoryWithOptions(RedisOptions{
+				Addr:     stub.addr(),
+				Timeout:  5 * time.Second,
+				PoolSize: bench.poolSize,
+				Pipeline: bench.pipeline,
+			})
+			defer repo.Close()
+
+			ctx := context.Background()
+			if err := repo.Set(ctx, "/bench|GET|", StoredResponse{StatusCode: 200, BodyBase64: "b2s="}, true); err != nil {
+				b.Fatalf("Set: %v", err)
+			}
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := repo.Get(ctx, "/bench|GET|"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package replay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultRedisPort = "6379"
+
+// ParseRedisURL reads redis://[user:password@]host[:port][/db] and the TLS
+// variant rediss://. A URL with only a password (redis://:secret@host) sends
+// the legacy single-argument AUTH; with a user it sends AUTH user password
+// for Redis 6 ACLs. rediss:// enables TLS verified against the system roots;
+// use RedisTLSOptions for a private CA or client certificates.
+func ParseRedisURL(raw string) (RedisOptions, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return RedisOptions{}, err
+	}
+	if parsed.Scheme != "redis" && parsed.Scheme != "rediss" {
+		return RedisOptions{}, fmt.Errorf("unsupported redis URL scheme: %q", parsed.Scheme)
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return RedisOptions{}, errors.New("redis URL has no host")
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = defaultRedisPort
+	}
+
+	options := RedisOptions{Addr: net.JoinHostPort(host, port)}
+	if parsed.User != nil {
+		options.Username = parsed.User.Username()
+		options.Password, _ = parsed.User.Password()
+	}
+	if db := strings.Trim(parsed.Path, "/"); db != "" {
+		options.DB, err = strconv.Atoi(db)
+		if err != nil || options.DB < 0 {
+			return RedisOptions{}, fmt.Errorf("invalid redis database: %q", db)
+		}
+	}
+	if parsed.Scheme == "rediss" {
+		options.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	return options, nil
+}
+
+// RedisTLSOptions describes the files used to secure a Redis connection.
+type RedisTLSOptions struct {
+	// CAFile verifies the server against a private CA instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile present a client certificate.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables server verification; only for local use.
+	InsecureSkipVerify bool
+}
+
+// Config builds a tls.Config for serverName from the configured files.
+func (o RedisTLSOptions) Config(serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pemData, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("%s: no certificates found", o.CAFile)
+		}
+		config.RootCAs = roots
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Enabled reports whether any TLS option is set.
+func (o RedisTLSOptions) Enabled() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.InsecureSkipVerify
+}
@@ -0,0 +1,243 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloadable is implemented by the plugins whose settings can be replaced
+// while the server runs: replay, record, map-local, map-remote,
+// header-rewrite and route. The swap happens under the plugin's lock, so a
+// request sees either the old or the new settings, never a mix.
+type Reloadable interface {
+	Plugin
+	swapSettings(next Plugin) error
+}
+
+// ReloadPlugins rebuilds the reloadable plugins of a chain built by
+// NewPluginsFromConfig from configs, the chain's current declaration. Every
+// plugin is built and validated before any is swapped, so a mistake leaves
+// the whole chain on its previous settings. The decoder and dumper cannot be
+// reloaded, so a change to their declaration fails the reload, as does a
+// change to the chain itself, including the chains of its routes.
+func ReloadPlugins(plugins []Plugin, configs []PluginConfig) error {
+	var swaps []pluginSwap
+	if err := planReload(plugins, configs, &swaps); err != nil {
+		return err
+	}
+	for _, swap := range swaps {
+		if err := swap.current.swapSettings(swap.next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pluginSwap struct {
+	current Reloadable
+	next    Plugin
+}
+
+// planReload builds the replacement of every reloadable plugin of the chain,
+// descending into routes, without swapping any. Slots that cannot be reloaded
+// must keep their declaration.
+func planReload(plugins []Plugin, configs []PluginConfig, swaps *[]pluginSwap) error {
+	if len(configs) != len(plugins) {
+		return fmt.Errorf("the chain has %d plugins, the config declares %d; restart to change it", len(plugins), len(configs))
+	}
+	for i, plugin := range plugins {
+		// Checked before anything is built, as building a dumper opens
+		// its file.
+		if configs[i].Type != pluginType(plugin) {
+			return fmt.Errorf("plugin %d changed from %s to %s; restart to change the chain", i, plugin.Name(), configs[i].Type)
+		}
+		switch current := plugin.(type) {
+		case *Route:
+			// The route's plugins are reloaded in place rather than
+			// built a second time.
+			options, err := configs[i].route()
+			if err != nil {
+				return fmt.Errorf("plugin %d (route): %w", i, err)
+			}
+			if err := planReload(current.Plugins, options.Plugins, swaps); err != nil {
+				return fmt.Errorf("plugin %d (route): %w", i, err)
+			}
+			*swaps = append(*swaps, pluginSwap{current: current, next: NewRoute(options.Match)})
+		case Reloadable:
+			next, err := NewPluginFromConfig(configs[i])
+			if err != nil {
+				return fmt.Errorf("plugin %d (%s): %w", i, configs[i].Type, err)
+			}
+			*swaps = append(*swaps, pluginSwap{current: current, next: next})
+		default:
+			if err := checkUnchanged(plugin, configs[i]); err != nil {
+				return fmt.Errorf("plugin %d (%s): %w; restart to change it", i, configs[i].Type, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pluginType returns the PluginConfig type plugin is built from.
+func pluginType(plugin Plugin) string {
+	switch plugin.(type) {
+	case *ReplayPlugin:
+		return "replay"
+	case *RecordPlugin:
+		return "record"
+	case *Decoder:
+		return "decoder"
+	case *Dumper:
+		return "dumper"
+	case *MapLocal:
+		return "map-local"
+	case *MapRemote:
+		return "map-remote"
+	case *HeaderRewrite:
+		return "header-rewrite"
+	case *Route:
+		return "route"
+	default:
+		return ""
+	}
+}
+
+// checkUnchanged reports whether config still declares plugin, which cannot
+// be reloaded.
+func checkUnchanged(plugin Plugin, config PluginConfig) error {
+	name := config.Name
+	switch plugin := plugin.(type) {
+	case *Dumper:
+		var options dumperSettings
+		if err := config.decodeSettings(&options); err != nil {
+			return err
+		}
+		if options.Output != plugin.filename || options.Level != plugin.level {
+			return errors.New("dumper settings changed")
+		}
+		if name == "" {
+			name = "dumper"
+		}
+	case *Decoder:
+		if err := config.decodeSettings(&struct{}{}); err != nil {
+			return err
+		}
+		if name == "" {
+			name = "decoder"
+		}
+	}
+	if name != plugin.Name() {
+		return fmt.Errorf("name changed from %s to %s", plugin.Name(), name)
+	}
+	return nil
+}
+
+// ReloadPluginFromFile re-reads and validates the rules file of a plugin
+// built by its New*FromFile constructor and swaps them in. On error the
+// plugin keeps its current rules.
+func ReloadPluginFromFile(plugin Plugin, filename string) error {
+	var next Plugin
+	var err error
+	switch plugin.(type) {
+	case *ReplayPlugin:
+		next, err = NewReplayPluginFromFile(filename)
+	case *RecordPlugin:
+		next, err = NewRecordPluginFromFile(filename)
+	case *MapLocal:
+		next, err = NewMapLocalFromFile(filename)
+	case *MapRemote:
+		next, err = NewMapRemoteFromFile(filename)
+	case *HeaderRewrite:
+		next, err = NewHeaderRewriteFromFile(filename)
+	default:
+		return fmt.Errorf("plugin %s cannot be reloaded", plugin.Name())
+	}
+	if err != nil {
+		return err
+	}
+	return plugin.(Reloadable).swapSettings(next)
+}
+
+// RuleWatcher reruns reload functions when their rule files change.
+type RuleWatcher struct {
+	mu    sync.Mutex
+	files []*watchedFile
+}
+
+type watchedFile struct {
+	filename string
+	reload   func() error
+	modTime  time.Time
+	size     int64
+}
+
+// Watch registers reload to run whenever filename changes.
+func (w *RuleWatcher) Watch(filename string, reload func() error) {
+	file := &watchedFile{filename: filename, reload: reload}
+	if info, err := os.Stat(filename); err == nil {
+		file.modTime, file.size = info.ModTime(), info.Size()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = append(w.files, file)
+}
+
+// Check reloads the files whose modification time or size changed since
+// they were last seen. A file that fails to reload is retried once it
+// changes again. Missing files are skipped, as editors may briefly remove a
+// file while saving it.
+func (w *RuleWatcher) Check() error {
+	return w.reload(false)
+}
+
+// ReloadAll reloads every file, changed or not, as on SIGHUP.
+func (w *RuleWatcher) ReloadAll() error {
+	return w.reload(true)
+}
+
+func (w *RuleWatcher) reload(all bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for _, file := range w.files {
+		info, err := os.Stat(file.filename)
+		if err != nil {
+			if all {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if !all && info.ModTime().Equal(file.modTime) && info.Size() == file.size {
+			continue
+		}
+		file.modTime, file.size = info.ModTime(), info.Size()
+		if err := file.reload(); err != nil {
+			errs = append(errs, fmt.Errorf("reload %s: %w", file.filename, err))
+			continue
+		}
+		log.Printf("reloaded %s", file.filename)
+	}
+	return errors.Join(errs...)
+}
+
+// Run checks the files every interval until ctx ends, logging failed
+// reloads; the previous rules stay active for those.
+func (w *RuleWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Check(); err != nil {
+				log.Printf("rules reload failed, keeping the previous rules: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package replay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func reloadTestConfigs(t *testing.T, raw string) []PluginConfig {
+	t.Helper()
+	var configs []PluginConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return configs
+}
+
+func TestReloadPlugins(t *testing.T) {
+	plugins, err := NewPluginsFromConfig(reloadTestConfigs(t, `[
+		{"type": "map-remote", "settings": {"items": [{"enable": true, "from": {"path": "/a"}, "to": {"host": "a.example.com"}}]}},
+		{"type": "decoder"},
+		{"type": "record", "settings": {"ttl_seconds": 60}}
+	]`))
+	if err != nil {
+		t.Fatalf("NewPluginsFromConfig: %v", err)
+	}
+	mapRemote := plugins[0].(*MapRemote)
+	record := plugins[2].(*RecordPlugin)
+
+	err = ReloadPlugins(plugins, reloadTestConfigs(t, `[
+		{"type": "map-remote", "settings": {"items": [{"enable": true, "from": {"path": "/b"}, "to": {"host": "b.example.com"}}]}},
+		{"type": "decoder"},
+		{"type": "record", "settings": {"ttl_seconds": 120, "overwrite": true}}
+	]`))
+	if err != nil {
+		t.Fatalf("ReloadPlugins: %v", err)
+	}
+	if plugins[0] != mapRemote || len(mapRemote.Items) != 1 || mapRemote.Items[0].From.Path != "/b" {
+		t.Fatalf("expected the map-remote items to be swapped in place: %#v", mapRemote.Items)
+	}
+	if record.TTLSeconds != 120 || !record.Overwrite {
+		t.Fatalf("unexpected record settings: %#v", record)
+	}
+}
+
+func TestReloadPluginsKeepsRulesOnError(t *testing.T) {
+	plugins, err := NewPluginsFromConfig(reloadTestConfigs(t, `[
+		{"type": "map-remote", "settings": {"items": [{"enable": true, "from": {"path": "/a"}, "to": {"host": "a.example.com"}}]}},
+		{"type": "record", "settings": {"ttl_seconds": 60}}
+	]`))
+	if err != nil {
+		t.Fatalf("NewPluginsFromConfig: %v", err)
+	}
+	mapRemote := plugins[0].(*MapRemote)
+	record := plugins[1].(*RecordPlugin)
+
+	cases := map[string]string{
+		"invalid rule": `[
+			{"type": "map-remote", "settings": {"items": [{"enable": true, "from": {"path": "/b"}, "to": {"host": "b.example.com"}}]}},
+			{"type": "record", "settings": {"ttl_seconds": -1}}
+		]`,
+		"changed type": `[
+			{"type": "map-local"},
+			{"type": "record"}
+		]`,
+		"changed length": `[
+			{"type": "map-remote"}
+		]`,
+	}
+	for name, raw := range cases {
+		if err := ReloadPlugins(plugins, reloadTestConfigs(t, raw)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if mapRemote.Items[0].From.Path != "/a" || record.TTLSeconds != 60 {
+		t.Fatalf("expected the previous rules to stay active: %#v %#v", mapRemote.Items[0].From, record)
+	}
+}
+
+func TestReloadPluginsRejectsChangesToFixedPlugins(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "dump.log")
+	declare := func(dumper string) []PluginConfig {
+		return reloadTestConfigs(t, `[
+			{"type": "decoder"},
+			`+dumper+`,
+			{"type": "record"}
+		]`)
+	}
+	plugins, err := NewPluginsFromConfig(declare(`{"type": "dumper", "settings": {"output": "` + dump + `"}}`))
+	if err != nil {
+		t.Fatalf("NewPluginsFromConfig: %v", err)
+	}
+	defer ClosePlugins(plugins)
+
+	if err := ReloadPlugins(plugins, declare(`{"type": "dumper", "settings": {"output": "`+dump+`"}}`)); err != nil {
+		t.Fatalf("an unchanged declaration should reload: %v", err)
+	}
+	other := filepath.Join(dir, "other.log")
+	cases := map[string][]PluginConfig{
+		"dumper output": declare(`{"type": "dumper", "settings": {"output": "` + other + `"}}`),
+		"dumper level":  declare(`{"type": "dumper", "settings": {"output": "` + dump + `", "level": 1}}`),
+		"dumper name":   declare(`{"type": "dumper", "name": "payments", "settings": {"output": "` + dump + `"}}`),
+		"dumper type":   declare(`{"type": "record"}`),
+		"decoder type": reloadTestConfigs(t, `[
+			{"type": "dumper", "settings": {"output": "`+other+`"}},
+			{"type": "dumper", "settings": {"output": "`+dump+`"}},
+			{"type": "record"}
+		]`),
+	}
+	for name, configs := range cases {
+		if err := ReloadPlugins(plugins, configs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatalf("a rejected reload opened %s: %v", other, err)
+	}
+}
+
+func TestReloadPluginFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.yaml")
+	if err := os.WriteFile(path, []byte("enable: true\nlog_not_found: false\n"), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	replay, err := NewReplayPluginFromFile(path)
+	if err != nil {
+		t.Fatalf("NewReplayPluginFromFile: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("enable: true\nsequence_exhausted: never\n"), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := ReloadPluginFromFile(replay, path); err == nil {
+		t.Fatalf("expected invalid rules to be rejected")
+	}
+
+	if err := os.WriteFile(path, []byte("enable: true\nlog_not_found: true\n"), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := ReloadPluginFromFile(replay, path); err != nil {
+		t.Fatalf("ReloadPluginFromFile: %v", err)
+	}
+	if !replay.LogNotFound {
+		t.Fatalf("expected the reloaded rules to be active")
+	}
+
+	if err := ReloadPluginFromFile(NewDecoder(), path); err == nil {
+		t.Fatalf("expected the decoder to be rejected")
+	}
+}
+
+func TestRuleWatcherCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	var reloads int
+	var watcher RuleWatcher
+	watcher.Watch(path, func() error {
+		reloads++
+		return nil
+	})
+
+	if err := watcher.Check(); err != nil || reloads != 0 {
+		t.Fatalf("expected no reload for an unchanged file, got %d (%v)", reloads, err)
+	}
+	if err := os.WriteFile(path, []byte(`{"enable": true}`), 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := watcher.Check(); err != nil || reloads != 1 {
+		t.Fatalf("expected one reload, got %d (%v)", reloads, err)
+	}
+	if err := watcher.ReloadAll(); err != nil || reloads != 2 {
+		t.Fatalf("expected ReloadAll to reload, got %d (%v)", reloads, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := watcher.Check(); err != nil {
+		t.Fatalf("expected a missing file to be skipped: %v", err)
+	}
+	if err := watcher.ReloadAll(); err == nil {
+		t.Fatalf("expected ReloadAll to report the missing file")
+	}
+}
+
+func TestReloadUnderConcurrentRequests(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	mapLocal := &MapLocal{
+		BasePlugin: BasePlugin{PluginName: "map-local"},
+		Enable:     true,
+		Items: []*mapLocalItem{
+			{From: &mapFrom{Path: "/a.txt"}, To: &mapLocalTo{Path: filepath.Join(dir, "a.txt")}, Enable: true},
+		},
+	}
+	next := &MapLocal{BasePlugin: BasePlugin{PluginName: "map-local"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/a.txt", nil)
+				if err := mapLocal.OnRequest(&RequestContext{Request: req}); err != nil {
+					t.Errorf("OnRequest: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := mapLocal.swapSettings(next); err != nil {
+			t.Fatalf("swapSettings: %v", err)
+		}
+	}
+	wg.Wait()
+	if mapLocal.Enable || mapLocal.Items != nil {
+		t.Fatalf("expected the last swap to win: %#v", mapLocal)
+	}
+}
@@ -3,8 +3,15 @@ package replay
 import (
 	"context"
 	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/tidwall/match"
 )
 
+// defaultScanLimit is the page size used when ScanOptions.Limit is zero.
+const defaultScanLimit = 1000
+
 type Header struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -14,14 +21,90 @@ type StoredResponse struct {
 	StatusCode int      `json:"status_code"`
 	Headers    []Header `json:"headers"`
 	BodyBase64 string   `json:"body_base64"`
+	// Trailers are sent after the body, as gRPC does with grpc-status.
+	Trailers []Header `json:"trailers,omitempty"`
+	// RecordedAt is when the response was fetched from upstream, in Unix
+	// seconds; zero for imported entries.
+	RecordedAt int64 `json:"recorded_at,omitempty"`
+	// Events holds a recorded text/event-stream body in place of
+	// BodyBase64, replayed one event at a time.
+	Events []StoredEvent `json:"events,omitempty"`
+	// WebSocket holds the messages of a recorded WebSocket connection; the
+	// entry itself is the 101 handshake response.
+	WebSocket []StoredWSMessage `json:"websocket,omitempty"`
+}
+
+// StoredEvent is one server-sent event: its raw text, including the blank
+// line that ends it, and when it arrived relative to the response headers.
+type StoredEvent struct {
+	OffsetMillis int64  `json:"offset_ms"`
+	Data         string `json:"data"`
 }
 
 type Repository interface {
 	Get(ctx context.Context, key string) (StoredResponse, bool, error)
 	Set(ctx context.Context, key string, value StoredResponse, overwrite bool) error
+	// SetWithTTL stores value like Set and expires it after ttl; ttl <= 0
+	// never expires. Expired entries read as misses and may be replaced
+	// even without overwrite.
+	SetWithTTL(ctx context.Context, key string, value StoredResponse, overwrite bool, ttl time.Duration) error
+	// Scan returns one page of keys selected by options. Pass the returned
+	// cursor back to continue; an empty cursor marks the last page.
+	Scan(ctx context.Context, options ScanOptions) (ScanPage, error)
+	// List returns every key selected by options, ignoring Cursor and Limit.
+	List(ctx context.Context, options ScanOptions) ([]string, error)
+	// Count reports how many keys options selects.
+	Count(ctx context.Context, options ScanOptions) (int, error)
+	// Delete removes keys, together with their response sequences, and
+	// reports how many entries existed.
+	Delete(ctx context.Context, keys ...string) (int, error)
+	// Append adds value to the end of the response sequence at key and
+	// returns the new sequence length. Sequences never expire, whatever
+	// the TTL of the single entry. Sequences are kept apart from the
+	// single entries read by Get and selected by Scan, List and Count.
+	Append(ctx context.Context, key string, value StoredResponse) (int, error)
+	// GetAt returns entry index of the sequence at key along with the
+	// sequence length. found is false when index is out of range.
+	GetAt(ctx context.Context, key string, index int) (StoredResponse, int, bool, error)
 	Close() error
 }
 
+// ScanOptions selects stored keys. Prefix and Pattern combine: a key must
+// start with Prefix and, when Pattern is set, match the glob Pattern as a
+// whole. In Pattern "*" matches any run of characters, "?" any one character
+// and "\" makes the next character literal; every other character, "["
+// included, matches itself, whatever the backend. Response sequences are
+// never listed.
+type ScanOptions struct {
+	Prefix  string
+	Pattern string
+	// Cursor continues a previous Scan; empty starts from the beginning.
+	Cursor string
+	// Limit is a page size hint for Scan; zero uses defaultScanLimit.
+	Limit int
+}
+
+// ScanPage is one page of a Scan. Cursor is empty on the last page.
+type ScanPage struct {
+	Keys   []string
+	Cursor string
+}
+
+func (o ScanOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultScanLimit
+	}
+	return o.Limit
+}
+
+// matches reports whether key is selected by the prefix and pattern.
+func (o ScanOptions) matches(key string) bool {
+	if !strings.HasPrefix(key, o.Prefix) {
+		return false
+	}
+	return o.Pattern == "" || match.Match(key, o.Pattern)
+}
+
 func encodeStoredResponse(response StoredResponse) ([]byte, error) {
 	return json.Marshal(response)
 }
@@ -17,6 +17,34 @@ type RequestMatch struct {
 	BodyContains string            `json:"body_contains"`
 }
 
+// RuleMatch selects the requests a plugin rule applies to: those its Match
+// selects while the rule is enabled. Rules embed it so that every plugin
+// filters them alike.
+type RuleMatch struct {
+	Name   string       `json:"name"`
+	Enable bool         `json:"enable"`
+	Match  RequestMatch `json:"match"`
+}
+
+func (r *RuleMatch) selects(ctx *RequestContext) bool {
+	return r.Enable && r.Match.matches(ctx)
+}
+
+// matchingRules returns the rules that select ctx, in order. Nil rules are
+// skipped.
+func matchingRules[R any, P interface {
+	*R
+	selects(*RequestContext) bool
+}](rules []P, ctx *RequestContext) []P {
+	var matching []P
+	for _, rule := range rules {
+		if rule != nil && rule.selects(ctx) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
 func (m RequestMatch) matches(ctx *RequestContext) bool {
 	if ctx == nil || ctx.Request == nil {
 		return false
@@ -71,8 +99,6 @@ func canonicalRequestURL(req *http.Request) string {
 	if req == nil || req.URL == nil {
 		return ""
 	}
-	host := requestHost(req)
-	scheme := requestScheme(req)
 	path := req.URL.Path
 	query := req.URL.RawQuery
 	if query != "" {
@@ -80,14 +106,17 @@ func canonicalRequestURL(req *http.Request) string {
 			query = sorted
 		}
 	}
-	if host == "" {
-		if query == "" {
-			return path
-		}
-		return path + "?" + query
-	}
 	if query == "" {
-		return scheme + "://" + host + path
+		return requestOrigin(req) + path
+	}
+	return requestOrigin(req) + path + "?" + query
+}
+
+// requestOrigin returns scheme://host for req, or "" when the host is unknown.
+func requestOrigin(req *http.Request) string {
+	host := requestHost(req)
+	if host == "" {
+		return ""
 	}
-	return scheme + "://" + host + path + "?" + query
+	return requestScheme(req) + "://" + host
 }
@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Route attaches a plugin chain to the requests its Match selects. A Route
+// sits in a chain like any plugin: for a matching request its plugins run in
+// its place, for any other request it is skipped. Routes are resolved once
+// per request, against the request as the client sent it, so a plugin that
+// rewrites the request does not move it to another route.
+type Route struct {
+	BasePlugin
+	Match   RequestMatch
+	Plugins []Plugin
+
+	// settings guards Match against a reload swapping it while requests
+	// are routed.
+	settings sync.RWMutex
+}
+
+// NewRoute returns a route running plugins for the requests match selects.
+// An empty match selects every request.
+func NewRoute(match RequestMatch, plugins ...Plugin) *Route {
+	return &Route{BasePlugin: BasePlugin{PluginName: "route"}, Match: match, Plugins: plugins}
+}
+
+func (r *Route) matches(ctx *RequestContext) bool {
+	r.settings.RLock()
+	defer r.settings.RUnlock()
+	return r.Match.matches(ctx)
+}
+
+// Init initializes the route's plugins.
+func (r *Route) Init() error {
+	return InitPlugins(r.Plugins)
+}
+
+// Close closes the route's plugins.
+func (r *Route) Close() error {
+	return ClosePlugins(r.Plugins)
+}
+
+// swapSettings takes over the match of next; ReloadPlugins reloads the
+// route's plugins one by one.
+func (r *Route) swapSettings(next Plugin) error {
+	loaded, ok := next.(*Route)
+	if !ok {
+		return fmt.Errorf("cannot reload %s from %T", r.Name(), next)
+	}
+	r.settings.Lock()
+	defer r.settings.Unlock()
+	r.Match = loaded.Match
+	return nil
+}
+
+// switchable is implemented by plugins whose settings can turn them off.
+// The chain leaves them out while they are off, so their hooks need not check.
+type switchable interface {
+	Plugin
+	enabled() bool
+}
+
+// routePlugins returns the chain that handles ctx: plugins with every Route
+// replaced by its own chain when it matches and dropped when it does not, and
+// without the plugins that are turned off.
+func routePlugins(plugins []Plugin, ctx *RequestContext) []Plugin {
+	routed := make([]Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		switch plugin := plugin.(type) {
+		case *Route:
+			if plugin.matches(ctx) {
+				routed = append(routed, routePlugins(plugin.Plugins, ctx)...)
+			}
+		case switchable:
+			if plugin.enabled() {
+				routed = append(routed, plugin)
+			}
+		default:
+			routed = append(routed, plugin)
+		}
+	}
+	return routed
+}
+
+// allPlugins returns plugins with every Route replaced by its own chain,
+// whatever it matches.
+func allPlugins(plugins []Plugin) []Plugin {
+	if !hasRoutes(plugins) {
+		return plugins
+	}
+	all := make([]Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		if route, ok := plugin.(*Route); ok {
+			all = append(all, allPlugins(route.Plugins)...)
+			continue
+		}
+		all = append(all, plugin)
+	}
+	return all
+}
+
+func hasRoutes(plugins []Plugin) bool {
+	for _, plugin := range plugins {
+		if _, ok := plugin.(*Route); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutePlugins(t *testing.T) {
+	first := testPlugin{name: "first"}
+	payments := testPlugin{name: "payments"}
+	posts := testPlugin{name: "posts"}
+	last := testPlugin{name: "last"}
+	plugins := []Plugin{
+		first,
+		NewRoute(RequestMatch{Path: "/api/payments/*"},
+			payments,
+			NewRoute(RequestMatch{Method: []string{http.MethodPost}}, posts),
+		),
+		last,
+	}
+
+	chain := func(method, target string) string {
+		ctx := &RequestContext{Request: httptest.NewRequest(method, target, nil)}
+		var names []string
+		for _, plugin := range routePlugins(plugins, ctx) {
+			names = append(names, plugin.Name())
+		}
+		return strings.Join(names, ",")
+	}
+	if got := chain(http.MethodGet, "http://example.com/api/users"); got != "first,last" {
+		t.Fatalf("unexpected chain for an unrouted request: %s", got)
+	}
+	if got := chain(http.MethodGet, "http://example.com/api/payments/7"); got != "first,payments,last" {
+		t.Fatalf("unexpected chain for a routed request: %s", got)
+	}
+	if got := chain(http.MethodPost, "http://example.com/api/payments/7"); got != "first,payments,posts,last" {
+		t.Fatalf("unexpected chain for a nested route: %s", got)
+	}
+	if got := len(allPlugins(plugins)); got != 4 {
+		t.Fatalf("expected every routed plugin, got %d", got)
+	}
+}
+
+func TestRoutePluginsSkipsDisabledPlugins(t *testing.T) {
+	record := NewRecordPlugin()
+	replay := NewReplayPlugin()
+	replay.Enable = false
+	plugins := []Plugin{replay, NewRoute(RequestMatch{}, record)}
+
+	ctx := &RequestContext{Request: httptest.NewRequest(http.MethodGet, "http://example.com/", nil)}
+	chain := routePlugins(plugins, ctx)
+	if len(chain) != 1 || chain[0] != record {
+		t.Fatalf("expected only the enabled plugin, got %v", chain)
+	}
+
+	if err := replay.swapSettings(NewReplayPlugin()); err != nil {
+		t.Fatalf("swapSettings: %v", err)
+	}
+	if chain := routePlugins(plugins, ctx); len(chain) != 2 {
+		t.Fatalf("expected the reloaded plugin back in the chain, got %d plugins", len(chain))
+	}
+}
+
+func TestServerRoutesPlugins(t *testing.T) {
+	var dumped []string
+	dump := testPlugin{
+		name: "dump",
+		onResponse: func(ctx *RequestContext, _ *StoredResponse) error {
+			dumped = append(dumped, ctx.Request.URL.Path)
+			return nil
+		},
+	}
+	reply := testPlugin{
+		name: "reply",
+		onRequest: func(ctx *RequestContext) error {
+			ctx.Response = &StoredResponse{StatusCode: http.StatusOK}
+			return nil
+		},
+	}
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+		Plugins: []Plugin{
+			reply,
+			NewRoute(RequestMatch{Path: "/api/payments/*"}, dump),
+		},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, path := range []string{"/api/payments/1", "/api/users/1", "/api/payments/2"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if got := strings.Join(dumped, ","); got != "/api/payments/1,/api/payments/2" {
+		t.Fatalf("unexpected dumped requests: %s", got)
+	}
+}
+
+func TestRouteFromConfigReloads(t *testing.T) {
+	declare := func(path, host string) []PluginConfig {
+		var configs []PluginConfig
+		raw := `[
+			{"type": "route", "settings": {
+				"match": {"path": "` + path + `"},
+				"plugins": [
+					{"type": "decoder"},
+					{"type": "map-remote", "settings": {"items": [{"enable": true, "from": {"path": "/a"}, "to": {"host": "` + host + `"}}]}}
+				]
+			}}
+		]`
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		return configs
+	}
+	plugins, err := NewPluginsFromConfig(declare("/a", "a.example.com"))
+	if err != nil {
+		t.Fatalf("NewPluginsFromConfig: %v", err)
+	}
+	route := plugins[0].(*Route)
+	mapRemote := route.Plugins[1].(*MapRemote)
+
+	if err := ReloadPlugins(plugins, declare("/b", "b.example.com")); err != nil {
+		t.Fatalf("ReloadPlugins: %v", err)
+	}
+	if route.Match.Path != "/b" || mapRemote.Items[0].To.Host != "b.example.com" {
+		t.Fatalf("expected the route and its plugins to reload: %#v %#v", route.Match, mapRemote.Items[0].To)
+	}
+
+	broken := declare("/c", "c.example.com")
+	broken[0].Settings = json.RawMessage(`{"match": {"path": "/c"}, "plugins": [{"type": "decoder"}]}`)
+	if err := ReloadPlugins(plugins, broken); err == nil {
+		t.Fatalf("expected a changed route chain to be rejected")
+	}
+	if route.Match.Path != "/b" {
+		t.Fatalf("expected the previous match to stay active: %#v", route.Match)
+	}
+
+	if files := RuleFiles([]PluginConfig{{Type: "route", Settings: json.RawMessage(`{"plugins": [{"type": "record", "file": "record.yaml"}]}`)}}); len(files) != 1 || files[0] != "record.yaml" {
+		t.Fatalf("unexpected rule files: %v", files)
+	}
+}
+
+func TestRouteLifecycle(t *testing.T) {
+	var steps []string
+	route := NewRoute(RequestMatch{Host: "example.com"},
+		&lifecyclePlugin{BasePlugin: BasePlugin{PluginName: "inner"}, steps: &steps},
+	)
+	if err := InitPlugins([]Plugin{route}); err != nil {
+		t.Fatalf("InitPlugins: %v", err)
+	}
+	if err := ClosePlugins([]Plugin{route}); err != nil {
+		t.Fatalf("ClosePlugins: %v", err)
+	}
+	if got := strings.Join(steps, ","); got != "init inner,close inner" {
+		t.Fatalf("unexpected steps: %s", got)
+	}
+}
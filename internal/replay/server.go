@@ -1,6 +1,9 @@
 package replay
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 
@@ -13,13 +16,89 @@ type ServerOptions struct {
 	Upstream        *UpstreamClient
 	RecordMiss      bool
 	RecordOverwrite bool
-	Plugins         []Plugin
+	// Plugins is the chain every request passes through. A Route in it
+	// runs its own chain only for the requests it matches. NewReplayRouter
+	// initializes them and its close function closes them.
+	Plugins []Plugin
+	// ForwardProxy accepts absolute-form requests from HTTP_PROXY clients.
+	// Each request is fetched from its own origin. Pair it with a
+	// KeySchemeHost policy so that requests to different hosts get
+	// different keys.
+	ForwardProxy bool
+	// KeyPolicy controls key building; nil keys by path only. Importers
+	// filling the repository must use the same policy.
+	KeyPolicy *KeyPolicy
+	// CertAuthority enables HTTPS interception of CONNECT tunnels in
+	// forward-proxy mode. Without it tunnels are relayed untouched.
+	CertAuthority *CertAuthority
+	// AdminPrefix reserves a path prefix such as "/_admin" for the admin API.
+	// Requests under it are never replayed or forwarded.
+	AdminPrefix string
+	// StreamResponses sends upstream responses to the client as they
+	// arrive instead of buffering them. Response plugins then run after
+	// the body was sent, so their changes only affect what is recorded.
+	StreamResponses bool
+	// MaxRecordBodySize bounds the streamed bodies that are recorded;
+	// larger responses are passed through without being stored. Zero uses
+	// DefaultMaxRecordBodySize. It also bounds recorded event streams.
+	MaxRecordBodySize int64
+	// EventTimeScale multiplies the recorded spacing of server-sent events
+	// on replay: zero or 1 keeps the original timing, 0.5 replays twice as
+	// fast, and a negative value sends every event without delay.
+	EventTimeScale float64
+	// WebSocketReplay picks how replayed WebSocket connections answer client
+	// messages: WebSocketOrdered (the default) or WebSocketMatch.
+	WebSocketReplay string
+	// H2C accepts cleartext HTTP/2, as gRPC clients without TLS use, on
+	// the listener returned by the router's Handler. HTTP/2 over TLS needs
+	// no option.
+	H2C bool
 }
 
-func NewReplayRouter(repository Repository, options ServerOptions) *gin.Engine {
+func (o ServerOptions) eventTimeScale() float64 {
+	if o.EventTimeScale == 0 {
+		return 1
+	}
+	return o.EventTimeScale
+}
+
+func (o ServerOptions) maxRecordBodySize() int64 {
+	if o.MaxRecordBodySize <= 0 {
+		return DefaultMaxRecordBodySize
+	}
+	return o.MaxRecordBodySize
+}
+
+// NewReplayRouter serves requests from repository through the plugin chain,
+// fetching misses from the upstream. It initializes options.Plugins first and
+// fails when one of them does. Call close once the server has stopped: it
+// waits for background refreshes and closes the plugins, so dumper files are
+// flushed.
+func NewReplayRouter(repository Repository, options ServerOptions) (*gin.Engine, func() error, error) {
+	if err := InitPlugins(options.Plugins); err != nil {
+		return nil, nil, err
+	}
+	closePlugins := func() error {
+		return ClosePlugins(options.Plugins)
+	}
+
+	keyPolicy := options.KeyPolicy
+	var flights flightGroup
 	router := gin.Default()
+	router.UseH2C = options.H2C
+	if options.AdminPrefix != "" {
+		admin := NewAdminRouter(repository, AdminOptions{
+			KeyPrefix: options.KeyPrefix,
+			BasePath:  options.AdminPrefix,
+			Plugins:   options.Plugins,
+		})
+		router.Use(adminHandler(options.AdminPrefix, admin))
+	}
+	if options.ForwardProxy {
+		router.Use(connectHandler(router, options.CertAuthority))
+	}
 	router.Any("/*any", func(c *gin.Context) {
-		flowReq, readErr := readFlowRequest(c.Request)
+		flowReq, readErr := readFlowRequest(c.Request, keyPolicy)
 		if readErr != nil {
 			log.Printf("read request: %v", readErr)
 			c.Status(http.StatusBadRequest)
@@ -31,20 +110,23 @@ func NewReplayRouter(repository Repository, options ServerOptions) *gin.Engine {
 			Body:       flowReq.body,
 			Key:        flowReq.key,
 			KeyPrefix:  options.KeyPrefix,
+			KeyPolicy:  keyPolicy,
 			Repository: repository,
+			Upstream:   options.Upstream,
 		}
-		if pluginErr := applyRequestPlugins(options.Plugins, ctx); pluginErr != nil {
+		ctx.plugins = routePlugins(options.Plugins, ctx)
+		if pluginErr := applyRequestPlugins(ctx.plugins, ctx); pluginErr != nil {
 			log.Printf("request plugin failed: %v", pluginErr)
 			c.Status(statusFromPluginError(pluginErr))
 			return
 		}
 		if ctx.Response != nil {
-			if pluginErr := applyResponsePlugins(options.Plugins, ctx, ctx.Response); pluginErr != nil {
+			if pluginErr := applyResponsePlugins(ctx.plugins, ctx, ctx.Response); pluginErr != nil {
 				log.Printf("response plugin failed: %v", pluginErr)
 				c.Status(statusFromPluginError(pluginErr))
 				return
 			}
-			if writeErr := writeStoredResponse(c.Writer, *ctx.Response); writeErr != nil {
+			if writeErr := options.writeResponse(c, *ctx.Response); writeErr != nil {
 				log.Printf("write response failed: %v", writeErr)
 			}
 			return
@@ -54,23 +136,127 @@ func NewReplayRouter(repository Repository, options ServerOptions) *gin.Engine {
 			c.Status(http.StatusNotFound)
 			return
 		}
-
-		resp, respBody, fetchErr := options.Upstream.Fetch(c.Request.Context(), ctx.Request, ctx.Body)
-		if fetchErr != nil {
-			log.Printf("upstream fetch failed: %v", fetchErr)
-			c.Status(http.StatusBadGateway)
+		if isWebSocketUpgrade(c.Request) {
+			proxyWebSocket(c, options, ctx)
 			return
 		}
+		serveUpstream(c, &flights, options, ctx)
+	})
+	return router, closePlugins, nil
+}
+
+// serveUpstream fetches a cache miss and sends it to the client. Buffered
+// responses pass through the response plugins before they are written;
+// streamed responses and event streams reach the client as they arrive and
+// the plugins only shape the recording. The upstream timeout covers the whole
+// of a buffered response but only the headers of a streamed one.
+//
+// Concurrent misses on the same key share one fetch: followers wait for the
+// leader's response, skip storing it, and fetch on their own when the
+// leader's streamed response could not be recorded. Event streams release
+// the followers as soon as their headers arrive, so every subscriber gets
+// the stream live. Requests whose replay rules bypass the cache are always
+// fetched.
+func serveUpstream(c *gin.Context, flights *flightGroup, options ServerOptions, ctx *RequestContext) {
+	limit := options.maxRecordBodySize()
+	wrote := false
+	fetch := func(fetchCtx context.Context) (StoredResponse, error) {
+		resp, err := options.Upstream.fetchFor(fetchCtx, ctx)
+		if err != nil {
+			return StoredResponse{}, err
+		}
+		if isEventStream(resp.Header) {
+			if !ctx.SkipCache {
+				flights.release(ctx.KeyPrefix + ctx.Key)
+			}
+			// Once released, the stream serves this client only, so
+			// it ends when the client goes away.
+			streamBody(c.Request.Context(), resp)
+			wrote = true
+			return streamEvents(c.Writer, resp, limit)
+		}
+		if options.StreamResponses {
+			// Followers of a stream its client abandoned fetch on
+			// their own.
+			streamBody(c.Request.Context(), resp)
+			wrote = true
+			return streamResponse(c.Writer, resp, limit)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return StoredResponse{}, err
+		}
+		return storedResponseFromHTTP(resp, body), nil
+	}
+
+	var stored StoredResponse
+	var err error
+	shared := false
+	if ctx.SkipCache {
+		stored, err = fetch(c.Request.Context())
+	} else {
+		stored, shared, err = flights.do(c.Request.Context(), ctx.KeyPrefix+ctx.Key, func() (StoredResponse, error) {
+			// Followers depend on this fetch, so the leader's client
+			// going away must not cancel it.
+			return fetch(context.WithoutCancel(c.Request.Context()))
+		})
+		if shared && errors.Is(err, errNotRecorded) {
+			shared = false
+			stored, err = fetch(c.Request.Context())
+		}
+	}
+
+	switch {
+	case err != nil && isPluginError(err):
+		log.Printf("upstream request plugin failed: %v", err)
+		c.Status(statusFromPluginError(err))
+		return
+	case err != nil && !wrote:
+		log.Printf("upstream fetch failed: %v", err)
+		c.Status(http.StatusBadGateway)
+		return
+	case err != nil:
+		log.Printf("stream %s: %v", ctx.KeyPrefix+ctx.Key, err)
+		return
+	}
+	if shared {
+		ctx.SkipStore = true
+	}
 
-		stored := storedResponseFromHTTP(resp, respBody)
-		if pluginErr := applyResponsePlugins(options.Plugins, ctx, &stored); pluginErr != nil {
+	pluginErr := applyResponsePlugins(ctx.plugins, ctx, &stored)
+	if wrote {
+		// The client already has the response.
+		if pluginErr != nil {
 			log.Printf("response plugin failed: %v", pluginErr)
-			c.Status(statusFromPluginError(pluginErr))
-			return
 		}
-		if writeErr := writeStoredResponse(c.Writer, stored); writeErr != nil {
-			log.Printf("write response failed: %v", writeErr)
+		return
+	}
+	if pluginErr != nil {
+		log.Printf("response plugin failed: %v", pluginErr)
+		c.Status(statusFromPluginError(pluginErr))
+		return
+	}
+	if writeErr := options.writeResponse(c, stored); writeErr != nil {
+		log.Printf("write response failed: %v", writeErr)
+	}
+}
+
+// writeResponse writes a stored or fetched response, replaying recorded
+// events with their original spacing scaled by EventTimeScale. Recorded
+// WebSocket handshakes are replayed as a connection and refused to clients
+// that did not ask for an upgrade.
+func (o ServerOptions) writeResponse(c *gin.Context, stored StoredResponse) error {
+	if stored.StatusCode == http.StatusSwitchingProtocols {
+		if !isWebSocketUpgrade(c.Request) {
+			c.Header("Upgrade", "websocket")
+			c.Status(http.StatusUpgradeRequired)
+			return nil
 		}
-	})
-	return router
+		return replayWebSocket(c, stored, o.WebSocketReplay)
+	}
+	if len(stored.Events) > 0 {
+		return writeStoredEvents(c.Request.Context(), c.Writer, stored, o.eventTimeScale())
+	}
+	return writeStoredResponse(c.Writer, stored)
 }
@@ -8,37 +8,153 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
+// memoryRepo is a Repository for tests. Its methods are safe for the
+// background refreshes; tests read the maps directly once traffic is done.
 type memoryRepo struct {
+	mu         sync.Mutex
 	data       map[string]StoredResponse
+	expires    map[string]time.Time
+	sequences  map[string][]StoredResponse
 	getCalls   int
 	setCalls   int
 	closeCalls int
 }
 
+// newTestRouter builds a router whose plugins are closed when the test ends.
+func newTestRouter(t *testing.T, repository Repository, options ServerOptions) *gin.Engine {
+	t.Helper()
+	router, closePlugins, err := NewReplayRouter(repository, options)
+	if err != nil {
+		t.Fatalf("NewReplayRouter: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := closePlugins(); err != nil {
+			t.Errorf("close plugins: %v", err)
+		}
+	})
+	return router
+}
+
 func newMemoryRepo() *memoryRepo {
-	return &memoryRepo{data: make(map[string]StoredResponse)}
+	return &memoryRepo{
+		data:      make(map[string]StoredResponse),
+		expires:   make(map[string]time.Time),
+		sequences: make(map[string][]StoredResponse),
+	}
 }
 
 func (m *memoryRepo) Get(_ context.Context, key string) (StoredResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.getCalls++
+	if m.expired(key) {
+		return StoredResponse{}, false, nil
+	}
 	value, ok := m.data[key]
 	return value, ok, nil
 }
 
-func (m *memoryRepo) Set(_ context.Context, key string, value StoredResponse, overwrite bool) error {
+func (m *memoryRepo) Set(ctx context.Context, key string, value StoredResponse, overwrite bool) error {
+	return m.SetWithTTL(ctx, key, value, overwrite, 0)
+}
+
+func (m *memoryRepo) SetWithTTL(_ context.Context, key string, value StoredResponse, overwrite bool, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.setCalls++
-	if !overwrite {
+	if !overwrite && !m.expired(key) {
 		if _, ok := m.data[key]; ok {
 			return nil
 		}
 	}
 	m.data[key] = value
+	delete(m.expires, key)
+	if ttl > 0 {
+		m.expires[key] = time.Now().Add(ttl)
+	}
 	return nil
 }
 
+func (m *memoryRepo) expired(key string) bool {
+	expiry, ok := m.expires[key]
+	return ok && !time.Now().Before(expiry)
+}
+
+func (m *memoryRepo) Scan(ctx context.Context, options ScanOptions) (ScanPage, error) {
+	keys, _ := m.List(ctx, options)
+	start := sort.SearchStrings(keys, options.Cursor)
+	if start < len(keys) && keys[start] == options.Cursor {
+		start++
+	}
+	keys = keys[start:]
+	if len(keys) <= options.limit() {
+		return ScanPage{Keys: keys}, nil
+	}
+	keys = keys[:options.limit()]
+	return ScanPage{Keys: keys, Cursor: keys[len(keys)-1]}, nil
+}
+
+func (m *memoryRepo) List(_ context.Context, options ScanOptions) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		if options.matches(key) && !m.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryRepo) Count(ctx context.Context, options ScanOptions) (int, error) {
+	keys, err := m.List(ctx, options)
+	return len(keys), err
+}
+
+func (m *memoryRepo) Delete(_ context.Context, keys ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for _, key := range keys {
+		delete(m.sequences, key)
+		if _, ok := m.data[key]; ok {
+			delete(m.data, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *memoryRepo) Append(_ context.Context, key string, value StoredResponse) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sequences[key] = append(m.sequences[key], value)
+	return len(m.sequences[key]), nil
+}
+
+func (m *memoryRepo) GetAt(_ context.Context, key string, index int) (StoredResponse, int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sequence := m.sequences[key]
+	if index < 0 || index >= len(sequence) {
+		return StoredResponse{}, len(sequence), false, nil
+	}
+	return sequence[index], len(sequence), true, nil
+}
+
 func (m *memoryRepo) Close() error {
 	m.closeCalls++
 	return nil
@@ -46,7 +162,7 @@ func (m *memoryRepo) Close() error {
 
 func TestServerRequestPluginError(t *testing.T) {
 	repo := newMemoryRepo()
-	router := NewReplayRouter(repo, ServerOptions{
+	router := newTestRouter(t, repo, ServerOptions{
 		Plugins: []Plugin{
 			testPlugin{
 				name: "fail",
@@ -70,10 +186,68 @@ func TestServerRequestPluginError(t *testing.T) {
 	}
 }
 
+// signingPlugin sets a header on outgoing upstream requests, or fails them
+// when err is set.
+type signingPlugin struct {
+	BasePlugin
+	err error
+}
+
+func (p signingPlugin) OnUpstreamRequest(ctx *RequestContext, req *http.Request) error {
+	if p.err != nil {
+		return p.err
+	}
+	req.Header.Set("X-Signature", req.Method+" "+req.URL.Path+" "+string(ctx.Body))
+	return nil
+}
+
+func TestServerUpstreamRequestPlugin(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		_, _ = w.Write([]byte(r.Header.Get("X-Signature")))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	post := func(plugin signingPlugin) (int, string) {
+		router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+			Upstream: client,
+			Plugins:  []Plugin{plugin},
+		})
+		server := httptest.NewServer(router)
+		defer server.Close()
+		resp, err := http.Post(server.URL+"/orders", "text/plain", strings.NewReader("42"))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		payload, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(payload)
+	}
+
+	if status, body := post(signingPlugin{BasePlugin: BasePlugin{PluginName: "sign"}}); status != http.StatusOK || body != "POST /orders 42" {
+		t.Fatalf("unexpected signed response: %d %q", status, body)
+	}
+	failing := signingPlugin{
+		BasePlugin: BasePlugin{PluginName: "sign"},
+		err:        PluginError{Status: http.StatusUnauthorized, Err: errors.New("no credentials")},
+	}
+	if status, _ := post(failing); status != http.StatusUnauthorized {
+		t.Fatalf("expected the plugin status, got %d", status)
+	}
+	if hits != 1 {
+		t.Fatalf("expected the failed request to stay local, upstream saw %d", hits)
+	}
+}
+
 func TestServerRequestPluginResponse(t *testing.T) {
 	repo := newMemoryRepo()
 	body := base64.StdEncoding.EncodeToString([]byte("ok"))
-	router := NewReplayRouter(repo, ServerOptions{
+	router := newTestRouter(t, repo, ServerOptions{
 		Plugins: []Plugin{
 			testPlugin{
 				name: "short-circuit",
@@ -107,3 +281,147 @@ func TestServerRequestPluginResponse(t *testing.T) {
 		t.Fatalf("expected no repository lookups, got %d", repo.getCalls)
 	}
 }
+
+func TestServerForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from " + r.Host + r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		ForwardProxy: true,
+		KeyPolicy:    NewKeyPolicy(KeySchemeHost),
+		Upstream:     NewProxyUpstreamClient(time.Second),
+		Plugins:      []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL + "/users?b=2&a=1")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	payload, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	if want := "from " + upstreamURL.Host + "/users?b=2&a=1"; string(payload) != want {
+		t.Fatalf("unexpected body: %q want %q", payload, want)
+	}
+	key := upstream.URL + "/users|GET|a=1&b=2"
+	if _, ok := repo.data[key]; !ok {
+		t.Fatalf("expected host-aware key %q, have %v", key, repo.data)
+	}
+
+	upstream.Close()
+	resp, err = client.Get(upstream.URL + "/users?a=1&b=2")
+	if err != nil {
+		t.Fatalf("replay request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected replayed response, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerRefreshesExpiredEntry(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		_, _ = w.Write([]byte("version " + strconv.Itoa(hits)))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	record := NewRecordPlugin()
+	record.TTLSeconds = 60
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), record},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func() string {
+		resp, err := http.Get(server.URL + "/report")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		payload, _ := io.ReadAll(resp.Body)
+		return string(payload)
+	}
+
+	if got := get(); got != "version 1" {
+		t.Fatalf("first request: %q", got)
+	}
+	if got := get(); got != "version 1" {
+		t.Fatalf("expected replay before expiry, got %q", got)
+	}
+	for key := range repo.expires {
+		repo.expires[key] = time.Now().Add(-time.Second)
+	}
+	if got := get(); got != "version 2" {
+		t.Fatalf("expected upstream refresh after expiry, got %q", got)
+	}
+	if got := get(); got != "version 2" {
+		t.Fatalf("expected refreshed entry to replay, got %q", got)
+	}
+}
+
+func TestServerCoalescesConcurrentMisses(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("X-Upstream", "yes")
+		_, _ = w.Write([]byte("cold"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const clients = 10
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL + "/cold")
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			payload, _ := io.ReadAll(resp.Body)
+			if string(payload) != "cold" || resp.Header.Get("X-Upstream") != "yes" {
+				t.Errorf("unexpected response: %q %v", payload, resp.Header)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("upstream fetched %d times, want 1", got)
+	}
+	if repo.setCalls != 1 {
+		t.Fatalf("entry recorded %d times, want 1", repo.setCalls)
+	}
+}
@@ -5,35 +5,69 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqliteDeleteBatch bounds the keys deleted per statement.
+const sqliteDeleteBatch = 500
+
+// SQLiteOptions configures a SQLiteRepository.
+type SQLiteOptions struct {
+	Path string
+	// Timeout is the busy timeout for locked databases.
+	Timeout time.Duration
+	// SweepInterval deletes expired entries in the background; zero leaves
+	// them in place, where Get still treats them as misses.
+	SweepInterval time.Duration
+}
+
+// SQLiteRepository stores entries in flow_items. expires_at holds the expiry
+// in Unix milliseconds, or NULL for entries that never expire.
 type SQLiteRepository struct {
-	db *sql.DB
+	db        *sql.DB
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewSQLiteRepository(path string, timeout time.Duration) (*SQLiteRepository, error) {
-	if path == "" {
+	return NewSQLiteRepositoryWithOptions(SQLiteOptions{Path: path, Timeout: timeout})
+}
+
+func NewSQLiteRepositoryWithOptions(options SQLiteOptions) (*SQLiteRepository, error) {
+	if options.Path == "" {
 		return nil, errors.New("sqlite path is required")
 	}
-	dsn := sqliteDSN(path, timeout)
+	dsn := sqliteDSN(options.Path, options.Timeout)
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
+	if options.Path == ":memory:" {
+		// Every connection would open its own empty in-memory database.
+		db.SetMaxOpenConns(1)
+	}
 	if err := initSQLiteSchema(db); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
-	return &SQLiteRepository{db: db}, nil
+	repo := &SQLiteRepository{db: db, done: make(chan struct{})}
+	if options.SweepInterval > 0 {
+		go repo.sweep(options.SweepInterval)
+	}
+	return repo, nil
 }
 
 func (r *SQLiteRepository) Get(ctx context.Context, key string) (StoredResponse, bool, error) {
 	var payload []byte
-	err := r.db.QueryRowContext(ctx, "SELECT payload FROM flow_items WHERE key = ?", key).Scan(&payload)
+	err := r.db.QueryRowContext(ctx, `
+		SELECT payload FROM flow_items
+		WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)
+	`, key, sqliteNow()).Scan(&payload)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return StoredResponse{}, false, nil
@@ -48,29 +82,261 @@ func (r *SQLiteRepository) Get(ctx context.Context, key string) (StoredResponse,
 }
 
 func (r *SQLiteRepository) Set(ctx context.Context, key string, value StoredResponse, overwrite bool) error {
+	return r.SetWithTTL(ctx, key, value, overwrite, 0)
+}
+
+func (r *SQLiteRepository) SetWithTTL(ctx context.Context, key string, value StoredResponse, overwrite bool, ttl time.Duration) error {
 	payload, err := encodeStoredResponse(value)
 	if err != nil {
 		return err
 	}
+	now := sqliteNow()
+	var expiresAt interface{}
+	if ttl > 0 {
+		expiresAt = now + ttl.Milliseconds()
+	}
 	if overwrite {
 		_, err = r.db.ExecContext(ctx, `
-			INSERT INTO flow_items (key, payload)
-			VALUES (?, ?)
-			ON CONFLICT(key) DO UPDATE SET payload = excluded.payload
-		`, key, payload)
+			INSERT INTO flow_items (key, payload, expires_at)
+			VALUES (?, ?, ?)
+			ON CONFLICT(key) DO UPDATE SET payload = excluded.payload, expires_at = excluded.expires_at
+		`, key, payload, expiresAt)
 		return err
 	}
 	_, err = r.db.ExecContext(ctx, `
-		INSERT OR IGNORE INTO flow_items (key, payload)
-		VALUES (?, ?)
-	`, key, payload)
+		INSERT INTO flow_items (key, payload, expires_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET payload = excluded.payload, expires_at = excluded.expires_at
+		WHERE flow_items.expires_at IS NOT NULL AND flow_items.expires_at <= ?
+	`, key, payload, expiresAt, now)
 	return err
 }
 
+// DeleteExpired removes entries whose TTL has passed and reports how many
+// were removed.
+func (r *SQLiteRepository) DeleteExpired(ctx context.Context) (int, error) {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM flow_items WHERE expires_at <= ?", sqliteNow())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (r *SQLiteRepository) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		deleted, err := r.DeleteExpired(context.Background())
+		if err != nil {
+			log.Printf("sqlite sweep: %v", err)
+			continue
+		}
+		if deleted > 0 {
+			log.Printf("sqlite sweep: removed %d expired entries", deleted)
+		}
+	}
+}
+
+func (r *SQLiteRepository) Scan(ctx context.Context, options ScanOptions) (ScanPage, error) {
+	where, args := sqliteScanFilter(options)
+	limit := options.limit()
+	keys, err := r.queryKeys(ctx, "SELECT key FROM flow_items"+where+" ORDER BY key LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	if len(keys) <= limit {
+		return ScanPage{Keys: keys}, nil
+	}
+	keys = keys[:limit]
+	return ScanPage{Keys: keys, Cursor: keys[limit-1]}, nil
+}
+
+func (r *SQLiteRepository) List(ctx context.Context, options ScanOptions) ([]string, error) {
+	options.Cursor = ""
+	where, args := sqliteScanFilter(options)
+	return r.queryKeys(ctx, "SELECT key FROM flow_items"+where+" ORDER BY key", args...)
+}
+
+func (r *SQLiteRepository) Count(ctx context.Context, options ScanOptions) (int, error) {
+	options.Cursor = ""
+	where, args := sqliteScanFilter(options)
+	var count int
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM flow_items"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (r *SQLiteRepository) queryKeys(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Delete removes keys in batches so large deletes stay under SQLite's bound
+// parameter limit.
+func (r *SQLiteRepository) Delete(ctx context.Context, keys ...string) (int, error) {
+	deleted := 0
+	for start := 0; start < len(keys); start += sqliteDeleteBatch {
+		end := start + sqliteDeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		count, err := r.deleteBatch(ctx, keys[start:end])
+		if err != nil {
+			return deleted, err
+		}
+		deleted += count
+	}
+	return deleted, nil
+}
+
+func (r *SQLiteRepository) deleteBatch(ctx context.Context, keys []string) (int, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keys)), ",")
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM flow_sequences WHERE key IN ("+placeholders+")", args...); err != nil {
+		return 0, err
+	}
+	result, err := r.db.ExecContext(ctx, "DELETE FROM flow_items WHERE key IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (r *SQLiteRepository) Append(ctx context.Context, key string, value StoredResponse) (int, error) {
+	payload, err := encodeStoredResponse(value)
+	if err != nil {
+		return 0, err
+	}
+	var index int
+	err = r.db.QueryRowContext(ctx, `
+		INSERT INTO flow_sequences (key, idx, payload)
+		SELECT ?, COALESCE(MAX(idx) + 1, 0), ? FROM flow_sequences WHERE key = ?
+		RETURNING idx
+	`, key, payload, key).Scan(&index)
+	if err != nil {
+		return 0, err
+	}
+	return index + 1, nil
+}
+
+func (r *SQLiteRepository) GetAt(ctx context.Context, key string, index int) (StoredResponse, int, bool, error) {
+	var length int
+	var payload []byte
+	err := r.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM flow_sequences WHERE key = ?),
+			(SELECT payload FROM flow_sequences WHERE key = ? AND idx = ?)
+	`, key, key, index).Scan(&length, &payload)
+	if err != nil {
+		return StoredResponse{}, 0, false, err
+	}
+	if payload == nil {
+		return StoredResponse{}, length, false, nil
+	}
+	response, err := decodeStoredResponse(payload)
+	if err != nil {
+		return StoredResponse{}, length, false, err
+	}
+	return response, length, true, nil
+}
+
 func (r *SQLiteRepository) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
 	return r.db.Close()
 }
 
+// sqliteScanFilter builds the WHERE clause for options, skipping expired
+// entries. Prefixes become a range on the primary key index instead of a
+// full-table GLOB.
+func sqliteScanFilter(options ScanOptions) (string, []interface{}) {
+	clauses := []string{"(expires_at IS NULL OR expires_at > ?)"}
+	args := []interface{}{sqliteNow()}
+	if options.Prefix != "" {
+		clauses = append(clauses, "key >= ?")
+		args = append(args, options.Prefix)
+		if upper, ok := prefixUpperBound(options.Prefix); ok {
+			clauses = append(clauses, "key < ?")
+			args = append(args, upper)
+		}
+	}
+	if options.Pattern != "" {
+		if pattern, ok := sqliteGlob(options.Pattern); ok {
+			clauses = append(clauses, "key GLOB ?")
+			args = append(args, pattern)
+		} else {
+			clauses = append(clauses, "0")
+		}
+	}
+	if options.Cursor != "" {
+		clauses = append(clauses, "key > ?")
+		args = append(args, options.Cursor)
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+// sqliteGlob turns a ScanOptions pattern into GLOB syntax, where brackets
+// start a character class and a backslash is an ordinary character. ok is
+// false for a pattern ending in a lone backslash, which matches nothing.
+func sqliteGlob(pattern string) (string, bool) {
+	var builder strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped && (r == '*' || r == '?' || r == '['):
+			builder.WriteByte('[')
+			builder.WriteRune(r)
+			builder.WriteByte(']')
+			escaped = false
+		case escaped:
+			builder.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '[':
+			builder.WriteString("[[]")
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String(), !escaped
+}
+
+// prefixUpperBound returns the smallest string greater than every string
+// starting with prefix. ok is false when no such bound exists.
+func prefixUpperBound(prefix string) (string, bool) {
+	upper := []byte(prefix)
+	for len(upper) > 0 && upper[len(upper)-1] == 0xff {
+		upper = upper[:len(upper)-1]
+	}
+	if len(upper) == 0 {
+		return "", false
+	}
+	upper[len(upper)-1]++
+	return string(upper), true
+}
+
 func sqliteDSN(path string, timeout time.Duration) string {
 	if strings.HasPrefix(path, "file:") || path == ":memory:" {
 		return path
@@ -82,12 +348,43 @@ func sqliteDSN(path string, timeout time.Duration) string {
 	return fmt.Sprintf("file:%s?_busy_timeout=%d&_foreign_keys=on", path, busyMillis)
 }
 
+func sqliteNow() int64 {
+	return time.Now().UnixMilli()
+}
+
 func initSQLiteSchema(db *sql.DB) error {
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS flow_items (
 			key TEXT PRIMARY KEY,
-			payload BLOB NOT NULL
+			payload BLOB NOT NULL,
+			expires_at INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS flow_sequences (
+			key TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			payload BLOB NOT NULL,
+			PRIMARY KEY (key, idx)
 		)
 	`)
+	if err != nil {
+		return err
+	}
+	return migrateSQLiteExpiry(db)
+}
+
+// migrateSQLiteExpiry adds expires_at to databases created before entries
+// could expire, and indexes it for the sweeper.
+func migrateSQLiteExpiry(db *sql.DB) error {
+	var columns int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('flow_items') WHERE name = 'expires_at'").Scan(&columns)
+	if err != nil {
+		return err
+	}
+	if columns == 0 {
+		if _, err := db.Exec("ALTER TABLE flow_items ADD COLUMN expires_at INTEGER"); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS flow_items_expires_at ON flow_items (expires_at) WHERE expires_at IS NOT NULL")
 	return err
 }
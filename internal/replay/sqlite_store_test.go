@@ -2,6 +2,9 @@ package replay
 
 import (
 	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,3 +39,287 @@ func TestSQLiteRepositoryEmptyPath(t *testing.T) {
 		t.Fatal("expected error for empty path")
 	}
 }
+
+func TestSQLiteRepositoryListDelete(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	for _, key := range []string{"a:/one|GET|", "a:/two|GET|", "b:/one|GET|"} {
+		if err := repo.Set(ctx, key, StoredResponse{StatusCode: 200}, false); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	keys, err := repo.List(ctx, ScanOptions{Prefix: "a:"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "a:/one|GET|" || keys[1] != "a:/two|GET|" {
+		t.Fatalf("unexpected keys: %#v", keys)
+	}
+	deleted, err := repo.Delete(ctx, "a:/one|GET|", "missing")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("unexpected delete count: %d", deleted)
+	}
+	if _, found, _ := repo.Get(ctx, "a:/one|GET|"); found {
+		t.Fatal("expected key to be deleted")
+	}
+}
+
+func TestSQLiteRepositorySequence(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	key := "/jobs/1|GET|"
+	for i, status := range []int{202, 200} {
+		length, err := repo.Append(ctx, key, StoredResponse{StatusCode: status})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if length != i+1 {
+			t.Fatalf("unexpected length: %d", length)
+		}
+	}
+
+	stored, length, found, err := repo.GetAt(ctx, key, 1)
+	if err != nil || !found || length != 2 || stored.StatusCode != 200 {
+		t.Fatalf("unexpected GetAt: %#v %d %v %v", stored, length, found, err)
+	}
+	if _, length, found, _ := repo.GetAt(ctx, key, 2); found || length != 2 {
+		t.Fatalf("expected out of range, got %d %v", length, found)
+	}
+	if _, found, _ := repo.Get(ctx, key); found {
+		t.Fatal("sequence should not create a single entry")
+	}
+
+	if _, err := repo.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, length, _, _ := repo.GetAt(ctx, key, 0); length != 0 {
+		t.Fatalf("expected sequence to be deleted, length %d", length)
+	}
+}
+
+func TestSQLiteRepositoryScan(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	for _, key := range []string{"a:/1|GET|", "a:/2|GET|", "a:/3|POST|", "a;/4|GET|", "b:/1|GET|"} {
+		if err := repo.Set(ctx, key, StoredResponse{StatusCode: 200}, false); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	options := ScanOptions{Prefix: "a:", Limit: 2}
+	var scanned []string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("scan did not terminate")
+		}
+		page, err := repo.Scan(ctx, options)
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		scanned = append(scanned, page.Keys...)
+		if page.Cursor == "" {
+			break
+		}
+		options.Cursor = page.Cursor
+	}
+	if strings.Join(scanned, ",") != "a:/1|GET|,a:/2|GET|,a:/3|POST|" {
+		t.Fatalf("unexpected scan: %#v", scanned)
+	}
+
+	count, err := repo.Count(ctx, ScanOptions{Prefix: "a:", Pattern: "*|GET|"})
+	if err != nil || count != 2 {
+		t.Fatalf("unexpected count: %d %v", count, err)
+	}
+	if total, _ := repo.Count(ctx, ScanOptions{}); total != 5 {
+		t.Fatalf("unexpected total: %d", total)
+	}
+}
+
+func TestSQLiteRepositoryPatternSyntax(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	for _, key := range []string{"/a[1]x", "/a1x", "/b*", "/bb", `/c\d`} {
+		if err := repo.Set(ctx, key, StoredResponse{StatusCode: 200}, false); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	cases := map[string]string{
+		"/a[1]*": "/a[1]x",
+		`/b\*`:   "/b*",
+		`/c\\d`:  `/c\d`,
+		`/b\`:    "",
+	}
+	for pattern, want := range cases {
+		keys, err := repo.List(ctx, ScanOptions{Pattern: pattern})
+		if err != nil {
+			t.Fatalf("List %q: %v", pattern, err)
+		}
+		if got := strings.Join(keys, ","); got != want {
+			t.Fatalf("pattern %q selected %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	if upper, ok := prefixUpperBound("a:"); !ok || upper != "a;" {
+		t.Fatalf("unexpected bound: %q %v", upper, ok)
+	}
+	if upper, ok := prefixUpperBound("a\xff"); !ok || upper != "b" {
+		t.Fatalf("unexpected bound: %q %v", upper, ok)
+	}
+	if _, ok := prefixUpperBound("\xff"); ok {
+		t.Fatal("expected no bound for all 0xff prefix")
+	}
+}
+
+func TestSQLiteRepositoryTTL(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.SetWithTTL(ctx, "short", StoredResponse{StatusCode: 200}, false, 50*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if err := repo.SetWithTTL(ctx, "long", StoredResponse{StatusCode: 200}, false, time.Hour); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	if _, found, _ := repo.Get(ctx, "short"); !found {
+		t.Fatal("expected entry before expiry")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if _, found, err := repo.Get(ctx, "short"); err != nil || found {
+		t.Fatalf("expected expired entry to miss: %v %v", found, err)
+	}
+	if count, _ := repo.Count(ctx, ScanOptions{}); count != 1 {
+		t.Fatalf("expired entries should not be counted, got %d", count)
+	}
+
+	// Without overwrite an expired entry is still replaced.
+	if err := repo.Set(ctx, "short", StoredResponse{StatusCode: 201}, false); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if stored, found, _ := repo.Get(ctx, "short"); !found || stored.StatusCode != 201 {
+		t.Fatalf("expected refreshed entry, got %#v %v", stored, found)
+	}
+	if err := repo.Set(ctx, "long", StoredResponse{StatusCode: 500}, false); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if stored, _, _ := repo.Get(ctx, "long"); stored.StatusCode != 200 {
+		t.Fatalf("live entry was replaced without overwrite: %#v", stored)
+	}
+}
+
+func TestSQLiteRepositorySweeper(t *testing.T) {
+	repo, err := NewSQLiteRepositoryWithOptions(SQLiteOptions{
+		Path:          ":memory:",
+		Timeout:       2 * time.Second,
+		SweepInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSQLiteRepositoryWithOptions: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+
+	ctx := context.Background()
+	if err := repo.SetWithTTL(ctx, "gone", StoredResponse{StatusCode: 200}, false, time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var rows int
+		if err := repo.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM flow_items").Scan(&rows); err != nil {
+			t.Fatalf("count rows: %v", err)
+		}
+		if rows == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sweeper did not remove the expired entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSQLiteRepositoryCloseTwice(t *testing.T) {
+	repo, err := NewSQLiteRepository(":memory:", time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestSQLiteRepositoryMigratesExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE flow_items (key TEXT PRIMARY KEY, payload BLOB NOT NULL);
+		INSERT INTO flow_items (key, payload) VALUES ('old', '{"status_code":200,"headers":[],"body_base64":""}')
+	`)
+	_ = db.Close()
+	if err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+
+	repo, err := NewSQLiteRepository(path, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	ctx := context.Background()
+	if _, found, err := repo.Get(ctx, "old"); err != nil || !found {
+		t.Fatalf("existing entry lost in migration: %v %v", found, err)
+	}
+	if err := repo.SetWithTTL(ctx, "new", StoredResponse{StatusCode: 200}, false, time.Hour); err != nil {
+		t.Fatalf("SetWithTTL after migration: %v", err)
+	}
+}
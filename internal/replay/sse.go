@@ -0,0 +1,106 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// streamEvents relays an event stream to w one event at a time and records
+// each event with its offset from the start of the response. Streams larger
+// than limit are relayed without being recorded.
+func streamEvents(w http.ResponseWriter, resp *http.Response, limit int64) (StoredResponse, error) {
+	defer resp.Body.Close()
+	writeStoredHeaders(w, storedResponseFromHTTP(resp, nil))
+	flush(w)
+
+	start := time.Now()
+	reader := bufio.NewReader(resp.Body)
+	var events []StoredEvent
+	var size int64
+	overflow := false
+	var block []byte
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		block = append(block, line...)
+		endOfEvent := len(block) > 0 && (isBlankLine(line) || readErr != nil)
+		if endOfEvent {
+			if _, err := w.Write(block); err != nil {
+				return StoredResponse{}, fmt.Errorf("%w: %v", errNotRecorded, err)
+			}
+			flush(w)
+			size += int64(len(block))
+			if size > limit {
+				overflow, events = true, nil
+			}
+			if !overflow {
+				events = append(events, StoredEvent{
+					OffsetMillis: time.Since(start).Milliseconds(),
+					Data:         string(block),
+				})
+			}
+			block = nil
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return StoredResponse{}, fmt.Errorf("%w: %v", errNotRecorded, readErr)
+		}
+	}
+	if overflow {
+		return StoredResponse{}, fmt.Errorf("%w: event stream over %d bytes", errNotRecorded, limit)
+	}
+
+	stored := storedResponseFromHTTP(resp, nil)
+	stored.Events = events
+	return stored, nil
+}
+
+// writeStoredEvents replays recorded events, waiting for each event's offset
+// multiplied by scale. A negative scale sends the events without delay.
+func writeStoredEvents(ctx context.Context, w http.ResponseWriter, stored StoredResponse, scale float64) error {
+	writeStoredHeaders(w, stored)
+	flush(w)
+
+	start := time.Now()
+	for _, event := range stored.Events {
+		if scale >= 0 {
+			due := start.Add(time.Duration(float64(event.OffsetMillis) * scale * float64(time.Millisecond)))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		if _, err := io.WriteString(w, event.Data); err != nil {
+			return err
+		}
+		flush(w)
+	}
+	return nil
+}
+
+func isBlankLine(line []byte) bool {
+	return string(line) == "\n" || string(line) == "\r\n"
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
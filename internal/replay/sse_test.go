@@ -0,0 +1,231 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads one event, up to and including its blank line.
+func readEvent(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	var event strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v (got %q)", err, event.String())
+		}
+		event.WriteString(line)
+		if line == "\n" {
+			return event.String()
+		}
+	}
+}
+
+func TestServerRecordsEventStream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		_, _ = w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("event: done\ndata: two\n\n"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	// The first event is relayed before the upstream sends the second.
+	if got := readEvent(t, reader); got != "data: one\n\n" {
+		t.Fatalf("first event: %q", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if got := readEvent(t, reader); got != "event: done\ndata: two\n\n" {
+		t.Fatalf("second event: %q", got)
+	}
+
+	stored, found, _ := repo.Get(context.Background(), "/events|GET|")
+	if !found || len(stored.Events) != 2 {
+		t.Fatalf("expected two recorded events, got %#v", stored)
+	}
+	if gap := stored.Events[1].OffsetMillis - stored.Events[0].OffsetMillis; gap < 100 {
+		t.Fatalf("recorded spacing %dms, want at least 100ms", gap)
+	}
+	if stored.BodyBase64 != "" {
+		t.Fatalf("events should not also be stored as a body")
+	}
+}
+
+func TestServerReplaysEventTiming(t *testing.T) {
+	repo := newMemoryRepo()
+	repo.data["/events|GET|"] = StoredResponse{
+		StatusCode: http.StatusOK,
+		Headers:    []Header{{Key: "Content-Type", Value: "text/event-stream"}},
+		Events: []StoredEvent{
+			{OffsetMillis: 0, Data: "data: a\n\n"},
+			{OffsetMillis: 400, Data: "data: b\n\n"},
+		},
+	}
+
+	for _, tc := range []struct {
+		scale    float64
+		min, max time.Duration
+	}{
+		{scale: 0.25, min: 80 * time.Millisecond, max: 300 * time.Millisecond},
+		{scale: -1, min: 0, max: 80 * time.Millisecond},
+	} {
+		router := newTestRouter(t, repo, ServerOptions{
+			EventTimeScale: tc.scale,
+			Plugins:        []Plugin{NewReplayPlugin()},
+		})
+		server := httptest.NewServer(router)
+
+		resp, err := http.Get(server.URL + "/events")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		reader := bufio.NewReader(resp.Body)
+		if got := readEvent(t, reader); got != "data: a\n\n" {
+			t.Fatalf("first event: %q", got)
+		}
+		first := time.Now()
+		if got := readEvent(t, reader); got != "data: b\n\n" {
+			t.Fatalf("second event: %q", got)
+		}
+		gap := time.Since(first)
+		resp.Body.Close()
+		server.Close()
+
+		if gap < tc.min || gap > tc.max {
+			t.Fatalf("scale %v: events %v apart, want %v-%v", tc.scale, gap, tc.min, tc.max)
+		}
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestServerEventStreamSubscribersAreNotCoalesced(t *testing.T) {
+	arrived := make(chan struct{}, 2)
+	headers := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-headers
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	// Both streams must end before the servers can close.
+	defer close(release)
+
+	firstEvents := make(chan string, 2)
+	subscribe := func() {
+		resp, err := http.Get(server.URL + "/notifications")
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		firstEvents <- line
+	}
+	go subscribe()
+	<-arrived
+	// The second subscriber joins the first one's fetch.
+	go subscribe()
+	time.Sleep(50 * time.Millisecond)
+	close(headers)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-firstEvents:
+			if line != "data: one\n" {
+				t.Fatalf("subscriber %d got %q", i, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("subscriber %d did not get the stream live", i)
+		}
+	}
+}
+
+func TestServerEventStreamEndsWithItsClient(t *testing.T) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(gone)
+		case <-done:
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+	client, err := NewUpstreamClient(upstream.URL, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/notifications")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	readEvent(t, bufio.NewReader(resp.Body))
+	// The stream outlives the upstream timeout while its client listens.
+	select {
+	case <-gone:
+		t.Fatal("the upstream timeout cut the event stream")
+	case <-time.After(300 * time.Millisecond):
+	}
+	resp.Body.Close()
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the upstream stream outlived its client")
+	}
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// DefaultMaxRecordBodySize bounds the recorded body of streamed responses
+// when ServerOptions.MaxRecordBodySize is zero.
+const DefaultMaxRecordBodySize = 10 << 20
+
+// errNotRecorded marks a streamed response that reached the client, at least
+// partly, without being recorded: its body exceeded the recording limit or
+// the copy failed midway.
+var errNotRecorded = errors.New("streamed response was not recorded")
+
+// recordBuffer keeps up to limit bytes of a streamed body. Once the body
+// outgrows the limit the buffer is released and later writes are dropped.
+type recordBuffer struct {
+	limit    int64
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (b *recordBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.overflow = true
+		b.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// flushWriter flushes after every write so slow chunked responses reach the
+// client as they arrive.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	flush(f.w)
+	return n, err
+}
+
+// streamResponse copies resp to w while teeing the body into a recording
+// buffer, and returns the recorded response when the whole body fit within
+// limit. Any error is returned after the status line was written.
+func streamResponse(w http.ResponseWriter, resp *http.Response, limit int64) (StoredResponse, error) {
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			if shouldSkipHeader(key, value) {
+				continue
+			}
+			header.Add(key, value)
+		}
+	}
+	if resp.ContentLength >= 0 && len(resp.TransferEncoding) == 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	record := &recordBuffer{limit: limit, overflow: resp.ContentLength > limit}
+	if _, err := io.Copy(flushWriter{w: w}, io.TeeReader(resp.Body, record)); err != nil {
+		return StoredResponse{}, fmt.Errorf("%w: %v", errNotRecorded, err)
+	}
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			header.Add(http.TrailerPrefix+key, value)
+		}
+	}
+	if record.overflow {
+		return StoredResponse{}, fmt.Errorf("%w: body over %d bytes", errNotRecorded, limit)
+	}
+	return storedResponseFromHTTP(resp, record.buf.Bytes()), nil
+}
@@ -0,0 +1,218 @@
+package replay
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordBuffer(t *testing.T) {
+	record := &recordBuffer{limit: 5}
+	_, _ = record.Write([]byte("abc"))
+	_, _ = record.Write([]byte("de"))
+	if record.overflow || record.buf.String() != "abcde" {
+		t.Fatalf("unexpected buffer at limit: %q %v", record.buf.String(), record.overflow)
+	}
+	if n, err := record.Write([]byte("f")); n != 1 || err != nil {
+		t.Fatalf("overflowing write should still succeed: %d %v", n, err)
+	}
+	if !record.overflow || record.buf.Len() != 0 {
+		t.Fatalf("expected the buffer to be released after overflow")
+	}
+}
+
+func TestServerStreamsUpstreamResponses(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("first;"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("second"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream:        client,
+		StreamResponses: true,
+		Plugins:         []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/download")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The first chunk arrives while the upstream is still sending.
+	first := make([]byte, len("first;"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first;" {
+		t.Fatalf("first chunk: %q %v", first, err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != "second" {
+		t.Fatalf("rest of body: %q", rest)
+	}
+
+	stored, found, _ := repo.Get(resp.Request.Context(), "/download|GET|")
+	if !found {
+		t.Fatalf("expected streamed response to be recorded, have %v", repo.data)
+	}
+	if body, _ := base64.StdEncoding.DecodeString(stored.BodyBase64); string(body) != "first;second" {
+		t.Fatalf("recorded body %q", body)
+	}
+}
+
+func TestServerStreamSkipsRecordingLargeBodies(t *testing.T) {
+	body := strings.Repeat("x", 64)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream:          client,
+		StreamResponses:   true,
+		MaxRecordBodySize: 16,
+		Plugins:           []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/large")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	payload, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(payload) != body || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("client should get the whole body: %d bytes, Content-Length %d", len(payload), resp.ContentLength)
+	}
+	if len(repo.data) != 0 {
+		t.Fatalf("oversized response should not be recorded: %v", repo.data)
+	}
+}
+
+func TestServerStreamOutlivesUpstreamTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first;"))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("second"))
+	}))
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream:        client,
+		StreamResponses: true,
+		Plugins:         []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	payload, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(payload) != "first;second" {
+		t.Fatalf("body cut off after the upstream timeout: %q", payload)
+	}
+	if _, found := repo.data["/slow|GET|"]; !found {
+		t.Fatalf("expected the slow response to be recorded, have %v", repo.data)
+	}
+}
+
+func TestServerUpstreamTimeoutBoundsBufferedBodies(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+	client, err := NewUpstreamClient(upstream.URL, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	router := newTestRouter(t, newMemoryRepo(), ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// The second request follows the first's fetch, so both are bounded
+	// by the leader's timeout.
+	statuses := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(server.URL + "/stalled")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case status := <-statuses:
+			if status != http.StatusBadGateway {
+				t.Fatalf("expected a stalled body to fail with 502, got %d", status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a stalled upstream body hung the request")
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/stalled", nil)
+	if _, _, err := client.Fetch(req.Context(), req, nil); err == nil {
+		t.Fatal("expected Fetch to time out on a stalled body")
+	}
+}
+
+func TestUpstreamTimeoutBoundsResponseHeaders(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+	client, err := NewUpstreamClient(upstream.URL, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hang", nil)
+	if _, err := client.FetchStream(req.Context(), req, nil); err == nil {
+		t.Fatal("expected missing response headers to time out")
+	}
+}
@@ -0,0 +1,165 @@
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxTNetstringLength guards against corrupt length prefixes allocating huge buffers.
+const maxTNetstringLength = 1 << 30
+
+// tnetstringReader decodes the tnetstring values mitmproxy writes to .flow files.
+// Bytes and unicode strings decode to string, dicts to map[string]interface{},
+// lists to []interface{}, integers to int64, floats to float64 and booleans to bool.
+type tnetstringReader struct {
+	reader *bufio.Reader
+}
+
+func newTNetstringReader(r io.Reader) *tnetstringReader {
+	return &tnetstringReader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next top-level value, or io.EOF once the stream is exhausted.
+func (r *tnetstringReader) Next() (interface{}, error) {
+	size, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return parseTNetstringPayload(payload[:size], payload[size])
+}
+
+func (r *tnetstringReader) readLength() (int, error) {
+	digits := make([]byte, 0, 12)
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(digits) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b == ':' {
+			break
+		}
+		if b < '0' || b > '9' || len(digits) >= 12 {
+			return 0, fmt.Errorf("tnetstring: invalid length prefix %q", append(digits, b))
+		}
+		digits = append(digits, b)
+	}
+	return parseTNetstringLength(digits)
+}
+
+func parseTNetstringLength(digits []byte) (int, error) {
+	if len(digits) == 0 {
+		return 0, errors.New("tnetstring: empty length prefix")
+	}
+	size, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return 0, fmt.Errorf("tnetstring: invalid length prefix %q", digits)
+	}
+	if size > maxTNetstringLength {
+		return 0, fmt.Errorf("tnetstring: length %d exceeds limit", size)
+	}
+	return size, nil
+}
+
+// parseTNetstring decodes one value from data and returns the unread remainder.
+func parseTNetstring(data []byte) (interface{}, []byte, error) {
+	colon := -1
+	for i := 0; i < len(data) && i <= 12; i++ {
+		if data[i] == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return nil, nil, errors.New("tnetstring: missing length prefix")
+	}
+	size, err := parseTNetstringLength(data[:colon])
+	if err != nil {
+		return nil, nil, err
+	}
+	end := colon + 1 + size
+	if end >= len(data) {
+		return nil, nil, errors.New("tnetstring: truncated value")
+	}
+	value, err := parseTNetstringPayload(data[colon+1:end], data[end])
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, data[end+1:], nil
+}
+
+func parseTNetstringPayload(payload []byte, tag byte) (interface{}, error) {
+	switch tag {
+	case ',', ';':
+		return string(payload), nil
+	case '#':
+		value, err := strconv.ParseInt(string(payload), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("tnetstring: invalid integer %q", payload)
+		}
+		return value, nil
+	case '^':
+		value, err := strconv.ParseFloat(string(payload), 64)
+		if err != nil {
+			return nil, fmt.Errorf("tnetstring: invalid float %q", payload)
+		}
+		return value, nil
+	case '!':
+		switch string(payload) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("tnetstring: invalid boolean %q", payload)
+	case '~':
+		if len(payload) != 0 {
+			return nil, errors.New("tnetstring: null with payload")
+		}
+		return nil, nil
+	case ']':
+		items := make([]interface{}, 0)
+		for len(payload) > 0 {
+			item, rest, err := parseTNetstring(payload)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			payload = rest
+		}
+		return items, nil
+	case '}':
+		dict := make(map[string]interface{})
+		for len(payload) > 0 {
+			key, rest, err := parseTNetstring(payload)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("tnetstring: unsupported dict key type %T", key)
+			}
+			value, rest, err := parseTNetstring(rest)
+			if err != nil {
+				return nil, err
+			}
+			dict[name] = value
+			payload = rest
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("tnetstring: unknown type tag %q", tag)
+	}
+}
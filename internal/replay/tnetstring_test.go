@@ -0,0 +1,50 @@
+package replay
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTNetstringNested(t *testing.T) {
+	input := "53:4:name;5:hello,5:items;17:1:1#3:2.5^4:true!]3:nil;0:~}"
+	got, rest, err := parseTNetstring([]byte(input))
+	if err != nil {
+		t.Fatalf("parseTNetstring: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("unexpected remainder: %q", rest)
+	}
+	want := map[string]interface{}{
+		"name":  "hello",
+		"items": []interface{}{int64(1), 2.5, true},
+		"nil":   nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v want %#v", got, want)
+	}
+}
+
+func TestTNetstringReaderStream(t *testing.T) {
+	reader := newTNetstringReader(strings.NewReader("1:a,2:42#"))
+	first, err := reader.Next()
+	if err != nil || first != "a" {
+		t.Fatalf("unexpected first value: %#v, %v", first, err)
+	}
+	second, err := reader.Next()
+	if err != nil || second != int64(42) {
+		t.Fatalf("unexpected second value: %#v, %v", second, err)
+	}
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestTNetstringReaderTruncated(t *testing.T) {
+	reader := newTNetstringReader(strings.NewReader("10:abc"))
+	if _, err := reader.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
@@ -3,17 +3,29 @@ package replay
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 type UpstreamClient struct {
 	baseURL *url.URL
 	client  *http.Client
+	// h2c sends gRPC calls to http:// upstreams as cleartext HTTP/2; https
+	// upstreams negotiate HTTP/2 through client.
+	h2c *http.Client
+	// timeout bounds the whole response, body included, unless the body is
+	// streamed to the client; see streamBody.
+	timeout time.Duration
 }
 
 func NewUpstreamClient(baseURL string, timeout time.Duration) (*UpstreamClient, error) {
@@ -29,31 +41,36 @@ func NewUpstreamClient(baseURL string, timeout time.Duration) (*UpstreamClient,
 	}
 	return &UpstreamClient{
 		baseURL: parsed,
-		client:  &http.Client{Timeout: timeout},
+		client:  &http.Client{},
+		h2c:     newH2CClient(),
+		timeout: timeout,
 	}, nil
 }
 
-func (u *UpstreamClient) Fetch(ctx context.Context, req *http.Request, body []byte) (*http.Response, []byte, error) {
-	target := *u.baseURL
-	if req.URL.Scheme != "" && req.URL.Host != "" {
-		target = *req.URL
-	} else {
-		target.Path = req.URL.Path
-		target.RawQuery = req.URL.RawQuery
+// NewProxyUpstreamClient returns a client without a base URL for forward-proxy
+// mode, where every request carries its own absolute target.
+func NewProxyUpstreamClient(timeout time.Duration) *UpstreamClient {
+	return &UpstreamClient{client: &http.Client{}, h2c: newH2CClient(), timeout: timeout}
+}
+
+func newH2CClient() *http.Client {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
 	}
+	return &http.Client{Transport: transport}
+}
 
-	forwardReq, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+// Fetch forwards req and reads the whole response within the timeout.
+func (u *UpstreamClient) Fetch(ctx context.Context, req *http.Request, body []byte) (*http.Response, []byte, error) {
+	forwardReq, err := u.newRequest(ctx, req, body)
 	if err != nil {
 		return nil, nil, err
 	}
-	if target.Host != "" {
-		forwardReq.Host = target.Host
-	} else {
-		forwardReq.Host = u.baseURL.Host
-	}
-	forwardReq.Header = cloneRequestHeaders(req.Header)
-
-	resp, err := u.client.Do(forwardReq)
+	resp, err := u.do(forwardReq)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -66,6 +83,151 @@ func (u *UpstreamClient) Fetch(ctx context.Context, req *http.Request, body []by
 	return resp, respBody, nil
 }
 
+// FetchStream forwards req like Fetch but returns as soon as the response
+// headers arrive. The timeout only bounds the headers: the body is read under
+// ctx for as long as the upstream sends it. The caller reads and closes
+// resp.Body.
+func (u *UpstreamClient) FetchStream(ctx context.Context, req *http.Request, body []byte) (*http.Response, error) {
+	forwardReq, err := u.newRequest(ctx, req, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.do(forwardReq)
+	if err != nil {
+		return nil, err
+	}
+	streamBody(ctx, resp)
+	return resp, nil
+}
+
+// fetchFor forwards the request of rc like Fetch once the upstream request
+// plugins of its chain have seen the outgoing request, and returns as soon as
+// the response headers arrive. The timeout still covers reading the body
+// unless the caller streams it; see streamBody.
+func (u *UpstreamClient) fetchFor(ctx context.Context, rc *RequestContext) (*http.Response, error) {
+	forwardReq, err := u.newRequest(ctx, rc.Request, rc.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyUpstreamRequestPlugins(rc.plugins, rc, forwardReq); err != nil {
+		return nil, err
+	}
+	return u.do(forwardReq)
+}
+
+// newRequest builds the request sent upstream for req.
+func (u *UpstreamClient) newRequest(ctx context.Context, req *http.Request, body []byte) (*http.Request, error) {
+	target, err := u.target(req)
+	if err != nil {
+		return nil, err
+	}
+	forwardReq, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	forwardReq.Host = target.Host
+	forwardReq.Header = cloneRequestHeaders(req.Header)
+	if isGRPC(req.Header) {
+		// gRPC servers expect the TE header that hop-by-hop stripping drops.
+		forwardReq.Header.Set("TE", "trailers")
+	}
+	return forwardReq, nil
+}
+
+// do sends forwardReq and gives up when the whole response, body included,
+// does not arrive within the timeout.
+func (u *UpstreamClient) do(forwardReq *http.Request) (*http.Response, error) {
+	client := u.client
+	if isGRPC(forwardReq.Header) && forwardReq.URL.Scheme == "http" {
+		client = u.h2c
+	}
+
+	ctx, cancel := context.WithCancel(forwardReq.Context())
+	body := &timedBody{cancel: cancel, host: forwardReq.URL.Host, timeout: u.timeout}
+	if u.timeout > 0 {
+		body.timer = time.AfterFunc(u.timeout, func() {
+			body.expired.Store(true)
+			cancel()
+		})
+	}
+	resp, err := client.Do(forwardReq.WithContext(ctx))
+	if err != nil {
+		body.stopTimer()
+		cancel()
+		if body.expired.Load() {
+			return nil, fmt.Errorf("upstream %s: no response headers within %s", body.host, u.timeout)
+		}
+		return nil, err
+	}
+	body.ReadCloser = resp.Body
+	resp.Body = body
+	return resp, nil
+}
+
+// timedBody is an upstream response body read under the upstream timeout.
+// Closing it releases the request context.
+type timedBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired atomic.Bool
+	// stop detaches the context streamBody tied the fetch to.
+	stop    func() bool
+	host    string
+	timeout time.Duration
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.expired.Load() {
+		err = fmt.Errorf("upstream %s: response not complete within %s", b.host, b.timeout)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.stopTimer()
+	if b.stop != nil {
+		b.stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (b *timedBody) stopTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// streamBody lifts the upstream timeout from the body of resp, which is relayed
+// to a client as it arrives for as long as the upstream sends it. The fetch is
+// abandoned once ctx ends instead. A timeout that already expired stands.
+func streamBody(ctx context.Context, resp *http.Response) {
+	body, ok := resp.Body.(*timedBody)
+	if !ok {
+		return
+	}
+	body.stopTimer()
+	body.stop = context.AfterFunc(ctx, body.cancel)
+}
+
+// target resolves where req is forwarded: its own absolute URL in
+// forward-proxy mode, otherwise the base URL with the request path.
+func (u *UpstreamClient) target(req *http.Request) (url.URL, error) {
+	if req.URL.Scheme != "" && req.URL.Host != "" {
+		return *req.URL, nil
+	}
+	if u.baseURL == nil {
+		return url.URL{}, errors.New("request has no absolute URL and no upstream base URL is configured")
+	}
+	target := *u.baseURL
+	target.Path = req.URL.Path
+	target.RawQuery = req.URL.RawQuery
+	return target, nil
+}
+
 func cloneRequestHeaders(source http.Header) http.Header {
 	cloned := source.Clone()
 	stripHopByHopHeaders(cloned)
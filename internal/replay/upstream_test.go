@@ -1,7 +1,9 @@
 package replay
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -15,6 +17,16 @@ func TestNewUpstreamClientValidation(t *testing.T) {
 	}
 }
 
+func TestProxyUpstreamRequiresAbsoluteURL(t *testing.T) {
+	client := NewProxyUpstreamClient(time.Second)
+	req := httptest.NewRequest(http.MethodGet, "/relative", nil)
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	if _, _, err := client.Fetch(context.Background(), req, nil); err == nil {
+		t.Fatal("expected error for relative request without base URL")
+	}
+}
+
 func TestCloneRequestHeaders(t *testing.T) {
 	headers := http.Header{
 		"Connection":      []string{"keep-alive"},
@@ -0,0 +1,560 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebSocket replay modes: how recorded server messages are chosen for each
+// client message.
+const (
+	// WebSocketOrdered answers the n-th client message with the server
+	// messages recorded after the n-th recorded client message.
+	WebSocketOrdered = "ordered"
+	// WebSocketMatch answers a client message with the server messages
+	// recorded after the first unused client message with the same content.
+	WebSocketMatch = "match"
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// maxWSPayload bounds a single frame so a bad peer cannot exhaust memory.
+	maxWSPayload = 64 << 20
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// StoredWSMessage is one data message of a recorded WebSocket conversation.
+type StoredWSMessage struct {
+	OffsetMillis int64 `json:"offset_ms"`
+	FromClient   bool  `json:"from_client"`
+	Binary       bool  `json:"binary,omitempty"`
+	// Data is the text payload, or the base64 payload of binary messages.
+	Data string `json:"data"`
+}
+
+func (m StoredWSMessage) payload() []byte {
+	if !m.Binary {
+		return []byte(m.Data)
+	}
+	payload, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+func (m StoredWSMessage) opcode() byte {
+	if m.Binary {
+		return wsBinary
+	}
+	return wsText
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func (f wsFrame) control() bool {
+	return f.opcode >= wsClose
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// readWSFrame reads one frame and unmasks its payload.
+func readWSFrame(r io.Reader) (wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return wsFrame{}, err
+	}
+	frame := wsFrame{fin: head[0]&0x80 != 0, opcode: head[0] & 0x0f}
+	if head[0]&0x70 != 0 {
+		return wsFrame{}, errors.New("websocket: reserved bits set; extensions are not supported")
+	}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWSPayload {
+		return wsFrame{}, fmt.Errorf("websocket: frame of %d bytes is too large", length)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return wsFrame{}, err
+		}
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return wsFrame{}, err
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= mask[i%4]
+		}
+	}
+	return frame, nil
+}
+
+// writeWSFrame writes frame, masking it as clients must.
+func writeWSFrame(w io.Writer, frame wsFrame, masked bool) error {
+	head := make([]byte, 2, 14)
+	head[0] = frame.opcode
+	if frame.fin {
+		head[0] |= 0x80
+	}
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		head[1] = byte(length)
+	case length <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(length))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(length))
+	}
+	payload := frame.payload
+	if masked {
+		head[1] |= 0x80
+		// RFC 6455 5.3: client masks must be unpredictable.
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		head = append(head, mask[:]...)
+		payload = make([]byte, length)
+		for i, b := range frame.payload {
+			payload[i] = b ^ mask[i%4]
+		}
+	}
+	_, err := w.Write(append(head, payload...))
+	return err
+}
+
+// wsAssembler joins fragmented data frames into messages.
+type wsAssembler struct {
+	opcode  byte
+	payload []byte
+}
+
+// add returns the complete message once its final frame arrives. Control
+// frames are ignored.
+func (a *wsAssembler) add(frame wsFrame) (byte, []byte, bool) {
+	if frame.control() {
+		return 0, nil, false
+	}
+	if frame.opcode != wsContinuation {
+		a.opcode, a.payload = frame.opcode, nil
+	}
+	a.payload = append(a.payload, frame.payload...)
+	if !frame.fin {
+		return 0, nil, false
+	}
+	payload := a.payload
+	a.payload = nil
+	return a.opcode, payload, true
+}
+
+func newStoredWSMessage(start time.Time, fromClient bool, opcode byte, payload []byte) StoredWSMessage {
+	message := StoredWSMessage{OffsetMillis: time.Since(start).Milliseconds(), FromClient: fromClient}
+	if opcode == wsBinary {
+		message.Binary = true
+		message.Data = base64.StdEncoding.EncodeToString(payload)
+	} else {
+		message.Data = string(payload)
+	}
+	return message
+}
+
+// dialWebSocket sends the client's handshake to the upstream, after the
+// upstream request plugins of rc's chain have seen it, and returns the
+// connection with the upstream's handshake response. Extensions are not
+// negotiated so frames can be relayed and recorded as they are.
+func (u *UpstreamClient) dialWebSocket(ctx context.Context, rc *RequestContext) (net.Conn, *bufio.Reader, *http.Response, error) {
+	req := rc.Request
+	target, err := u.target(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	addr := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" || target.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(target.Hostname(), port)
+	}
+
+	handshake := (&http.Request{
+		Method:     http.MethodGet,
+		URL:        &target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       target.Host,
+		Header:     req.Header.Clone(),
+	}).WithContext(ctx)
+	handshake.Header.Del("Sec-WebSocket-Extensions")
+	handshake.Header.Del("Proxy-Connection")
+	handshake.Header.Del("Proxy-Authorization")
+	handshake.Header.Set("Connection", "Upgrade")
+	handshake.Header.Set("Upgrade", "websocket")
+	if err := applyUpstreamRequestPlugins(rc.plugins, rc, handshake); err != nil {
+		return nil, nil, nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: u.timeout}
+	var conn net.Conn
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: target.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if u.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(u.timeout))
+	}
+	if err := handshake.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, handshake)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, reader, resp, nil
+}
+
+// writeHandshakeResponse writes a 101 response on a hijacked connection.
+func writeHandshakeResponse(w *bufio.Writer, header http.Header) error {
+	if _, err := w.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// wsCloseGrace is how long the other direction of a relayed connection may
+// keep going once one side closed, so close handshakes complete.
+const wsCloseGrace = time.Second
+
+// wsRecorder collects the data messages of a relayed connection, up to limit
+// payload bytes in total.
+type wsRecorder struct {
+	mu       sync.Mutex
+	start    time.Time
+	limit    int64
+	size     int64
+	overflow bool
+	messages []StoredWSMessage
+}
+
+func (r *wsRecorder) add(fromClient bool, opcode byte, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.overflow {
+		return
+	}
+	r.size += int64(len(payload))
+	if r.size > r.limit {
+		r.overflow = true
+		r.messages = nil
+		return
+	}
+	r.messages = append(r.messages, newStoredWSMessage(r.start, fromClient, opcode, payload))
+}
+
+// relayWSFrames copies frames from src to dst until a close frame was passed
+// on or either side fails. Frames towards the upstream are masked.
+func relayWSFrames(src io.Reader, dst io.Writer, fromClient bool, record *wsRecorder) {
+	var assembler wsAssembler
+	for {
+		frame, err := readWSFrame(src)
+		if err != nil {
+			return
+		}
+		if err := writeWSFrame(dst, frame, fromClient); err != nil {
+			return
+		}
+		if frame.opcode == wsClose {
+			return
+		}
+		if opcode, payload, ok := assembler.add(frame); ok {
+			record.add(fromClient, opcode, payload)
+		}
+	}
+}
+
+// proxyWebSocket forwards an upgrade request to the upstream and relays the
+// connection frame by frame. Once it closes, the handshake response and the
+// messages of both directions pass through the response plugins, which
+// store them under the handshake's key. A refused upgrade is answered like
+// any other upstream response.
+func proxyWebSocket(c *gin.Context, options ServerOptions, ctx *RequestContext) {
+	upstream, upstreamReader, resp, err := options.Upstream.dialWebSocket(c.Request.Context(), ctx)
+	if err != nil && isPluginError(err) {
+		log.Printf("upstream request plugin failed: %v", err)
+		c.Status(statusFromPluginError(err))
+		return
+	}
+	if err != nil {
+		log.Printf("websocket dial failed: %v", err)
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("upstream fetch failed: %v", err)
+			c.Status(http.StatusBadGateway)
+			return
+		}
+		stored := storedResponseFromHTTP(resp, body)
+		if pluginErr := applyResponsePlugins(ctx.plugins, ctx, &stored); pluginErr != nil {
+			log.Printf("response plugin failed: %v", pluginErr)
+			c.Status(statusFromPluginError(pluginErr))
+			return
+		}
+		if writeErr := options.writeResponse(c, stored); writeErr != nil {
+			log.Printf("write response failed: %v", writeErr)
+		}
+		return
+	}
+
+	conn, buffered, err := c.Writer.Hijack()
+	if err != nil {
+		log.Printf("websocket hijack failed: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if err := writeHandshakeResponse(buffered.Writer, resp.Header); err != nil {
+		log.Printf("websocket handshake failed: %v", err)
+		return
+	}
+
+	record := &wsRecorder{start: time.Now(), limit: options.maxRecordBodySize()}
+	done := make(chan struct{}, 2)
+	go func() {
+		relayWSFrames(buffered.Reader, upstream, true, record)
+		done <- struct{}{}
+	}()
+	go func() {
+		relayWSFrames(upstreamReader, conn, false, record)
+		done <- struct{}{}
+	}()
+	<-done
+	deadline := time.Now().Add(wsCloseGrace)
+	_ = conn.SetReadDeadline(deadline)
+	_ = upstream.SetReadDeadline(deadline)
+	<-done
+
+	if record.overflow {
+		log.Printf("websocket %s: %v: messages over %d bytes", ctx.KeyPrefix+ctx.Key, errNotRecorded, record.limit)
+		return
+	}
+	stored := storedResponseFromHTTP(resp, nil)
+	stored.WebSocket = record.messages
+	if pluginErr := applyResponsePlugins(ctx.plugins, ctx, &stored); pluginErr != nil {
+		log.Printf("response plugin failed: %v", pluginErr)
+	}
+}
+
+// wsTurn is a recorded client message and the server messages that followed
+// it.
+type wsTurn struct {
+	client  StoredWSMessage
+	replies []StoredWSMessage
+	used    bool
+}
+
+// wsScript answers client messages from a recorded conversation.
+type wsScript struct {
+	mode    string
+	initial []StoredWSMessage
+	turns   []*wsTurn
+	next    int
+}
+
+func newWSScript(messages []StoredWSMessage, mode string) *wsScript {
+	script := &wsScript{mode: mode}
+	for _, message := range messages {
+		switch {
+		case message.FromClient:
+			script.turns = append(script.turns, &wsTurn{client: message})
+		case len(script.turns) == 0:
+			script.initial = append(script.initial, message)
+		default:
+			last := script.turns[len(script.turns)-1]
+			last.replies = append(last.replies, message)
+		}
+	}
+	return script
+}
+
+// reply returns the server messages answering a client message, or false
+// when the recording has no answer for it.
+func (s *wsScript) reply(opcode byte, payload []byte) ([]StoredWSMessage, bool) {
+	if s.mode == WebSocketMatch {
+		for _, turn := range s.turns {
+			if !turn.used && turn.client.opcode() == opcode && bytes.Equal(turn.client.payload(), payload) {
+				turn.used = true
+				return turn.replies, true
+			}
+		}
+		return nil, false
+	}
+	if s.next >= len(s.turns) {
+		return nil, false
+	}
+	turn := s.turns[s.next]
+	s.next++
+	return turn.replies, true
+}
+
+// replayWebSocket accepts the upgrade itself and plays back a recorded
+// conversation: server messages sent before the client's first message go
+// out at once, and each client message is answered per mode.
+func replayWebSocket(c *gin.Context, stored StoredResponse, mode string) error {
+	key := c.Request.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		c.Status(http.StatusBadRequest)
+		return errors.New("websocket: missing Sec-WebSocket-Key")
+	}
+	conn, buffered, err := c.Writer.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	header := http.Header{}
+	for _, h := range stored.Headers {
+		switch http.CanonicalHeaderKey(h.Key) {
+		case "Sec-Websocket-Accept", "Sec-Websocket-Extensions", "Upgrade", "Connection", "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		header.Add(h.Key, h.Value)
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", webSocketAccept(key))
+	if err := writeHandshakeResponse(buffered.Writer, header); err != nil {
+		return err
+	}
+
+	script := newWSScript(stored.WebSocket, mode)
+	send := func(messages []StoredWSMessage) error {
+		for _, message := range messages {
+			if err := writeWSFrame(conn, wsFrame{fin: true, opcode: message.opcode(), payload: message.payload()}, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := send(script.initial); err != nil {
+		return err
+	}
+
+	var assembler wsAssembler
+	for {
+		frame, err := readWSFrame(buffered.Reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch frame.opcode {
+		case wsPing:
+			if err := writeWSFrame(conn, wsFrame{fin: true, opcode: wsPong, payload: frame.payload}, false); err != nil {
+				return err
+			}
+			continue
+		case wsClose:
+			return writeWSFrame(conn, wsFrame{fin: true, opcode: wsClose, payload: frame.payload}, false)
+		}
+		opcode, payload, ok := assembler.add(frame)
+		if !ok {
+			continue
+		}
+		replies, found := script.reply(opcode, payload)
+		if !found {
+			log.Printf("websocket replay: no recorded answer for %q", payload)
+			continue
+		}
+		if err := send(replies); err != nil {
+			return err
+		}
+	}
+}
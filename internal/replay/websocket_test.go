@@ -0,0 +1,289 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTestWebSocket performs a client handshake against server and returns the
+// connection with a reader positioned at the first frame.
+func dialTestWebSocket(t *testing.T, serverURL, path string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	req, _ := http.NewRequest(http.MethodGet, serverURL+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept %q", got)
+	}
+	return conn, reader
+}
+
+func sendText(t *testing.T, conn net.Conn, text string) {
+	t.Helper()
+	if err := writeWSFrame(conn, wsFrame{fin: true, opcode: wsText, payload: []byte(text)}, true); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+func readText(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	frame, err := readWSFrame(reader)
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if frame.opcode != wsText {
+		t.Fatalf("expected a text frame, got opcode %d", frame.opcode)
+	}
+	return string(frame.payload)
+}
+
+// newEchoWebSocketServer greets each connection and echoes text messages.
+func newEchoWebSocketServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) || r.Header.Get("Sec-WebSocket-Extensions") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := http.Header{}
+		header.Set("Upgrade", "websocket")
+		header.Set("Connection", "Upgrade")
+		header.Set("Sec-WebSocket-Accept", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		header.Set("X-Upstream", "echo")
+		if err := writeHandshakeResponse(buffered.Writer, header); err != nil {
+			return
+		}
+		_ = writeWSFrame(conn, wsFrame{fin: true, opcode: wsText, payload: []byte("hello")}, false)
+		var assembler wsAssembler
+		for {
+			frame, err := readWSFrame(buffered.Reader)
+			if err != nil {
+				return
+			}
+			if frame.opcode == wsClose {
+				_ = writeWSFrame(conn, frame, false)
+				return
+			}
+			if _, payload, ok := assembler.add(frame); ok {
+				_ = writeWSFrame(conn, wsFrame{fin: true, opcode: wsText, payload: append([]byte("echo: "), payload...)}, false)
+			}
+		}
+	}))
+}
+
+func TestWSFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 70000} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		for _, masked := range []bool{false, true} {
+			var buf bytes.Buffer
+			if err := writeWSFrame(&buf, wsFrame{fin: true, opcode: wsBinary, payload: payload}, masked); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			frame, err := readWSFrame(&buf)
+			if err != nil {
+				t.Fatalf("read %d bytes (masked %v): %v", size, masked, err)
+			}
+			if !frame.fin || frame.opcode != wsBinary || !bytes.Equal(frame.payload, payload) {
+				t.Fatalf("round trip of %d bytes (masked %v) changed the frame", size, masked)
+			}
+		}
+	}
+}
+
+func TestWSAssemblerJoinsFragments(t *testing.T) {
+	var assembler wsAssembler
+	if _, _, ok := assembler.add(wsFrame{opcode: wsText, payload: []byte("hel")}); ok {
+		t.Fatalf("first fragment should not complete a message")
+	}
+	if _, _, ok := assembler.add(wsFrame{fin: true, opcode: wsPing}); ok {
+		t.Fatalf("control frames are not messages")
+	}
+	opcode, payload, ok := assembler.add(wsFrame{fin: true, opcode: wsContinuation, payload: []byte("lo")})
+	if !ok || opcode != wsText || string(payload) != "hello" {
+		t.Fatalf("unexpected message %d %q %v", opcode, payload, ok)
+	}
+}
+
+func TestServerRecordsWebSocket(t *testing.T) {
+	upstream := newEchoWebSocketServer(t)
+	defer upstream.Close()
+	client, err := NewUpstreamClient(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamClient: %v", err)
+	}
+
+	repo := newMemoryRepo()
+	router := newTestRouter(t, repo, ServerOptions{
+		Upstream: client,
+		Plugins:  []Plugin{NewReplayPlugin(), NewRecordPlugin()},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, reader := dialTestWebSocket(t, server.URL, "/socket")
+	if got := readText(t, reader); got != "hello" {
+		t.Fatalf("greeting: %q", got)
+	}
+	sendText(t, conn, "a")
+	if got := readText(t, reader); got != "echo: a" {
+		t.Fatalf("first reply: %q", got)
+	}
+	sendText(t, conn, "b")
+	if got := readText(t, reader); got != "echo: b" {
+		t.Fatalf("second reply: %q", got)
+	}
+	if err := writeWSFrame(conn, wsFrame{fin: true, opcode: wsClose}, true); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	if frame, err := readWSFrame(reader); err != nil || frame.opcode != wsClose {
+		t.Fatalf("expected the close to be echoed, got %v %v", frame.opcode, err)
+	}
+
+	// The entry is stored once the proxy sees the connection end.
+	var stored StoredResponse
+	found := false
+	for deadline := time.Now().Add(5 * time.Second); !found && time.Now().Before(deadline); {
+		stored, found, _ = repo.Get(context.Background(), "/socket|GET|")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found {
+		t.Fatalf("expected the connection to be recorded")
+	}
+	if stored.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected a 101 entry, got %d", stored.StatusCode)
+	}
+	var got []string
+	for _, message := range stored.WebSocket {
+		side := "server"
+		if message.FromClient {
+			side = "client"
+		}
+		got = append(got, side+" "+message.Data)
+	}
+	want := "server hello,client a,server echo: a,client b,server echo: b"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("recorded %q, want %q", strings.Join(got, ","), want)
+	}
+}
+
+func recordedConversation() StoredResponse {
+	return StoredResponse{
+		StatusCode: http.StatusSwitchingProtocols,
+		Headers: []Header{
+			{Key: "Upgrade", Value: "websocket"},
+			{Key: "Sec-WebSocket-Accept", Value: "stale"},
+			{Key: "X-Upstream", Value: "echo"},
+		},
+		WebSocket: []StoredWSMessage{
+			{FromClient: false, Data: "hello"},
+			{FromClient: true, Data: "a"},
+			{FromClient: false, Data: "echo: a"},
+			{FromClient: true, Data: "b"},
+			{FromClient: false, Data: "echo: b"},
+			{FromClient: false, Data: "bye"},
+		},
+	}
+}
+
+func newWebSocketReplayServer(t *testing.T, mode string) *httptest.Server {
+	repo := newMemoryRepo()
+	if err := repo.Set(context.Background(), "/socket|GET|", recordedConversation(), true); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	server := httptest.NewServer(newTestRouter(t, repo, ServerOptions{
+		WebSocketReplay: mode,
+		Plugins:         []Plugin{NewReplayPlugin()},
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServerReplaysWebSocketInOrder(t *testing.T) {
+	server := newWebSocketReplayServer(t, WebSocketOrdered)
+	conn, reader := dialTestWebSocket(t, server.URL, "/socket")
+	if got := readText(t, reader); got != "hello" {
+		t.Fatalf("greeting: %q", got)
+	}
+	sendText(t, conn, "anything")
+	if got := readText(t, reader); got != "echo: a" {
+		t.Fatalf("first reply: %q", got)
+	}
+	sendText(t, conn, "else")
+	if got := readText(t, reader); got != "echo: b" {
+		t.Fatalf("second reply: %q", got)
+	}
+	if got := readText(t, reader); got != "bye" {
+		t.Fatalf("third reply: %q", got)
+	}
+}
+
+func TestServerReplaysWebSocketByContent(t *testing.T) {
+	server := newWebSocketReplayServer(t, WebSocketMatch)
+	conn, reader := dialTestWebSocket(t, server.URL, "/socket")
+	if got := readText(t, reader); got != "hello" {
+		t.Fatalf("greeting: %q", got)
+	}
+	sendText(t, conn, "b")
+	if got := readText(t, reader); got != "echo: b" {
+		t.Fatalf("reply to b: %q", got)
+	}
+	if got := readText(t, reader); got != "bye" {
+		t.Fatalf("second reply to b: %q", got)
+	}
+	// Unknown messages get no answer; the ping's pong arrives next.
+	sendText(t, conn, "unknown")
+	if err := writeWSFrame(conn, wsFrame{fin: true, opcode: wsPing, payload: []byte("p")}, true); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	if frame, err := readWSFrame(reader); err != nil || frame.opcode != wsPong || string(frame.payload) != "p" {
+		t.Fatalf("expected a pong, got %d %q %v", frame.opcode, frame.payload, err)
+	}
+	sendText(t, conn, "a")
+	if got := readText(t, reader); got != "echo: a" {
+		t.Fatalf("reply to a: %q", got)
+	}
+}
+
+func TestServerRefusesWebSocketEntryWithoutUpgrade(t *testing.T) {
+	server := newWebSocketReplayServer(t, WebSocketOrdered)
+	resp, err := http.Get(server.URL + "/socket")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("expected 426, got %d", resp.StatusCode)
+	}
+}